@@ -1,14 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"telegram-bot/pkg/command"
 )
 
-var handlers = map[string]command.Handler{
-	"echo": command.Echo{},
-}
-
 func main() {
 	log.Println("Starting telegram bot")
 	runner, err := command.NewCommandRunnerFromEnv()
@@ -16,5 +16,17 @@ func main() {
 		panic(err)
 	}
 
-	runner.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := runner.Start(ctx); err != nil {
+		log.Printf("receive updates: %s", err)
+	}
+
+	// A second signal kills the bot right away.
+	stop()
+	log.Println("Shutting down telegram bot")
+	if err := runner.Shutdown(); err != nil {
+		log.Fatalf("shut down: %s", err)
+	}
 }
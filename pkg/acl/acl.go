@@ -0,0 +1,205 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"telegram-bot/pkg/storage"
+)
+
+// Role is the level of access granted to a user or chat.
+type Role string
+
+const (
+	RoleNone  Role = "none"
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+var (
+	ErrInvalidRole = errors.New("invalid role")
+	ErrFixedAdmin  = errors.New("admin is configured and can't be changed")
+	ErrAdminOnly   = errors.New("command is for admins only")
+)
+
+var ranks = map[Role]int{RoleNone: 0, RoleUser: 1, RoleAdmin: 2}
+
+// ParseRole parses the name of a role.
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := ranks[role]; !ok {
+		return RoleNone, fmt.Errorf("'%s': %w", name, ErrInvalidRole)
+	}
+
+	return role, nil
+}
+
+// Allows reports whether role grants at least the access of required.
+func (r Role) Allows(required Role) bool {
+	return ranks[r] >= ranks[required]
+}
+
+// Snapshot is the state of an ACL as it is stored. Grants are keyed by the ID
+// of a user or a chat, group chats have negative IDs and private chats share
+// the ID of their user. Commands holds the role required by commands whose
+// default has been overridden.
+type Snapshot struct {
+	Grants   map[int64]Role  `json:"grants"`
+	Commands map[string]Role `json:"commands"`
+}
+
+func (s Snapshot) copy() Snapshot {
+	c := Snapshot{Grants: map[int64]Role{}, Commands: map[string]Role{}}
+	for id, role := range s.Grants {
+		c.Grants[id] = role
+	}
+
+	for name, role := range s.Commands {
+		c.Commands[name] = role
+	}
+
+	return c
+}
+
+// Store persists the snapshot of an ACL.
+type Store interface {
+	Load() (Snapshot, error)
+	Save(Snapshot) error
+	Close() error
+}
+
+// ACL decides who can use the bot. Admins passed to New are always admins,
+// everyone else gets the role granted to them, or to the chat they are in when
+// they have no grant of their own.
+type ACL struct {
+	admins map[int64]bool
+	state  Snapshot
+	store  Store
+
+	mu sync.Mutex
+}
+
+// New restores the ACL kept in store, a nil store keeps it in memory only.
+func New(store Store, admins ...int64) (*ACL, error) {
+	a := &ACL{admins: map[int64]bool{}, state: Snapshot{}.copy(), store: store}
+	for _, id := range admins {
+		a.admins[id] = true
+	}
+
+	if store == nil {
+		return a, nil
+	}
+
+	state, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load acl: %w", err)
+	}
+
+	a.state = state.copy()
+	return a, nil
+}
+
+// Role returns the role of userID in chatID.
+func (a *ACL) Role(chatID, userID int64) Role {
+	if a.admins[userID] {
+		return RoleAdmin
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if role, ok := a.state.Grants[userID]; ok {
+		return role
+	}
+
+	if role, ok := a.state.Grants[chatID]; ok {
+		return role
+	}
+
+	return RoleNone
+}
+
+// Grant gives role to the user or chat id.
+func (a *ACL) Grant(id int64, role Role) error {
+	if a.admins[id] {
+		return fmt.Errorf("%d: %w", id, ErrFixedAdmin)
+	}
+
+	return a.update(func(s *Snapshot) {
+		s.Grants[id] = role
+	})
+}
+
+// Revoke removes the grant of the user or chat id.
+func (a *ACL) Revoke(id int64) error {
+	if a.admins[id] {
+		return fmt.Errorf("%d: %w", id, ErrFixedAdmin)
+	}
+
+	return a.update(func(s *Snapshot) {
+		delete(s.Grants, id)
+	})
+}
+
+// CommandRole returns the role required by the command name, fallback unless
+// it has been overridden. Commands for admins only always require RoleAdmin.
+func (a *ACL) CommandRole(name string, fallback Role) Role {
+	if fallback == RoleAdmin {
+		return RoleAdmin
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if role, ok := a.state.Commands[name]; ok {
+		return role
+	}
+
+	return fallback
+}
+
+// SetCommandRole overrides fallback, the role required by the command name.
+// Commands for admins only can't be overridden, so no grant can reach the
+// commands handing out grants.
+func (a *ACL) SetCommandRole(name string, role Role, fallback Role) error {
+	if fallback == RoleAdmin {
+		return fmt.Errorf("%s: %w", name, ErrAdminOnly)
+	}
+
+	return a.update(func(s *Snapshot) {
+		s.Commands[name] = role
+	})
+}
+
+// Snapshot returns a copy of the grants and command overrides.
+func (a *ACL) Snapshot() Snapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state.copy()
+}
+
+// Admins returns the IDs of the configured admins.
+func (a *ACL) Admins() []int64 {
+	ids := make([]int64, 0, len(a.admins))
+	for id := range a.admins {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// update changes the grants and command overrides under the lock.
+func (a *ACL) update(change func(*Snapshot)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return storage.Update[Snapshot](&a.state, a.store, "acl", Snapshot.copy, func(next Snapshot) error {
+		change(&next)
+		return nil
+	})
+}
+
+func (a *ACL) Close() error {
+	if a.store == nil {
+		return nil
+	}
+
+	return a.store.Close()
+}
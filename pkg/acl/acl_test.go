@@ -0,0 +1,178 @@
+package acl
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"telegram-bot/pkg/storage"
+	"testing"
+)
+
+// stores lists every Store implementation, each is reopened from the same
+// path to check that the ACL survives a restart.
+var stores = []struct {
+	name string
+	open func(t *testing.T, path string) (Store, error)
+}{
+	{
+		name: "file",
+		open: func(_ *testing.T, path string) (Store, error) {
+			return NewFileStore(path), nil
+		},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T, path string) (Store, error) {
+			db, err := storage.OpenSQLite(path)
+			if err != nil {
+				return nil, err
+			}
+
+			t.Cleanup(func() { db.Close() })
+			return NewSQLStore(db)
+		},
+	},
+}
+
+func TestACL_Role(t *testing.T) {
+	a, err := New(nil, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	a.Grant(2, RoleUser)
+	a.Grant(-100, RoleUser)
+	a.Grant(3, RoleNone)
+
+	cases := []struct {
+		desc     string
+		chatID   int64
+		userID   int64
+		expected Role
+	}{
+		{
+			desc:     "configured admins are admins everywhere",
+			chatID:   -200,
+			userID:   1,
+			expected: RoleAdmin,
+		},
+		{
+			desc:     "users keep their role in any chat",
+			chatID:   -200,
+			userID:   2,
+			expected: RoleUser,
+		},
+		{
+			desc:     "members of allowed chats get the chat's role",
+			chatID:   -100,
+			userID:   4,
+			expected: RoleUser,
+		},
+		{
+			desc:     "user grants take precedence over the chat's",
+			chatID:   -100,
+			userID:   3,
+			expected: RoleNone,
+		},
+		{
+			desc:     "everyone else has no access",
+			chatID:   4,
+			userID:   4,
+			expected: RoleNone,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if role := a.Role(tc.chatID, tc.userID); role != tc.expected {
+				t.Errorf("expected '%v', got '%v'", tc.expected, role)
+			}
+		})
+	}
+}
+
+func TestACL_FixedAdmins(t *testing.T) {
+	a, _ := New(nil, 1)
+	if err := a.Revoke(1); !errors.Is(err, ErrFixedAdmin) {
+		t.Errorf("expected '%v', got '%v'", ErrFixedAdmin, err)
+	}
+
+	if err := a.Grant(1, RoleUser); !errors.Is(err, ErrFixedAdmin) {
+		t.Errorf("expected '%v', got '%v'", ErrFixedAdmin, err)
+	}
+}
+
+func TestACL_AdminCommands(t *testing.T) {
+	a, _ := New(nil, 1)
+	if err := a.SetCommandRole("access", RoleUser, RoleAdmin); !errors.Is(err, ErrAdminOnly) {
+		t.Errorf("expected '%v', got '%v'", ErrAdminOnly, err)
+	}
+
+	a.state.Commands["tweak"] = RoleNone
+	if role := a.CommandRole("tweak", RoleAdmin); role != RoleAdmin {
+		t.Errorf("expected stored overrides of admin commands to be ignored, got '%v'", role)
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	if role, err := ParseRole("admin"); err != nil || role != RoleAdmin {
+		t.Errorf("expected '%v', got '%v' '%v'", RoleAdmin, role, err)
+	}
+
+	if _, err := ParseRole("root"); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("expected '%v', got '%v'", ErrInvalidRole, err)
+	}
+
+	if !RoleAdmin.Allows(RoleUser) || RoleUser.Allows(RoleAdmin) || !RoleNone.Allows(RoleNone) {
+		t.Errorf("unexpected role order")
+	}
+}
+
+func TestStores(t *testing.T) {
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "acl")
+			store, err := s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error opening store: %v", err)
+			}
+
+			a, err := New(store)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			a.Grant(2, RoleAdmin)
+			a.Grant(3, RoleUser)
+			a.Revoke(3)
+			a.SetCommandRole("dump", RoleAdmin, RoleUser)
+			if err := a.Close(); err != nil {
+				t.Fatalf("unexpected error closing: %v", err)
+			}
+
+			store, err = s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error reopening store: %v", err)
+			}
+
+			restored, err := New(store)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			defer restored.Close()
+			expected := Snapshot{
+				Grants:   map[int64]Role{2: RoleAdmin},
+				Commands: map[string]Role{"dump": RoleAdmin},
+			}
+
+			if snap := restored.Snapshot(); !reflect.DeepEqual(snap, expected) {
+				t.Errorf("expected '%v', got '%v'", expected, snap)
+			}
+
+			if role := restored.CommandRole("prompt", RoleUser); role != RoleUser {
+				t.Errorf("expected commands without overrides to keep their role, got '%v'", role)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package acl
+
+import (
+	"database/sql"
+	"fmt"
+	"telegram-bot/pkg/storage"
+)
+
+// FileStore keeps the ACL in a JSON file, which is replaced atomically on
+// every change.
+type FileStore = storage.FileStore[Snapshot]
+
+func NewFileStore(path string) *FileStore {
+	return storage.NewFileStore[Snapshot](path, "acl")
+}
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS acl_grants (
+	id   INTEGER PRIMARY KEY,
+	role TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS acl_commands (
+	name TEXT PRIMARY KEY,
+	role TEXT NOT NULL
+);
+`
+
+// SQLStore keeps the ACL in tables of a SQL database, such as the one threads
+// are stored in.
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, fmt.Errorf("migrate acl schema: %w", err)
+	}
+
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Load() (Snapshot, error) {
+	snap := Snapshot{Grants: map[int64]Role{}, Commands: map[string]Role{}}
+	rows, err := s.db.Query(`SELECT id, role FROM acl_grants`)
+	if err != nil {
+		return snap, fmt.Errorf("query acl grants: %w", err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var role string
+		if err := rows.Scan(&id, &role); err != nil {
+			return snap, fmt.Errorf("scan acl grant: %w", err)
+		}
+
+		snap.Grants[id] = Role(role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return snap, fmt.Errorf("query acl grants: %w", err)
+	}
+
+	rows, err = s.db.Query(`SELECT name, role FROM acl_commands`)
+	if err != nil {
+		return snap, fmt.Errorf("query acl commands: %w", err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var name, role string
+		if err := rows.Scan(&name, &role); err != nil {
+			return snap, fmt.Errorf("scan acl command: %w", err)
+		}
+
+		snap.Commands[name] = Role(role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return snap, fmt.Errorf("query acl commands: %w", err)
+	}
+
+	return snap, nil
+}
+
+func (s *SQLStore) Save(snap Snapshot) error {
+	return storage.ReplaceAll(s.db, "acl", []string{"acl_grants", "acl_commands"}, func(tx *sql.Tx) error {
+		for id, role := range snap.Grants {
+			if _, err := tx.Exec(`INSERT INTO acl_grants (id, role) VALUES (?, ?)`, id, string(role)); err != nil {
+				return fmt.Errorf("save acl grant %d: %w", id, err)
+			}
+		}
+
+		for name, role := range snap.Commands {
+			if _, err := tx.Exec(`INSERT INTO acl_commands (name, role) VALUES (?, ?)`, name, string(role)); err != nil {
+				return fmt.Errorf("save acl command %s: %w", name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close leaves the database open, the ACL only borrows it from whoever
+// opened it.
+func (s *SQLStore) Close() error {
+	return nil
+}
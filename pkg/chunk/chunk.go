@@ -0,0 +1,183 @@
+package chunk
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxMessageLength is the longest text Telegram accepts in a single message,
+// measured in UTF-16 code units.
+const MaxMessageLength int = 4096
+
+const fence string = "```"
+
+// rank orders the places text can be split at, higher is better.
+type rank int
+
+const (
+	rankNone rank = iota
+	rankWord
+	rankSentence
+	rankLine
+	rankParagraph
+)
+
+// Split breaks text into pieces of at most limit UTF-16 code units. It prefers
+// splitting between paragraphs, then lines, then sentences, then words, and
+// avoids splitting code blocks. A code block that has to be split is closed at
+// the end of one piece and reopened at the start of the next so both render.
+func Split(text string, limit int) []string {
+	chunks := []string{}
+	for length(text) > limit {
+		// Leave room to close a code block that is split.
+		end := prefix(text, limit-len(fence)-1)
+		at, open, lang := splitPoint(text, end)
+		if at == 0 {
+			_, at = utf8.DecodeRuneInString(text)
+		}
+
+		head := strings.TrimRight(text[:at], " \n")
+		text = strings.TrimLeft(text[at:], "\n")
+		if open {
+			head += "\n" + fence
+			text = fence + lang + "\n" + text
+		}
+
+		if head != "" {
+			chunks = append(chunks, head)
+		}
+	}
+
+	if strings.TrimSpace(text) != "" || len(chunks) == 0 {
+		chunks = append(chunks, text)
+	}
+
+	return chunks
+}
+
+// length counts the UTF-16 code units of text, which is how Telegram measures
+// message length.
+func length(text string) int {
+	n := 0
+	for _, r := range text {
+		n += utf16Len(r)
+	}
+
+	return n
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+
+	return 1
+}
+
+// prefix returns the byte index where the first limit UTF-16 code units of
+// text end.
+func prefix(text string, limit int) int {
+	n := 0
+	for i, r := range text {
+		n += utf16Len(r)
+		if n > limit {
+			return i
+		}
+	}
+
+	return len(text)
+}
+
+func rankAt(text string, i int) rank {
+	switch {
+	case strings.HasSuffix(text[:i], "\n\n"):
+		return rankParagraph
+	case strings.HasSuffix(text[:i], "\n"):
+		return rankLine
+	case strings.HasSuffix(text[:i], ". "), strings.HasSuffix(text[:i], "! "), strings.HasSuffix(text[:i], "? "):
+		return rankSentence
+	case strings.HasSuffix(text[:i], " "):
+		return rankWord
+	}
+
+	return rankNone
+}
+
+// splitPoint picks where to split text before byte index end. It also reports
+// whether the split falls inside a code block and the language the block was
+// opened with.
+func splitPoint(text string, end int) (at int, open bool, lang string) {
+	type candidate struct {
+		at     int
+		rank   rank
+		inside bool
+		lang   string
+	}
+
+	best := candidate{at: end, inside: false}
+	inside := false
+	blockLang := ""
+	lineStart := 0
+	for i := 1; i <= end; i++ {
+		if text[i-1] == '\n' {
+			line := strings.TrimSpace(text[lineStart : i-1])
+			if strings.HasPrefix(line, fence) {
+				inside = !inside
+				blockLang = strings.TrimPrefix(line, fence)
+			}
+
+			lineStart = i
+		}
+
+		r := rankAt(text, i)
+		if r == rankNone || i < end/2 {
+			continue
+		}
+
+		// Splitting outside of a code block beats any split inside one,
+		// later splits beat earlier ones of the same rank.
+		if better(r, inside, best.rank, best.inside) {
+			best = candidate{at: i, rank: r, inside: inside, lang: blockLang}
+		}
+	}
+
+	if best.rank == rankNone {
+		// No good place to split, cut at the limit without breaking a
+		// character apart.
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+
+		inside, blockLang = fenceState(text[:end])
+		return end, inside, blockLang
+	}
+
+	return best.at, best.inside, best.lang
+}
+
+func better(r rank, inside bool, bestRank rank, bestInside bool) bool {
+	if bestRank == rankNone {
+		return true
+	}
+
+	if inside != bestInside {
+		return !inside
+	}
+
+	return r >= bestRank
+}
+
+// fenceState reports whether text ends inside a code block.
+func fenceState(text string) (bool, string) {
+	inside := false
+	lang := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, fence) {
+			inside = !inside
+			lang = strings.TrimPrefix(line, fence)
+		}
+	}
+
+	return inside, lang
+}
@@ -0,0 +1,85 @@
+package chunk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		desc     string
+		input    string
+		limit    int
+		expected []string
+	}{
+		{
+			desc:     "keeps short text in one piece",
+			input:    "Hello world",
+			limit:    20,
+			expected: []string{"Hello world"},
+		},
+		{
+			desc:     "splits between paragraphs",
+			input:    "First paragraph here.\n\nSecond paragraph here.",
+			limit:    30,
+			expected: []string{"First paragraph here.", "Second paragraph here."},
+		},
+		{
+			desc:     "splits between sentences",
+			input:    "This is one sentence. This is another one.",
+			limit:    30,
+			expected: []string{"This is one sentence.", "This is another one."},
+		},
+		{
+			desc:     "splits between words",
+			input:    "alpha beta gamma delta epsilon",
+			limit:    20,
+			expected: []string{"alpha beta", "gamma delta epsilon"},
+		},
+		{
+			desc:     "cuts text without spaces",
+			input:    strings.Repeat("a", 30),
+			limit:    20,
+			expected: []string{strings.Repeat("a", 16), strings.Repeat("a", 14)},
+		},
+		{
+			desc:  "closes and reopens split code blocks",
+			input: "```go\nline one\nline two\nline three\n```",
+			limit: 30,
+			expected: []string{
+				"```go\nline one\nline two\n```",
+				"```go\nline three\n```",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result := Split(tc.input, tc.limit)
+			if !reflect.DeepEqual(tc.expected, result) {
+				t.Errorf("expected '%q', got '%q'", tc.expected, result)
+			}
+
+			for _, piece := range result {
+				if length(piece) > tc.limit {
+					t.Errorf("piece '%q' is longer than %d", piece, tc.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestSplit_CountsUTF16(t *testing.T) {
+	// Every emoji is two UTF-16 code units.
+	result := Split(strings.Repeat("😀", 10), 10)
+	for _, piece := range result {
+		if length(piece) > 10 {
+			t.Errorf("piece '%q' is longer than 10", piece)
+		}
+	}
+
+	if strings.Join(result, "") != strings.Repeat("😀", 10) {
+		t.Errorf("expected pieces to add up to the input, got '%q'", result)
+	}
+}
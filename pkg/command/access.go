@@ -0,0 +1,259 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/thread"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var (
+	ErrAccessDenied     = errors.New("access denied")
+	ErrAccessControlOff = errors.New("access control is off")
+)
+
+// defaultRole returns the role the command of spec requires unless /access
+// changed it.
+func defaultRole(spec Spec) acl.Role {
+	if spec.Role == "" {
+		return acl.RoleUser
+	}
+
+	return spec.Role
+}
+
+// requiredRole returns the role needed to run the command of spec.
+func (r *CommandRunner) requiredRole(spec Spec) acl.Role {
+	return r.acl.CommandRole(spec.Name, defaultRole(spec))
+}
+
+// authorize checks that the sender of msg may run the command of spec.
+// Senders without any access are denied without a reply, so strangers can't
+// make the bot talk, everyone else is told which role they are missing.
+func (r *CommandRunner) authorize(spec Spec, msg *telegram.Message) error {
+	if r.acl == nil {
+		return nil
+	}
+
+	var userID int64
+	if msg.From != nil {
+		userID = msg.From.ID
+	}
+
+	role := r.acl.Role(msg.Chat.ID, userID)
+	required := r.requiredRole(spec)
+	if role.Allows(required) {
+		return nil
+	}
+
+	if role == acl.RoleNone {
+		return fmt.Errorf("user %d: %w", userID, ErrAccessDenied)
+	}
+
+	return NewError(KindUser, fmt.Sprintf("Only %ss can use /%s.", required, spec.Name), fmt.Errorf("user %d: %w", userID, ErrAccessDenied))
+}
+
+// accessControl returns the ACL of the runner, or an error telling the user
+// how to turn access control on.
+func accessControl(ctx Context) (*acl.ACL, error) {
+	if ctx.Runner.acl == nil {
+		return nil, NewError(KindUser, "Access control is off, set ACL_ADMINS to turn it on.", ErrAccessControlOff)
+	}
+
+	return ctx.Runner.acl, nil
+}
+
+// grantee finds who a grant is for: the ID given as argument, the sender of
+// the message replied to or else the group chat the command was sent in.
+func grantee(ctx Context, args []string) (int64, error) {
+	if len(args) > 0 {
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return 0, NewError(KindUser, fmt.Sprintf("%s isn't the ID of a user or chat.", args[0]), err)
+		}
+
+		return id, nil
+	}
+
+	if ctx.Source != nil && ctx.Source.ReplyToMessage != nil {
+		if from := ctx.Source.ReplyToMessage.From; from != nil && !from.IsBot {
+			return from.ID, nil
+		}
+	}
+
+	if ctx.Source != nil && ctx.Scope == ScopeGroup {
+		return ctx.Source.Chat.ID, nil
+	}
+
+	return 0, NewError(KindUser, "Reply to a message of the user or pass the ID of a user or chat.", ErrMissingArgument)
+}
+
+type Grant struct{}
+
+func (Grant) Exec(ctx Context, msg *thread.Message) error {
+	access, err := accessControl(ctx)
+	if err != nil {
+		return err
+	}
+
+	args := strings.Fields(msg.Text)
+	if len(args) == 0 {
+		return fmt.Errorf("role: %w", ErrMissingArgument)
+	}
+
+	role, err := acl.ParseRole(args[0])
+	if err != nil {
+		return NewError(KindUser, "The roles are admin, user and none.", err)
+	}
+
+	id, err := grantee(ctx, args[1:])
+	if err != nil {
+		return err
+	}
+
+	if err := access.Grant(id, role); err != nil {
+		return err
+	}
+
+	ctx.Runner.Reply(msg, fmt.Sprintf("Granted %s to %d.", role, id), thread.TypeInformational)
+	return nil
+}
+
+func (Grant) Spec() Spec {
+	return Spec{
+		Name:    "grant",
+		Summary: "Give a user or chat access to the bot",
+		Usage:   "Grants the role to the user or chat with the ID, to the sender of the message replied to, or else to the group chat. Every member of a chat has the chat's role unless they have one of their own. The none role takes access away.",
+		Args: []Arg{
+			{Name: "role", Description: "admin, user or none"},
+			{Name: "id", Description: "ID of the user, or the negative ID of a group chat", Optional: true},
+		},
+		Role: acl.RoleAdmin,
+	}
+}
+
+type Revoke struct{}
+
+func (Revoke) Exec(ctx Context, msg *thread.Message) error {
+	access, err := accessControl(ctx)
+	if err != nil {
+		return err
+	}
+
+	id, err := grantee(ctx, strings.Fields(msg.Text))
+	if err != nil {
+		return err
+	}
+
+	if err := access.Revoke(id); err != nil {
+		return err
+	}
+
+	ctx.Runner.Reply(msg, fmt.Sprintf("Revoked the role of %d.", id), thread.TypeInformational)
+	return nil
+}
+
+func (Revoke) Spec() Spec {
+	return Spec{
+		Name:    "revoke",
+		Summary: "Remove the role granted to a user or chat",
+		Usage:   "Removes the role of the user or chat with the ID, of the sender of the message replied to, or else of the group chat.",
+		Args:    []Arg{{Name: "id", Description: "ID of the user, or the negative ID of a group chat", Optional: true}},
+		Role:    acl.RoleAdmin,
+	}
+}
+
+type Access struct{}
+
+func (Access) Exec(ctx Context, msg *thread.Message) error {
+	access, err := accessControl(ctx)
+	if err != nil {
+		return err
+	}
+
+	args := strings.Fields(msg.Text)
+	if len(args) == 0 {
+		ctx.Runner.Reply(msg, BuildAccessReport(ctx.Runner), thread.TypeInformational)
+		return nil
+	}
+
+	if len(args) != 2 {
+		return NewError(KindUser, "Incorrect usage of command, the correct syntax is "+Access{}.Spec().Synopsis(), ErrInvalidParameter)
+	}
+
+	handler, ok := ctx.Runner.handlers.Lookup(strings.TrimPrefix(args[0], "/"))
+	if !ok {
+		return NewError(KindUser, fmt.Sprintf("I don't know the command /%s, send /help to see the ones I know.", args[0]), ErrUnknownCommand)
+	}
+
+	role, err := acl.ParseRole(args[1])
+	if err != nil {
+		return NewError(KindUser, "The roles are admin, user and none.", err)
+	}
+
+	spec := handler.Spec()
+	name := spec.Name
+	err = access.SetCommandRole(name, role, defaultRole(spec))
+	if errors.Is(err, acl.ErrAdminOnly) {
+		return NewError(KindUser, fmt.Sprintf("/%s is for admins only, its role can't be changed.", name), err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Runner.Reply(msg, fmt.Sprintf("/%s now requires the %s role.", name, role), thread.TypeInformational)
+	return nil
+}
+
+// BuildAccessReport lists the admins, the grants and the role every command
+// requires.
+func BuildAccessReport(r *CommandRunner) string {
+	snap := r.acl.Snapshot()
+	var b strings.Builder
+	b.WriteString("```\n")
+	admins := r.acl.Admins()
+	sort.Slice(admins, func(i, j int) bool { return admins[i] < admins[j] })
+	b.WriteString("Admins:\n")
+	for _, id := range admins {
+		b.WriteString(fmt.Sprintf("  %d\n", id))
+	}
+
+	ids := make([]int64, 0, len(snap.Grants))
+	for id := range snap.Grants {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	b.WriteString("\nGrants:\n")
+	for _, id := range ids {
+		b.WriteString(fmt.Sprintf("  %d: %s\n", id, snap.Grants[id]))
+	}
+
+	b.WriteString("\nCommands:\n")
+	for _, h := range r.handlers.Handlers() {
+		spec := h.Spec()
+		b.WriteString(fmt.Sprintf("  /%s: %s\n", spec.Name, r.requiredRole(spec)))
+	}
+
+	b.WriteString("```\n")
+	return b.String()
+}
+
+func (Access) Spec() Spec {
+	return Spec{
+		Name:    "access",
+		Summary: "Show who can use the bot or change the role a command requires",
+		Usage:   "Without arguments lists the admins, the granted roles and the role each command requires. With a command and a role, the command requires that role from then on, except for the commands only admins can use.",
+		Args: []Arg{
+			{Name: "command", Description: "The command to change", Optional: true},
+			{Name: "role", Description: "admin, user or none", Optional: true},
+		},
+		Role: acl.RoleAdmin,
+	}
+}
@@ -0,0 +1,84 @@
+package command
+
+import (
+	"reflect"
+	"strings"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/completion"
+	"testing"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestCommandRunner_AccessControl(t *testing.T) {
+	ctx, srv := newTestContext(t, completion.NewFake("Hi there"))
+	runner := ctx.Runner
+	var err error
+	if runner.acl, err = acl.New(nil, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	runTestRunner(t, runner)
+	admin := telegram.User{ID: 1, FirstName: "Admin"}
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	// Strangers are ignored, the echo of the admin shows that the prompt
+	// before it has been handled.
+	srv.Post(3, user, "/prompt Hello", nil)
+	srv.Post(3, admin, "/echo handled", nil)
+	waitForSent(t, srv, 1)
+
+	stranger := srv.Post(3, user, "I'd like access", nil)
+	srv.Post(3, admin, "/grant user", &stranger)
+	waitForSent(t, srv, 2)
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	reply := waitForSent(t, srv, 3)
+
+	srv.Post(3, user, "/tweak MaxTokens=100", reply)
+	waitForSent(t, srv, 4)
+
+	srv.Post(3, admin, "/access tweak user", nil)
+	waitForSent(t, srv, 5)
+
+	srv.Post(3, admin, "/access prompt admin", nil)
+	waitForSent(t, srv, 6)
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	waitForSent(t, srv, 7)
+
+	srv.Post(3, admin, "/revoke 2", nil)
+	srv.Post(3, user, "/prompt Hello", nil)
+	srv.Post(3, admin, "/access", nil)
+	report := waitForSent(t, srv, 9)
+
+	expected := []string{
+		"handled",
+		"Granted user to 2.",
+		"Hi there",
+		"Only admins can use /tweak.",
+		"/tweak is for admins only, its role can't be changed.",
+		"/prompt now requires the admin role.",
+		"Only admins can use /prompt.",
+		"Revoked the role of 2.",
+	}
+
+	if sent := srv.Sent(); !reflect.DeepEqual(sent[:len(sent)-1], expected) {
+		t.Errorf("expected '%v', got '%v'", expected, sent)
+	}
+
+	for _, line := range []string{"Admins:\n  1\n", "/tweak: admin", "/prompt: admin", "/grant: admin", "/help: none"} {
+		if !strings.Contains(report.Text, line) {
+			t.Errorf("expected the report to contain '%s', got '%s'", line, report.Text)
+		}
+	}
+}
+
+func TestGrant_WithoutAccessControl(t *testing.T) {
+	_, srv := startTestRunner(t, completion.NewFake())
+	srv.Post(3, telegram.User{ID: 2, FirstName: "Foo"}, "/grant admin 2", nil)
+	reply := waitForSent(t, srv, 1)
+	if !strings.Contains(reply.Text, "Access control is off") {
+		t.Errorf("expected access control to be off, got '%s'", reply.Text)
+	}
+}
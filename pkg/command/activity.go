@@ -0,0 +1,102 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// activityInterval is how often a chat action is repeated, Telegram shows it
+// for five seconds or until the bot sends a message.
+var activityInterval = 4 * time.Second
+
+// Activity keeps a chat action such as telegram.ChatTyping shown while a
+// command runs. A nil Activity does nothing.
+type Activity struct {
+	runner *CommandRunner
+	chatID int64
+	action string
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	mu sync.Mutex
+}
+
+// SetChatAction shows action in the chat until the bot sends a message or
+// five seconds passed.
+func (r *CommandRunner) SetChatAction(chatID int64, action string) error {
+	_, err := r.telegramClient.Request(telegram.NewChatAction(chatID, action))
+	if err != nil {
+		return fmt.Errorf("set chat action '%s': %w", action, err)
+	}
+
+	return nil
+}
+
+// StartActivity shows action in the chat right away and keeps it shown until
+// ctx is done or Stop is called.
+func (r *CommandRunner) StartActivity(ctx context.Context, chatID int64, action string) *Activity {
+	a := &Activity{
+		runner: r,
+		chatID: chatID,
+		action: action,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go a.run(ctx)
+	return a
+}
+
+func (a *Activity) run(ctx context.Context) {
+	defer close(a.done)
+	ticker := time.NewTicker(activityInterval)
+	defer ticker.Stop()
+	for {
+		a.mu.Lock()
+		action := a.action
+		a.mu.Unlock()
+
+		if err := a.runner.SetChatAction(a.chatID, action); err != nil {
+			log.Printf("failed to set chat action: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-a.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Set switches the action shown, starting with the next time it is repeated.
+func (a *Activity) Set(action string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.action = action
+}
+
+// Stop stops repeating the action. Once it returns no more actions are sent,
+// so a message sent afterwards isn't followed by a stale indicator.
+func (a *Activity) Stop() {
+	if a == nil {
+		return
+	}
+
+	a.once.Do(func() {
+		close(a.stop)
+	})
+
+	<-a.done
+}
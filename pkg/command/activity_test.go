@@ -0,0 +1,79 @@
+package command
+
+import (
+	"context"
+	"reflect"
+	"telegram-bot/pkg/telegramtest"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func chatActions(calls []telegramtest.Call) []string {
+	actions := []string{}
+	for _, c := range calls {
+		actions = append(actions, c.Params.Get("action"))
+	}
+
+	return actions
+}
+
+func TestActivity(t *testing.T) {
+	interval := activityInterval
+	activityInterval = 10 * time.Millisecond
+	t.Cleanup(func() { activityInterval = interval })
+
+	ctx, srv := newTestContext(t, nil)
+	activity := ctx.Runner.StartActivity(context.Background(), 3, telegram.ChatTyping)
+	if _, err := srv.WaitFor("sendChatAction", 3, time.Second); err != nil {
+		t.Fatalf("expected the action to be repeated: %v", err)
+	}
+
+	activity.Set(telegram.ChatUploadPhoto)
+	calls, err := srv.WaitFor("sendChatAction", 5, time.Second)
+	if err != nil {
+		t.Fatalf("expected the action to be repeated: %v", err)
+	}
+
+	if last := calls[len(calls)-1].Params.Get("action"); last != telegram.ChatUploadPhoto {
+		t.Errorf("expected action '%s', got '%s'", telegram.ChatUploadPhoto, last)
+	}
+
+	activity.Stop()
+	activity.Stop()
+	stopped := chatActions(srv.Calls("sendChatAction"))
+	time.Sleep(5 * activityInterval)
+	if after := chatActions(srv.Calls("sendChatAction")); !reflect.DeepEqual(stopped, after) {
+		t.Errorf("expected no actions after stopping, got '%v'", after[len(stopped):])
+	}
+}
+
+func TestActivity_StopsWithContext(t *testing.T) {
+	ctx, srv := newTestContext(t, nil)
+	running, cancel := context.WithCancel(context.Background())
+	activity := ctx.Runner.StartActivity(running, 3, telegram.ChatRecordVoice)
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		activity.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the activity to stop with its context")
+	}
+
+	if actions := chatActions(srv.Calls("sendChatAction")); !reflect.DeepEqual(actions, []string{telegram.ChatRecordVoice}) {
+		t.Errorf("expected a single action, got '%v'", actions)
+	}
+}
+
+func TestActivity_Nil(t *testing.T) {
+	var activity *Activity
+	activity.Set(telegram.ChatTyping)
+	activity.Stop()
+}
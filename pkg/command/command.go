@@ -2,45 +2,120 @@ package command
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/chunk"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/persona"
+	"telegram-bot/pkg/quota"
+	"telegram-bot/pkg/settings"
+	"telegram-bot/pkg/storage"
+	"telegram-bot/pkg/summary"
 	"telegram-bot/pkg/thread"
+	"telegram-bot/pkg/usage"
 	"time"
 
 	"github.com/PullRequestInc/go-gpt3"
 	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
+// ExpiredThreadReply answers messages that can't be added to their thread
+// because it has been evicted or is full.
+const ExpiredThreadReply string = "This thread has expired and I no longer have its history. Start a new one with /prompt."
+
+// UndoneReply answers replies to messages removed from their thread by /undo.
+const UndoneReply string = "This part of the thread was undone, reply to a message that is still in it to continue."
+
+// PollTimeout is how long a poll for updates waits for one to arrive, stopping
+// waits for the poll in flight so it is kept well below the shutdown timeout.
+const PollTimeout time.Duration = 5 * time.Second
+
+// CommandTimeout is how long a handler may run before its context is
+// cancelled.
+const CommandTimeout time.Duration = 5 * time.Minute
+
 type Handler interface {
 	Exec(Context, *thread.Message) error
-	IsReplyOnly() bool
+	Spec() Spec
+}
+
+// Transport sends messages, edits and chat actions to Telegram.
+// *telegram.BotAPI implements it.
+type Transport interface {
+	Send(c telegram.Chattable) (telegram.Message, error)
+	Request(c telegram.Chattable) (*telegram.APIResponse, error)
 }
 
 type CommandRunner struct {
-	handlers       map[string]Handler
-	telegramClient *telegram.BotAPI
-	gptClient      gpt3.Client
-	repo           *thread.Repository
+	handlers       *Registry
+	bot            *telegram.BotAPI
+	telegramClient Transport
+	// fileEndpoint is where files are downloaded from, in the format of
+	// telegram.FileEndpoint, which is used when it is empty.
+	fileEndpoint string
+	completions  completion.Provider
+	summarizer   *summary.Summarizer
+	repo         thread.Repository
+	// storage is closed once the repository and every store are.
+	storage      Storage
+	streaming    bool
+	editInterval time.Duration
+	webhook      *WebhookConfig
+	dispatcher   *Dispatcher
+	// acl decides who can run which command, everyone can run every
+	// command when it is nil.
+	acl *acl.ACL
+	// userLimiter and chatLimiter limit how fast commands are sent, quotas
+	// how many tokens are used. Nothing is limited when they are nil.
+	userLimiter *quota.Limiter
+	chatLimiter *quota.Limiter
+	quotas      *quota.Quotas
+	// ledger records the usage of the completions, its meter wraps
+	// completions.
+	ledger *usage.Ledger
+	// personas is the library of saved personas, there are none when it is
+	// nil.
+	personas *persona.Library
+	// chatSettings holds the defaults new threads of each chat start with,
+	// they start with the global ones when it is nil.
+	chatSettings *settings.Chats
+
+	// inflight counts the handlers running, they are cancelled through
+	// handlersCtx when Shutdown stops waiting for them.
+	inflight        sync.WaitGroup
+	handlersOnce    sync.Once
+	handlersCtx     context.Context
+	cancelHandlers  context.CancelFunc
+	shutdownTimeout time.Duration
+	// lastUpdateID is the last update received by long polling.
+	lastUpdateID int
 }
 
 type Context struct {
 	Runner   *CommandRunner
-	Telegram *telegram.BotAPI
-	GPT3     gpt3.Client
-	Context  context.Context
-	Threads  *thread.Repository
-}
-
-func (r *CommandRunner) SetTyping(chatID int64) error {
-	action := telegram.NewChatAction(chatID, telegram.ChatTyping)
-	_, err := r.telegramClient.Request(action)
-	if err != nil {
-		return fmt.Errorf("set typing status: %s", err)
-	}
-
-	return nil
+	Telegram Transport
+	// Self is the bot's own user.
+	Self        telegram.User
+	Completions completion.Provider
+	Summarizer  *summary.Summarizer
+	Context     context.Context
+	Threads     thread.Repository
+	// Activity is the chat action shown while the handler runs.
+	Activity *Activity
+	// Scope is the kind of chat the command was sent in.
+	Scope ChatScope
+	// Source is the Telegram message the command was sent with.
+	Source *telegram.Message
+	// CorrelationID identifies the run of the command in the logs and in
+	// the replies to its errors.
+	CorrelationID string
 }
 
 func NewCommandRunnerFromEnv() (*CommandRunner, error) {
@@ -49,131 +124,603 @@ func NewCommandRunnerFromEnv() (*CommandRunner, error) {
 		return nil, errors.New("no telegram token set")
 	}
 
-	openaiToken := os.Getenv("OPENAI_TOKEN")
-	if openaiToken == "" {
-		return nil, errors.New("no openai token set")
-	}
-
 	telegramClient, err := telegram.NewBotAPI(telegramToken)
 	if err != nil {
 		return nil, fmt.Errorf("create telegram bot: %w", err)
 	}
 
-	gptClient := gpt3.NewClient(openaiToken)
-	var handlers = map[string]Handler{
-		"echo":   Echo{},
-		"prompt": Prompt{},
-		"think":  Think{},
-		"dump":   Dump{},
-		"tweak":  Tweak{},
-		"help":   Help{},
+	st, err := OpenStorageFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("open storage: %w", err)
+	}
+
+	repo, err := OpenRepositoryFromEnv(st)
+	if err != nil {
+		return nil, fmt.Errorf("open thread repository: %w", err)
+	}
+
+	access, err := ACLFromEnv(st)
+	if err != nil {
+		return nil, fmt.Errorf("open acl: %w", err)
+	}
+
+	provider, err := ProviderFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("create completion provider: %w", err)
+	}
+
+	ledger, err := LedgerFromEnv(st)
+	if err != nil {
+		return nil, fmt.Errorf("open usage ledger: %w", err)
+	}
+
+	// Summaries are metered too, they are paid for like any completion.
+	provider = usage.NewMeter(provider, ledger)
+	if model := os.Getenv("COMPLETION_MODEL"); model != "" {
+		thread.DefaultOpenAISettings.Model = model
+	}
+
+	// Self-hosted servers name their models freely, they are checked by the
+	// server rather than against the OpenAI ones.
+	if os.Getenv("COMPLETION_PROVIDER") == "compatible" {
+		ModelRegex = CompatibleModelRegex
+	}
+
+	summarizer, err := SummarizerFromEnv(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook, err := WebhookConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	dispatcher, err := DispatcherFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	userLimiter, chatLimiter, err := LimitersFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	quotas, err := QuotasFromEnv(st)
+	if err != nil {
+		return nil, fmt.Errorf("open quotas: %w", err)
+	}
+
+	personas, err := PersonasFromEnv(st)
+	if err != nil {
+		return nil, fmt.Errorf("open personas: %w", err)
+	}
+
+	chatSettings, err := ChatSettingsFromEnv(st)
+	if err != nil {
+		return nil, fmt.Errorf("open chat settings: %w", err)
+	}
+
+	shutdownTimeout := DefaultShutdownTimeout
+	if val := os.Getenv("SHUTDOWN_TIMEOUT"); val != "" {
+		if shutdownTimeout, err = time.ParseDuration(val); err != nil {
+			return nil, fmt.Errorf("parse SHUTDOWN_TIMEOUT: %w", err)
+		}
+	}
+
+	streaming := os.Getenv("STREAM_RESPONSES") != "false"
+	editInterval := DefaultEditInterval
+	if val := os.Getenv("STREAM_EDIT_INTERVAL"); val != "" {
+		if editInterval, err = time.ParseDuration(val); err != nil {
+			return nil, fmt.Errorf("parse STREAM_EDIT_INTERVAL: %w", err)
+		}
 	}
 
 	return &CommandRunner{
-		handlers:       handlers,
-		telegramClient: telegramClient,
-		gptClient:      gptClient,
-		repo:           thread.NewRepository(),
+		handlers:        DefaultRegistry(),
+		bot:             telegramClient,
+		telegramClient:  telegramClient,
+		completions:     provider,
+		summarizer:      summarizer,
+		streaming:       streaming,
+		editInterval:    editInterval,
+		webhook:         webhook,
+		dispatcher:      dispatcher,
+		acl:             access,
+		userLimiter:     userLimiter,
+		chatLimiter:     chatLimiter,
+		quotas:          quotas,
+		ledger:          ledger,
+		personas:        personas,
+		chatSettings:    chatSettings,
+		shutdownTimeout: shutdownTimeout,
+		storage:         st,
+		repo:            repo,
 	}, nil
 }
 
-func (r *CommandRunner) Start() {
-	u := telegram.NewUpdate(0)
-	u.Timeout = 60
+var (
+	ErrUnknownBackend  = errors.New("unknown storage backend")
+	ErrUnknownProvider = errors.New("unknown completion provider")
+)
 
-	updates := r.telegramClient.GetUpdatesChan(u)
-	for update := range updates {
-		if update.Message == nil {
+// ProviderFromEnv creates the completion provider selected by
+// COMPLETION_PROVIDER, defaulting to the OpenAI completions API.
+func ProviderFromEnv() (completion.Provider, error) {
+	provider := os.Getenv("COMPLETION_PROVIDER")
+	token := os.Getenv("OPENAI_TOKEN")
+	if provider == "" {
+		provider = "openai"
+	}
+
+	if token == "" && provider != "compatible" {
+		return nil, errors.New("no openai token set")
+	}
+
+	switch provider {
+	case "openai":
+		return completion.NewOpenAI(gpt3.NewClient(token)), nil
+	case "openai-chat":
+		return completion.NewOpenAIChat(token), nil
+	case "compatible":
+		baseURL := os.Getenv("COMPLETION_BASE_URL")
+		if baseURL == "" {
+			return nil, errors.New("no completion base url set")
+		}
+
+		api := completion.ChatAPI
+		if os.Getenv("COMPLETION_API") == "completions" {
+			api = completion.CompletionsAPI
+		}
+
+		return completion.NewHTTP(baseURL, token, api), nil
+	default:
+		return nil, fmt.Errorf("'%s': %w", provider, ErrUnknownProvider)
+	}
+}
+
+// Storage is where threads are stored, along with everything kept next to
+// them.
+type Storage struct {
+	Backend string
+	// Path is the journal or the SQLite database the backend stores to.
+	Path string
+	// DB is the database of the sqlite backend. The threads and every store
+	// share it, so their writes queue for the lock of a single pool.
+	DB *sql.DB
+}
+
+// OpenStorageFromEnv opens the storage backend selected by STORAGE_BACKEND.
+// When no backend is set threads are journaled to STORAGE_PATH if one is
+// provided and kept in memory otherwise.
+func OpenStorageFromEnv() (Storage, error) {
+	st := Storage{Path: os.Getenv("STORAGE_PATH"), Backend: os.Getenv("STORAGE_BACKEND")}
+	if st.Backend == "" {
+		st.Backend = "memory"
+		if st.Path != "" {
+			st.Backend = "journal"
+		}
+	}
+
+	switch st.Backend {
+	case "memory", "journal", "sqlite":
+	default:
+		return st, fmt.Errorf("'%s': %w", st.Backend, ErrUnknownBackend)
+	}
+
+	if st.Backend != "memory" && st.Path == "" {
+		return st, fmt.Errorf("storage backend '%s' requires STORAGE_PATH", st.Backend)
+	}
+
+	if st.Backend == "sqlite" {
+		db, err := storage.OpenSQLite(st.Path)
+		if err != nil {
+			return st, err
+		}
+
+		st.DB = db
+	}
+
+	return st, nil
+}
+
+// Close closes the SQLite database, once the repository and the stores
+// sharing it are closed.
+func (st Storage) Close() error {
+	if st.DB == nil {
+		return nil
+	}
+
+	return st.DB.Close()
+}
+
+// openStore opens the store a feature keeps next to the threads of st: memory
+// as it is, the file at the path of the journal with suffix appended, or the
+// tables prepared in the shared database.
+func openStore[S any](st Storage, suffix string, memory S, file func(path string) (S, error), tables func(db *sql.DB) (S, error)) (S, error) {
+	switch st.Backend {
+	case "memory":
+		return memory, nil
+	case "journal":
+		return file(st.Path + suffix)
+	case "sqlite":
+		return tables(st.DB)
+	default:
+		return memory, fmt.Errorf("'%s': %w", st.Backend, ErrUnknownBackend)
+	}
+}
+
+// OpenRepositoryFromEnv opens the thread repository of st. Threads kept in
+// memory or journaled are expired by the retention policy of the environment.
+func OpenRepositoryFromEnv(st Storage) (thread.Repository, error) {
+	var repo *thread.MemoryRepository
+	switch st.Backend {
+	case "memory":
+		repo = thread.NewMemoryRepository()
+	case "journal":
+		var err error
+		repo, err = thread.OpenJournalRepository(st.Path)
+		if err != nil {
+			return nil, err
+		}
+	case "sqlite":
+		return thread.NewSQLRepository(st.DB)
+	default:
+		return nil, fmt.Errorf("'%s': %w", st.Backend, ErrUnknownBackend)
+	}
+
+	policy, err := RetentionPolicyFromEnv()
+	if err != nil {
+		repo.Close()
+		return nil, err
+	}
+
+	if err := repo.SetRetention(policy); err != nil {
+		repo.Close()
+		return nil, fmt.Errorf("apply retention policy: %w", err)
+	}
+
+	return repo, nil
+}
+
+// ACLFromEnv turns on access control when ACL_ADMINS lists the IDs of the
+// users administering the bot. Grants and command overrides outlive restarts
+// unless threads are kept in memory.
+func ACLFromEnv(st Storage) (*acl.ACL, error) {
+	val := os.Getenv("ACL_ADMINS")
+	if val == "" {
+		return nil, nil
+	}
+
+	var admins []int64
+	for _, field := range strings.Split(val, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse ACL_ADMINS: %w", err)
+		}
+
+		admins = append(admins, id)
+	}
+
+	store, err := openStore[acl.Store](st, ".acl", nil,
+		func(path string) (acl.Store, error) { return acl.NewFileStore(path), nil },
+		func(db *sql.DB) (acl.Store, error) {
+			s, err := acl.NewSQLStore(db)
+			return s, err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return acl.New(store, admins...)
+}
+
+// SummarizerFromEnv configures when long threads are summarized,
+// SUMMARY_THRESHOLD set to 0 turns summaries off.
+func SummarizerFromEnv(provider completion.Provider) (*summary.Summarizer, error) {
+	s := &summary.Summarizer{
+		Provider:  provider,
+		Threshold: summary.DefaultThreshold,
+		Keep:      summary.DefaultKeep,
+	}
+
+	var err error
+	if val := os.Getenv("SUMMARY_THRESHOLD"); val != "" {
+		if s.Threshold, err = strconv.Atoi(val); err != nil {
+			return nil, fmt.Errorf("parse SUMMARY_THRESHOLD: %w", err)
+		}
+	}
+
+	if val := os.Getenv("SUMMARY_KEEP"); val != "" {
+		if s.Keep, err = strconv.Atoi(val); err != nil {
+			return nil, fmt.Errorf("parse SUMMARY_KEEP: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// DispatcherFromEnv starts the workers handling commands, DISPATCH_WORKERS
+// limits how many run at once.
+func DispatcherFromEnv() (*Dispatcher, error) {
+	workers, queueSize, maxPending := DefaultWorkers, DefaultQueueSize, DefaultMaxPending
+	ints := map[string]*int{
+		"DISPATCH_WORKERS":     &workers,
+		"DISPATCH_QUEUE_SIZE":  &queueSize,
+		"DISPATCH_MAX_PENDING": &maxPending,
+	}
+
+	for name, field := range ints {
+		val := os.Getenv(name)
+		if val == "" {
 			continue
 		}
 
-		if !update.Message.IsCommand() && update.Message.ReplyToMessage == nil {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+
+		if n < 1 {
+			return nil, fmt.Errorf("%s must be at least 1", name)
+		}
+
+		*field = n
+	}
+
+	return NewDispatcher(workers, queueSize, maxPending), nil
+}
+
+// RetentionPolicyFromEnv reads the in-memory retention limits, any limit that
+// isn't set is left disabled.
+func RetentionPolicyFromEnv() (policy thread.RetentionPolicy, err error) {
+	ints := map[string]*int{
+		"RETENTION_MAX_THREADS":  &policy.MaxThreads,
+		"RETENTION_MAX_MESSAGES": &policy.MaxMessagesPerThread,
+		"RETENTION_MAX_BYTES":    &policy.MaxBytes,
+	}
+
+	for name, field := range ints {
+		val := os.Getenv(name)
+		if val == "" {
 			continue
 		}
 
+		*field, err = strconv.Atoi(val)
+		if err != nil {
+			return policy, fmt.Errorf("parse %s: %w", name, err)
+		}
+	}
+
+	if val := os.Getenv("RETENTION_MAX_IDLE"); val != "" {
+		policy.MaxIdle, err = time.ParseDuration(val)
+		if err != nil {
+			return policy, fmt.Errorf("parse RETENTION_MAX_IDLE: %w", err)
+		}
+	}
+
+	return policy, nil
+}
+
+// Start receives updates until ctx is done, through the webhook if one is
+// configured and by long polling otherwise. Handlers dispatched before it
+// returns may still be running, call Shutdown to wait for them.
+func (r *CommandRunner) Start(ctx context.Context) error {
+	if err := r.PublishCommands(); err != nil {
+		log.Printf("failed to publish commands: %s", err)
+	}
+
+	if r.webhook != nil {
+		return r.serveWebhook(ctx, *r.webhook)
+	}
+
+	u := telegram.NewUpdate(0)
+	u.Timeout = int(PollTimeout / time.Second)
+
+	updates := r.bot.GetUpdatesChan(u)
+	r.handleUpdates(ctx, updates)
+
+	// Polling for updates confirms the ones fetched before, those waiting
+	// in the channel have to be handled or they are lost. The channel is
+	// closed once the poll in flight returned, committing the offset any
+	// earlier would run next to it and conflict.
+	r.bot.StopReceivingUpdates()
+	for update := range updates {
+		r.handleUpdate(update)
+	}
+
+	return r.commitOffset()
+}
+
+// handleUpdates handles updates until the channel is closed or ctx is done.
+func (r *CommandRunner) handleUpdates(ctx context.Context, updates <-chan telegram.Update) {
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+
+			r.handleUpdate(update)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleUpdate dispatches commands, replies and presses of the buttons of
+// responses, other updates are ignored.
+func (r *CommandRunner) handleUpdate(update telegram.Update) {
+	r.lastUpdateID = update.UpdateID
+	if query := update.CallbackQuery; query != nil && query.Message != nil && query.Message.Chat != nil {
+		r.inflight.Add(1)
+		err := r.dispatcher.Submit(query.Message.Chat.ID, func() {
+			defer r.inflight.Done()
+			r.handleCallback(query)
+		})
+		if err != nil {
+			r.inflight.Done()
+			log.Printf("failed to dispatch update %d: %s", update.UpdateID, err)
+		}
+
+		return
+	}
+
+	if update.Message == nil {
+		return
+	}
+
+	if !update.Message.IsCommand() && update.Message.ReplyToMessage == nil {
+		return
+	}
+
+	r.inflight.Add(1)
+	err := r.dispatcher.Submit(update.Message.Chat.ID, func() {
+		defer r.inflight.Done()
 		r.DispatchHandler(update)
+	})
+	if err == nil {
+		return
+	}
+
+	r.inflight.Done()
+	log.Printf("failed to dispatch update %d: %s", update.UpdateID, err)
+	if errors.Is(err, ErrBusy) {
+		reply := telegram.NewMessage(update.Message.Chat.ID, "I'm busy with other messages in this chat, try again in a moment.")
+		reply.ReplyToMessageID = update.Message.MessageID
+		if _, err := r.telegramClient.Send(reply); err != nil {
+			log.Printf("failed to send busy reply: %s", err)
+		}
 	}
 }
 
+// Reply sends text as a reply to msg. Text longer than Telegram allows is
+// split into a chain of messages, each replying to the one before it.
 func (r *CommandRunner) Reply(msg *thread.Message, text string, messageType thread.MessageType) error {
-	reply := telegram.NewMessage(msg.ID.ChannelID, text)
-	reply.ReplyToMessageID = msg.ID.MessageID
-	newMsg, err := r.telegramClient.Send(reply)
-	if err != nil {
-		return fmt.Errorf("send prompt reply: %w", err)
-	}
+	_, err := r.replyChain(msg, chunk.Split(text, chunk.MaxMessageLength), messageType)
+	return err
+}
 
-	_, err = r.repo.AddMessage(&newMsg, messageType)
-	if err != nil {
-		return fmt.Errorf("add message to thread: %w", err)
+// replyChain sends every part as a reply to the previous one, starting with a
+// reply to msg, and adds them all to the thread. It returns the last message
+// of the chain.
+func (r *CommandRunner) replyChain(msg *thread.Message, parts []string, messageType thread.MessageType) (*thread.Message, error) {
+	prev := msg
+	for _, part := range parts {
+		reply := telegram.NewMessage(prev.ID.ChannelID, part)
+		reply.ReplyToMessageID = prev.ID.MessageID
+		newMsg, err := r.telegramClient.Send(reply)
+		if err != nil {
+			return prev, fmt.Errorf("send prompt reply: %w", err)
+		}
+
+		newMsg.ReplyToMessage = replyTarget(prev)
+		prev, err = r.repo.AddMessage(&newMsg, messageType)
+		if err != nil {
+			return prev, fmt.Errorf("add message to thread: %w", err)
+		}
 	}
 
-	return nil
+	return prev, nil
 }
 
+// replyTarget identifies msg the way Telegram refers to it in the messages
+// replying to it, so replies are linked to msg regardless of how much of the
+// original message Telegram includes.
+func replyTarget(msg *thread.Message) *telegram.Message {
+	return &telegram.Message{
+		MessageID: msg.ID.MessageID,
+		From:      &telegram.User{ID: msg.ID.FromID},
+		Chat:      &telegram.Chat{ID: msg.ID.ChannelID},
+	}
+}
+
+// DispatchHandler adds the message of update to its thread and runs the
+// handler of the command wrapped in its middlewares, it returns once the
+// handler is done.
 func (r *CommandRunner) DispatchHandler(update telegram.Update) {
-	user := thread.User(*update.Message.From)
-	log.Printf("Handle command [%s] %s", user.DisplayName(), update.Message.Text)
 	var handler Handler = Prompt{}
 	if update.Message.IsCommand() {
 		cmd := update.Message.Command()
 		var ok bool
-		handler, ok = r.handlers[cmd]
-		if !ok {
+		handler, ok = r.handlers.Lookup(cmd)
+		if !ok || !handler.Spec().InScope(ScopeOf(update.Message.Chat)) {
 			log.Printf("skipping command '%s', no handler registered", cmd)
 			return
 		}
 	}
 
+	if err := r.authorize(handler.Spec(), update.Message); err != nil {
+		log.Printf("denied command '%s' in chat %d: %s", handler.Spec().Name, update.Message.Chat.ID, err)
+		var e *Error
+		if errors.As(err, &e) {
+			r.Reply(&thread.Message{ID: thread.GetMessageID(update.Message)}, ErrorReply(err, ""), thread.TypeInformational)
+		}
+
+		return
+	}
+
 	msgType := thread.TypeCommand
+	var mentioned *persona.Persona
 	if _, ok := handler.(Prompt); ok {
 		msgType = thread.TypePrompt
+		update.Message = r.continuedMessage(update.Message)
+		if update.Message.IsCommand() {
+			var err error
+			if update.Message, mentioned, err = r.mentionedPersona(update.Message); err != nil {
+				log.Printf("failed to find persona: %s", err)
+				r.Reply(&thread.Message{ID: thread.GetMessageID(update.Message)}, ErrorReply(err, ""), thread.TypeInformational)
+				return
+			}
+		}
 	}
 
 	msg, err := r.repo.AddMessage(update.Message, msgType)
-	if err != nil {
-		log.Printf("failed to add message to the repository")
+	if errors.Is(err, thread.ErrThreadExpired) {
+		log.Printf("reply to an expired thread, skipping")
+		r.Reply(&thread.Message{ID: thread.GetMessageID(update.Message)}, ExpiredThreadReply, thread.TypeInformational)
+		return
 	}
 
-	if handler.IsReplyOnly() && update.Message.ReplyToMessage == nil {
-		log.Printf("attempted to call a reply only handler without a reply message, skipping")
-		r.Reply(msg, "That command can only be used in the context of a thread, try replying to an existing message.", thread.TypeInformational)
+	if errors.Is(err, thread.ErrDetached) {
+		log.Printf("reply to an undone message, skipping")
+		r.Reply(&thread.Message{ID: thread.GetMessageID(update.Message)}, UndoneReply, thread.TypeInformational)
 		return
 	}
 
-	timeout, _ := context.WithTimeout(context.Background(), 5*time.Minute)
-	ctx := Context{
-		Runner:   r,
-		Telegram: r.telegramClient,
-		GPT3:     r.gptClient,
-		Context:  timeout,
-		Threads:  r.repo,
+	if err != nil {
+		log.Printf("failed to add message to the repository: %s", err)
+		return
 	}
 
-	ticker := time.NewTicker(3 * time.Second)
-	done := make(chan struct{})
-	go func(runner *CommandRunner, timeout <-chan struct{}, tick <-chan time.Time, done <-chan struct{}) {
-		select {
-		case <-timeout:
-			ticker.Stop()
-			log.Printf("command timed out")
-			return
-		case <-tick:
-			if err := runner.SetTyping(update.Message.Chat.ID); err != nil {
-				log.Printf("failed to set typing status: %s", err.Error())
-			}
-		case <-done:
-			ticker.Stop()
-			return
-		}
-	}(r, timeout.Done(), ticker.C, done)
+	// New threads start with the defaults of the chat, a persona mentioned
+	// by the prompt overrides the one of the chat.
+	if msg.Parent() == nil {
+		r.applyChatDefaults(msg)
+	}
 
-	go func(runner *CommandRunner) {
-		err := handler.Exec(ctx, msg)
-		if err != nil {
-			log.Printf("error in handler '%v': %s", handler, err.Error())
+	if mentioned != nil {
+		if err := setPersona(r.repo, msg.ThreadID, *mentioned); err != nil {
+			log.Printf("failed to set the persona of thread %s: %s", msg.ThreadID, err)
 		}
+	}
+
+	ctx := Context{
+		Runner:      r,
+		Telegram:    r.telegramClient,
+		Self:        r.bot.Self,
+		Completions: r.completions,
+		Summarizer:  r.summarizer,
+		Context: usage.WithAttribution(r.handlerContext(), usage.Attribution{
+			ChatID:   msg.ID.ChannelID,
+			UserID:   msg.ID.FromID,
+			ThreadID: msg.ThreadID,
+		}),
+		Threads: r.repo,
+		Scope:   ScopeOf(update.Message.Chat),
+		Source:  update.Message,
+	}
 
-		close(done)
-	}(r)
+	// Errors are logged by the middlewares.
+	r.handlers.Wrap(handler).Exec(ctx, msg)
 }
@@ -1 +1,361 @@
 package command
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"telegram-bot/pkg/chunk"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/telegramtest"
+	"telegram-bot/pkg/thread"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var testBot = telegramtest.Bot
+
+func newTestContext(t *testing.T, provider completion.Provider) (Context, *telegramtest.Server) {
+	srv := telegramtest.NewServer()
+	t.Cleanup(srv.Close)
+	bot, err := telegram.NewBotAPIWithAPIEndpoint("token", srv.Endpoint())
+	if err != nil {
+		t.Fatalf("unexpected error creating bot: %v", err)
+	}
+
+	runner := &CommandRunner{
+		handlers:       DefaultRegistry(),
+		bot:            bot,
+		telegramClient: bot,
+		fileEndpoint:   srv.FileEndpoint(),
+		completions:    provider,
+		dispatcher:     NewDispatcher(DefaultWorkers, DefaultQueueSize, DefaultMaxPending),
+		repo:           thread.NewMemoryRepository(),
+	}
+
+	t.Cleanup(runner.dispatcher.Close)
+
+	return Context{
+		Runner:      runner,
+		Telegram:    bot,
+		Self:        bot.Self,
+		Completions: provider,
+		Context:     context.Background(),
+		Threads:     runner.repo,
+	}, srv
+}
+
+// startTestRunner runs a command runner receiving updates from a fake Bot API
+// server until the test ends.
+func startTestRunner(t *testing.T, provider completion.Provider) (*CommandRunner, *telegramtest.Server) {
+	ctx, srv := newTestContext(t, provider)
+	runTestRunner(t, ctx.Runner)
+	return ctx.Runner, srv
+}
+
+// runTestRunner runs runner until the test ends.
+func runTestRunner(t *testing.T, runner *CommandRunner) {
+	running, stop := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- runner.Start(running)
+	}()
+
+	t.Cleanup(func() {
+		stop()
+		if err := <-done; err != nil {
+			t.Errorf("unexpected error from runner: %v", err)
+		}
+	})
+}
+
+// waitForSent waits until n messages have been sent and returns the last one.
+func waitForSent(t *testing.T, srv *telegramtest.Server, n int) *telegram.Message {
+	t.Helper()
+	calls, err := srv.WaitFor("sendMessage", n, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected %d messages to be sent: %v, got '%v'", n, err, srv.Sent())
+	}
+
+	return calls[n-1].Message
+}
+
+func TestPrompt_Exec(t *testing.T) {
+	cases := []struct {
+		desc           string
+		steps          []completion.Step
+		expectedPrompt string
+		expectedSent   []string
+		expectedErr    error
+	}{
+		{
+			desc:           "replies with the completion",
+			steps:          []completion.Step{{Response: completion.Response{Text: "Hi there"}}},
+			expectedPrompt: "Foo: Hello\n\nBot:",
+			expectedSent:   []string{"Hi there"},
+		},
+		{
+			desc:           "returns provider errors",
+			steps:          []completion.Step{{Err: completion.ErrNoChoices}},
+			expectedPrompt: "Foo: Hello\n\nBot:",
+			expectedSent:   []string{},
+			expectedErr:    completion.ErrNoChoices,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			provider := &completion.Fake{Steps: tc.steps}
+			ctx, srv := newTestContext(t, provider)
+			msg, _ := ctx.Threads.AddMessage(&telegram.Message{
+				MessageID: 1,
+				From:      &telegram.User{ID: 2, FirstName: "Foo"},
+				Chat:      &telegram.Chat{ID: 3},
+				Text:      "Hello",
+			}, thread.TypePrompt)
+
+			err := Prompt{}.Exec(ctx, msg)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("unexpected error expected '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if len(provider.Requests) != 1 || provider.Requests[0].Prompt != tc.expectedPrompt {
+				t.Fatalf("expected prompt '%s', got '%v'", tc.expectedPrompt, provider.Requests)
+			}
+
+			expectedMessages := []completion.Message{{Role: completion.RoleUser, Name: "Foo", Content: "Hello"}}
+			if !reflect.DeepEqual(provider.Requests[0].Messages, expectedMessages) {
+				t.Errorf("expected messages '%v', got '%v'", expectedMessages, provider.Requests[0].Messages)
+			}
+
+			if !reflect.DeepEqual(srv.Sent(), tc.expectedSent) {
+				t.Errorf("expected '%v', got '%v'", tc.expectedSent, srv.Sent())
+			}
+		})
+	}
+}
+
+func TestPrompt_ExecStreaming(t *testing.T) {
+	provider := completion.NewFake(" Hi there friend")
+	ctx, srv := newTestContext(t, provider)
+	ctx.Runner.streaming = true
+	msg, _ := ctx.Threads.AddMessage(&telegram.Message{
+		MessageID: 1,
+		From:      &telegram.User{ID: 2, FirstName: "Foo"},
+		Chat:      &telegram.Chat{ID: 3},
+		Text:      "Hello",
+	}, thread.TypePrompt)
+
+	if err := (Prompt{}).Exec(ctx, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedSent := []string{StreamPlaceholder}
+	if !reflect.DeepEqual(srv.Sent(), expectedSent) {
+		t.Errorf("expected '%v', got '%v'", expectedSent, srv.Sent())
+	}
+
+	expectedEdits := []string{"Hi", "Hi there", "Hi there friend"}
+	if !reflect.DeepEqual(srv.Edits(), expectedEdits) {
+		t.Errorf("expected edits '%v', got '%v'", expectedEdits, srv.Edits())
+	}
+
+	reply, err := ctx.Threads.GetMessage(thread.MessageID{ChannelID: 3, FromID: testBot.ID, MessageID: 1001})
+	if err != nil {
+		t.Fatalf("expected streamed reply to be added to the thread: %v", err)
+	}
+
+	if reply.Type != thread.TypeResponse || reply.Text != "Hi there friend" || reply.Parent() != msg {
+		t.Errorf("unexpected streamed reply '%v'", reply)
+	}
+}
+
+func TestCommandRunner_PromptThread(t *testing.T) {
+	provider := completion.NewFake("Hi there", "I'm fine")
+	_, srv := startTestRunner(t, provider)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	reply := waitForSent(t, srv, 1)
+	if reply.Text != "Hi there" || reply.ReplyToMessage == nil {
+		t.Fatalf("expected a reply with the completion, got '%v'", reply)
+	}
+
+	srv.Post(3, user, "How are you?", reply)
+	reply = waitForSent(t, srv, 2)
+	if reply.Text != "I'm fine" {
+		t.Errorf("expected the second completion, got '%s'", reply.Text)
+	}
+
+	expected := []completion.Message{
+		{Role: completion.RoleUser, Name: "Foo", Content: "Hello"},
+		{Role: completion.RoleAssistant, Content: "Hi there"},
+		{Role: completion.RoleUser, Name: "Foo", Content: "How are you?"},
+	}
+
+	if len(provider.Requests) != 2 || !reflect.DeepEqual(provider.Requests[1].Messages, expected) {
+		t.Errorf("expected the thread history '%v', got '%v'", expected, provider.Requests)
+	}
+}
+
+func TestCommandRunner_ReplyToSplitAnswer(t *testing.T) {
+	long := strings.Repeat("All work and no play. ", 400)
+	provider := completion.NewFake(long, "Indeed")
+	_, srv := startTestRunner(t, provider)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	first := waitForSent(t, srv, 1)
+	chunks := len(chunk.Split(long, chunk.MaxMessageLength))
+	if chunks < 2 {
+		t.Fatalf("expected the answer to be split, got %d chunk", chunks)
+	}
+
+	waitForSent(t, srv, chunks)
+	srv.Post(3, user, "Isn't that dull?", first)
+	waitForSent(t, srv, chunks+1)
+
+	expected := []completion.Message{
+		{Role: completion.RoleUser, Name: "Foo", Content: "Hello"},
+		{Role: completion.RoleAssistant, Content: strings.Join(srv.Sent()[:chunks], "\n\n")},
+		{Role: completion.RoleUser, Name: "Foo", Content: "Isn't that dull?"},
+	}
+
+	if len(provider.Requests) != 2 || !reflect.DeepEqual(provider.Requests[1].Messages, expected) {
+		t.Errorf("expected the whole answer in the history, got '%v'", provider.Requests)
+	}
+}
+
+func TestCommandRunner_FullThread(t *testing.T) {
+	provider := completion.NewFake("Hi there", "I'm fine")
+	ctx, srv := newTestContext(t, provider)
+	ctx.Runner.streaming = true
+	ctx.Runner.repo.(*thread.MemoryRepository).SetRetention(thread.RetentionPolicy{MaxMessagesPerThread: 3})
+	runTestRunner(t, ctx.Runner)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	reply := waitForSent(t, srv, 1)
+	srv.Post(3, user, "How are you?", reply)
+	reply = waitForSent(t, srv, 2)
+	if _, err := srv.WaitFor("editMessageText", 1, 5*time.Second); err != nil {
+		t.Fatalf("expected the answer to be streamed: %v", err)
+	}
+
+	ctx.Runner.inflight.Wait()
+	if _, err := ctx.Threads.GetMessage(thread.GetMessageID(reply)); err != nil {
+		t.Errorf("expected the answer filling the thread to be kept: %v", err)
+	}
+
+	srv.Post(3, user, "/export", reply)
+	if _, err := srv.WaitFor("sendDocument", 1, 5*time.Second); err != nil {
+		t.Errorf("expected a full thread to be exported: %v", err)
+	}
+
+	srv.Post(3, user, "Good to hear", reply)
+	waitForSent(t, srv, 3)
+
+	expected := []string{StreamPlaceholder, StreamPlaceholder, ExpiredThreadReply}
+	if !reflect.DeepEqual(srv.Sent(), expected) {
+		t.Errorf("expected '%v', got '%v'", expected, srv.Sent())
+	}
+
+	if edits := srv.Edits(); len(edits) == 0 || edits[len(edits)-1] != "I'm fine" {
+		t.Errorf("expected the answer filling the thread to be shown, got '%v'", edits)
+	}
+}
+
+func TestCommandRunner_ExpiresWhileAnswering(t *testing.T) {
+	provider := newGatedProvider()
+	ctx, srv := newTestContext(t, provider)
+	repo := ctx.Runner.repo.(*thread.MemoryRepository)
+	repo.SetRetention(thread.RetentionPolicy{MaxThreads: 1})
+	runTestRunner(t, ctx.Runner)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	select {
+	case <-provider.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the prompt to be completed")
+	}
+
+	// A new thread evicts the one being answered.
+	repo.AddMessage(&telegram.Message{MessageID: 100, From: &user, Chat: &telegram.Chat{ID: 4}, Text: "Hi"}, thread.TypePrompt)
+	close(provider.release)
+	waitForSent(t, srv, 2)
+
+	expected := []string{"Done", ExpiredThreadReply}
+	if !reflect.DeepEqual(srv.Sent(), expected) {
+		t.Errorf("expected '%v', got '%v'", expected, srv.Sent())
+	}
+}
+
+func TestCommandRunner_IgnoresUnrelatedMessages(t *testing.T) {
+	provider := completion.NewFake("Hi there")
+	_, srv := startTestRunner(t, provider)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "Just chatting", nil)
+	srv.Post(3, user, "/echo done", nil)
+	waitForSent(t, srv, 1)
+	if expected := []string{"done"}; !reflect.DeepEqual(srv.Sent(), expected) {
+		t.Errorf("expected '%v', got '%v'", expected, srv.Sent())
+	}
+
+	if len(provider.Requests) != 0 {
+		t.Errorf("expected no completions, got '%v'", provider.Requests)
+	}
+}
+
+func TestCommandRunner_TweakAndDump(t *testing.T) {
+	_, srv := startTestRunner(t, completion.NewFake("Hi there"))
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	reply := waitForSent(t, srv, 1)
+
+	tweak := srv.Post(3, user, "/tweak Model=gpt-4; MaxTokens=100; Temperature=0.5", reply)
+	cmd := srv.Post(3, user, "/dump", &tweak)
+	dump := waitForSent(t, srv, 2)
+	for _, expected := range []string{"Total prompts:\t\t1", "Model:\t\tgpt-4", "MaxTokens:\t\t100", "Temperature:\t\t0.500000"} {
+		if !strings.Contains(dump.Text, expected) {
+			t.Errorf("expected dump to contain '%s', got '%s'", expected, dump.Text)
+		}
+	}
+
+	if dump.ReplyToMessage == nil || dump.ReplyToMessage.MessageID != cmd.MessageID {
+		t.Errorf("expected dump to reply to the command, got '%v'", dump.ReplyToMessage)
+	}
+}
+
+func TestCommandRunner_ReplyOnlyOutsideThread(t *testing.T) {
+	_, srv := startTestRunner(t, completion.NewFake())
+	srv.Post(3, telegram.User{ID: 2, FirstName: "Foo"}, "/dump", nil)
+	reply := waitForSent(t, srv, 1)
+	if !strings.Contains(reply.Text, "can only be used in the context of a thread") {
+		t.Errorf("unexpected reply '%s'", reply.Text)
+	}
+}
+
+func TestThink_Cancelled(t *testing.T) {
+	ctx, srv := newTestContext(t, completion.NewFake())
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx.Context = cancelled
+
+	start := time.Now()
+	if err := (Think{}).Exec(ctx, &thread.Message{ID: thread.MessageID{ChannelID: 3}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected '%v', got '%v'", context.Canceled, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the cancelled handler to return at once, took %s", elapsed)
+	}
+
+	if sent := srv.Sent(); len(sent) != 0 {
+		t.Errorf("expected no reply, got '%v'", sent)
+	}
+}
@@ -0,0 +1,134 @@
+package command
+
+import (
+	"errors"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	DefaultWorkers    int = 8
+	DefaultQueueSize  int = 5
+	DefaultMaxPending int = 100
+)
+
+var (
+	ErrBusy             = errors.New("too many messages waiting")
+	ErrDispatcherClosed = errors.New("dispatcher closed")
+)
+
+type chatQueue struct {
+	jobs []func()
+	// active is set while the chat waits for a worker or one runs its jobs.
+	active bool
+}
+
+// Dispatcher runs jobs on a fixed number of workers. Jobs submitted for the
+// same chat run one after the other in the order they were submitted, jobs of
+// different chats run in parallel.
+type Dispatcher struct {
+	queueSize  int
+	maxPending int
+
+	queues  map[int64]*chatQueue
+	pending int
+	// ready holds the chats with jobs waiting for a worker, every chat is
+	// in it at most once.
+	ready  chan int64
+	closed bool
+
+	mu sync.Mutex
+}
+
+// NewDispatcher starts workers that run the submitted jobs. At most queueSize
+// jobs wait per chat and maxPending across all chats.
+func NewDispatcher(workers int, queueSize int, maxPending int) *Dispatcher {
+	d := &Dispatcher{
+		queueSize:  queueSize,
+		maxPending: maxPending,
+		queues:     map[int64]*chatQueue{},
+		ready:      make(chan int64, maxPending),
+	}
+
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+
+	return d
+}
+
+// Submit queues job to run after the jobs submitted for chatID before it. It
+// returns ErrBusy without queueing when the chat or the dispatcher has too
+// many jobs waiting.
+func (d *Dispatcher) Submit(chatID int64, job func()) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrDispatcherClosed
+	}
+
+	q, ok := d.queues[chatID]
+	if !ok {
+		q = &chatQueue{}
+		d.queues[chatID] = q
+	}
+
+	if len(q.jobs) >= d.queueSize || d.pending >= d.maxPending {
+		return ErrBusy
+	}
+
+	q.jobs = append(q.jobs, job)
+	d.pending++
+	if !q.active {
+		q.active = true
+		d.ready <- chatID
+	}
+
+	return nil
+}
+
+// Close stops the workers once they finished the jobs they are running, jobs
+// still waiting are dropped.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closed {
+		d.closed = true
+		close(d.ready)
+	}
+}
+
+func (d *Dispatcher) work() {
+	for chatID := range d.ready {
+		d.mu.Lock()
+		q := d.queues[chatID]
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		d.pending--
+		d.mu.Unlock()
+
+		run(job)
+
+		d.mu.Lock()
+		switch {
+		case d.closed:
+		case len(q.jobs) > 0:
+			d.ready <- chatID
+		default:
+			delete(d.queues, chatID)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// run runs job, a panicking job doesn't take down the worker.
+func run(job func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic in dispatched job: %v\n%s", p, debug.Stack())
+		}
+	}()
+
+	job()
+}
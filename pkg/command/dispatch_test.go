@@ -0,0 +1,169 @@
+package command
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestDispatcher_OrdersJobsPerChat(t *testing.T) {
+	d := NewDispatcher(4, 10, 100)
+	defer d.Close()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	order := map[int64][]int{}
+	for i := 0; i < 10; i++ {
+		for _, chatID := range []int64{1, 2} {
+			i, chatID := i, chatID
+			wg.Add(1)
+			err := d.Submit(chatID, func() {
+				defer wg.Done()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				order[chatID] = append(order[chatID], i)
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	wg.Wait()
+	expected := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	for _, chatID := range []int64{1, 2} {
+		if !reflect.DeepEqual(order[chatID], expected) {
+			t.Errorf("expected chat %d to run in order '%v', got '%v'", chatID, expected, order[chatID])
+		}
+	}
+}
+
+func TestDispatcher_SurvivesPanics(t *testing.T) {
+	d := NewDispatcher(1, 10, 100)
+	defer d.Close()
+
+	done := make(chan struct{})
+	if err := d.Submit(1, func() { panic("oops") }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := d.Submit(1, func() { close(done) }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the worker to keep running after a panic")
+	}
+}
+
+func TestDispatcher_RunsChatsInParallel(t *testing.T) {
+	d := NewDispatcher(2, 1, 10)
+	defer d.Close()
+
+	release := make(chan struct{})
+	started := make(chan int64, 2)
+	for _, chatID := range []int64{1, 2} {
+		chatID := chatID
+		d.Submit(chatID, func() {
+			started <- chatID
+			<-release
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("expected both chats to run at once")
+		}
+	}
+
+	close(release)
+}
+
+func TestDispatcher_Submit(t *testing.T) {
+	cases := []struct {
+		desc        string
+		queueSize   int
+		maxPending  int
+		chats       []int64
+		expectedErr error
+	}{
+		{
+			desc:        "queues jobs behind a running one",
+			queueSize:   2,
+			maxPending:  10,
+			chats:       []int64{1, 1},
+			expectedErr: nil,
+		},
+		{
+			desc:        "rejects jobs when the chat queue is full",
+			queueSize:   1,
+			maxPending:  10,
+			chats:       []int64{1, 1},
+			expectedErr: ErrBusy,
+		},
+		{
+			desc:        "rejects jobs when too many are waiting overall",
+			queueSize:   5,
+			maxPending:  2,
+			chats:       []int64{1, 2, 3},
+			expectedErr: ErrBusy,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			d := NewDispatcher(1, tc.queueSize, tc.maxPending)
+			defer d.Close()
+
+			// Keep the only worker busy so every other job has to wait.
+			release := make(chan struct{})
+			defer close(release)
+			started := make(chan struct{})
+			d.Submit(0, func() {
+				close(started)
+				<-release
+			})
+			<-started
+
+			var err error
+			for _, chatID := range tc.chats {
+				if err = d.Submit(chatID, func() {}); err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestCommandRunner_BusyReply(t *testing.T) {
+	provider := newGatedProvider()
+	ctx, srv := newTestContext(t, provider)
+	ctx.Runner.dispatcher = NewDispatcher(1, 1, 10)
+	t.Cleanup(ctx.Runner.dispatcher.Close)
+	runTestRunner(t, ctx.Runner)
+	t.Cleanup(func() { close(provider.release) })
+
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+	srv.Post(3, user, "/prompt Hello", nil)
+	<-provider.started
+	srv.Post(3, user, "/echo queued", nil)
+	srv.Post(3, user, "/echo rejected", nil)
+
+	reply := waitForSent(t, srv, 1)
+	if reply.Text != "I'm busy with other messages in this chat, try again in a moment." {
+		t.Errorf("unexpected reply '%s'", reply.Text)
+	}
+}
@@ -4,26 +4,67 @@ import (
 	"fmt"
 	"strings"
 	"telegram-bot/pkg/thread"
+	"telegram-bot/pkg/tokens"
 )
 
 type Dump struct{}
 
 func (Dump) Exec(ctx Context, msg *thread.Message) error {
 	if msg.Parent() == nil {
-		ctx.Runner.Reply(msg, "I couldn't find the thread history. I only keep a small sample of data around for future use, sorry 💩", thread.TypeInformational)
 		return thread.ErrNotFound
 	}
 
 	t, err := ctx.Threads.GetThread(msg.ThreadID)
 	if err != nil {
-		ctx.Runner.Reply(msg, "I couldn't find the thread history. I only keep a small sample of data around for future use, sorry 💩", thread.TypeInformational)
-		return thread.ErrNotFound
+		return fmt.Errorf("get thread: %w", err)
 	}
 
-	ctx.Runner.Reply(msg, BuildReportForThread(t), thread.TypeInformational)
+	ctx.Runner.Reply(msg, BuildReportForThread(t)+BuildTokenReport(t, msg.Parent()), thread.TypeInformational)
 	return nil
 }
 
+// BuildTokenReport describes the tokens used by the whole thread and by the
+// prompt a reply to msg would send, with the summary in place of the turns it
+// covers.
+func BuildTokenReport(t thread.Thread, msg *thread.Message) string {
+	total := 0
+	if t.Root != nil {
+		total = SumTokens(*t.Root)
+	}
+
+	budget := tokens.Budget(t.Settings.Model, t.Settings.MaxTokens)
+	sent, truncated, err := PromptTurns(t, t.Turns(msg), budget)
+	used := tokens.Count(sent)
+	var b strings.Builder
+	b.WriteString("\n")
+	b.WriteString("Thread Tokens:\n")
+	b.WriteString(fmt.Sprintf("    Total tokens:\t\t%d\n", total))
+	b.WriteString(fmt.Sprintf("    Context tokens:\t\t%d\n", used))
+	b.WriteString(fmt.Sprintf("    Context budget:\t\t%d\n", budget))
+	if err != nil {
+		b.WriteString("    The persona, language and summary leave no room for new prompts\n")
+	} else if truncated {
+		b.WriteString("    The oldest messages no longer fit and are left out of new prompts\n")
+	}
+
+	return b.String()
+}
+
+// SumTokens estimates the tokens of every prompt and response in the tree
+// below msg.
+func SumTokens(msg thread.Message) int {
+	total := 0
+	for _, c := range msg.Children() {
+		total += SumTokens(*c)
+	}
+
+	if msg.Type == thread.TypePrompt || msg.Type == thread.TypeResponse {
+		total += tokens.Estimate(msg.Text)
+	}
+
+	return total
+}
+
 func BuildReportForThread(t thread.Thread) string {
 	var b strings.Builder
 	b.WriteString("Thread Stats:\n")
@@ -34,12 +75,27 @@ func BuildReportForThread(t thread.Thread) string {
 	b.WriteString(fmt.Sprintf("    Total commands:\t\t%d\n", SumChildren(*t.Root, IncludeChildrenOfType(thread.TypeCommand))))
 	b.WriteString(fmt.Sprintf("    Total informational:\t\t%d\n", SumChildren(*t.Root, IncludeChildrenOfType(thread.TypeInformational))))
 	b.WriteString("\n")
-	b.WriteString("Thread GPT3 Parameters:\n")
-	b.WriteString(fmt.Sprintf("    MaxTokens:\t\t%d\n", t.Settings.MaxTokens))
-	b.WriteString(fmt.Sprintf("    FrequencyPenalty:\t\t%f\n", t.Settings.FrequencyPenalty))
-	b.WriteString(fmt.Sprintf("    PressencePenalty:\t\t%f\n", t.Settings.PressencePenalty))
-	b.WriteString(fmt.Sprintf("    Temperature:\t\t%f\n", t.Settings.Temperature))
-	b.WriteString(fmt.Sprintf("    TopP:\t\t%f\n", t.Settings.TopP))
+	b.WriteString("Thread Settings:\n")
+	b.WriteString(BuildSettingsReport(t))
+	if p := t.Persona; p != nil {
+		b.WriteString("\n")
+		b.WriteString("Thread Persona:\n")
+		b.WriteString(fmt.Sprintf("    Name:\t\t@%s\n", p.Name))
+		if p.DisplayName != "" {
+			b.WriteString(fmt.Sprintf("    Display name:\t\t%s\n", p.DisplayName))
+		}
+
+		b.WriteString(fmt.Sprintf("    System prompt:\t\t%s\n", p.SystemPrompt))
+	}
+
+	if f := t.Fork; f != nil {
+		b.WriteString("\n")
+		b.WriteString("Thread Fork:\n")
+		b.WriteString(fmt.Sprintf("    Forked from:\t\t%s\n", f.ThreadID))
+		b.WriteString(fmt.Sprintf("    At message:\t\t%d\n", f.MessageID.MessageID))
+		b.WriteString(fmt.Sprintf("    History turns:\t\t%d\n", len(f.History)))
+	}
+
 	return b.String()
 }
 
@@ -68,6 +124,11 @@ func SumChildren(msg thread.Message, predicate Predicate) int {
 	return childTotal
 }
 
-func (Dump) IsReplyOnly() bool {
-	return true
+func (Dump) Spec() Spec {
+	return Spec{
+		Name:      "dump",
+		Summary:   "Show statistics and settings of a thread",
+		Usage:     "Shows the number of prompts, responses, commands and informational messages of the thread, its completion parameters, the thread it was forked from and how many tokens the conversation uses out of the model's context window.",
+		ReplyOnly: true,
+	}
 }
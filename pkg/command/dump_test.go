@@ -0,0 +1,72 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"telegram-bot/pkg/thread"
+	"telegram-bot/pkg/tokens"
+	"testing"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestBuildTokenReport(t *testing.T) {
+	const overflow = "no longer fit"
+	repo := thread.NewMemoryRepository()
+	chat := &telegram.Chat{ID: -3}
+	user := &telegram.User{ID: 2, FirstName: "Foo"}
+	bot := &telegram.User{ID: 1, FirstName: "Bot", IsBot: true}
+	prompt := &telegram.Message{MessageID: 1, From: user, Chat: chat, Text: strings.Repeat("Tell me everything about the history of ", 20)}
+	response := &telegram.Message{MessageID: 2, From: bot, Chat: chat, Text: "It is long.", ReplyToMessage: prompt}
+	followUp := &telegram.Message{MessageID: 3, From: user, Chat: chat, Text: "Go on", ReplyToMessage: response}
+	repo.AddMessage(prompt, thread.TypePrompt)
+	repo.AddMessage(response, thread.TypeResponse)
+	last, _ := repo.AddMessage(followUp, thread.TypePrompt)
+
+	th, _ := repo.GetThread(last.ThreadID)
+	th.Settings.MaxTokens = tokens.ContextSize(th.Settings.Model) - 80
+	if report := BuildTokenReport(th, last); !strings.Contains(report, overflow) {
+		t.Errorf("expected the long history to overflow, got '%s'", report)
+	}
+
+	th.Summary = thread.Summary{Text: "Foo asked about history.", Through: thread.GetMessageID(response)}
+	report := BuildTokenReport(th, last)
+	if strings.Contains(report, overflow) {
+		t.Errorf("expected the summarized history to fit, got '%s'", report)
+	}
+
+	sent, _, _ := PromptTurns(th, th.Turns(last), tokens.Budget(th.Settings.Model, th.Settings.MaxTokens))
+	if expected := fmt.Sprintf("Context tokens:\t\t%d\n", tokens.Count(sent)); !strings.Contains(report, expected) {
+		t.Errorf("expected '%s' in '%s'", expected, report)
+	}
+}
+
+func TestPromptTurns_NoRoom(t *testing.T) {
+	repo := thread.NewMemoryRepository()
+	user := &telegram.User{ID: 2, FirstName: "Foo"}
+	prompt := &telegram.Message{MessageID: 1, From: user, Chat: &telegram.Chat{ID: -3}, Text: "Hello"}
+	msg, _ := repo.AddMessage(prompt, thread.TypePrompt)
+	th, _ := repo.GetThread(msg.ThreadID)
+	th.Persona = &thread.Persona{Name: "talker", SystemPrompt: strings.Repeat("Always answer at great length. ", 100)}
+	budget := tokens.Count(SystemTurns(th))
+	th.Settings.MaxTokens = tokens.ContextSize(th.Settings.Model) - budget
+
+	sent, _, err := PromptTurns(th, th.Turns(msg), budget)
+	if !errors.Is(err, ErrNoConversationBudget) {
+		t.Fatalf("expected '%v', got '%v'", ErrNoConversationBudget, err)
+	}
+
+	if len(sent) != 1 || sent[0].Role != thread.RoleSystem {
+		t.Errorf("expected the instructions alone, got '%v'", sent)
+	}
+
+	if report := BuildTokenReport(th, msg); !strings.Contains(report, "leave no room for new prompts") {
+		t.Errorf("expected the report to tell there is no room, got '%s'", report)
+	}
+
+	sent, _, err = PromptTurns(th, th.Turns(msg), budget+20)
+	if err != nil || len(sent) != 2 || sent[1].Content != "Hello" {
+		t.Errorf("expected the prompt to fit next to the instructions, got '%v' '%v'", sent, err)
+	}
+}
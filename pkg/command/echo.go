@@ -16,6 +16,11 @@ func (Echo) Exec(ctx Context, msg *thread.Message) error {
 	return nil
 }
 
-func (Echo) IsReplyOnly() bool {
-	return false
+func (Echo) Spec() Spec {
+	return Spec{
+		Name:    "echo",
+		Summary: "Reply with the given text",
+		Usage:   "Useful for starting a new thread without a prompt, reply to the echoed message to continue it.",
+		Args:    []Arg{{Name: "text", Description: "The text to reply with"}},
+	}
 }
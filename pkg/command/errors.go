@@ -0,0 +1,183 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/thread"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+// ErrorKind tells the user facing reply of a failed command apart.
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindUser
+	KindUpstream
+	KindRateLimited
+	KindTimeout
+	KindNotFound
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindUser:
+		return "user"
+	case KindUpstream:
+		return "upstream"
+	case KindRateLimited:
+		return "rate limited"
+	case KindTimeout:
+		return "timeout"
+	case KindNotFound:
+		return "not found"
+	default:
+		return "internal"
+	}
+}
+
+var ErrPanic = errors.New("handler panicked")
+
+// Error is an error of a known kind, Message replaces the default reply of
+// its kind when set.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+// NewError returns err as an error of kind replied to with message.
+func NewError(kind ErrorKind, message string, err error) error {
+	return &Error{Kind: kind, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// reportedError is an error the handler already told the user about.
+type reportedError struct {
+	err error
+}
+
+func (e reportedError) Error() string {
+	return e.err.Error()
+}
+
+func (e reportedError) Unwrap() error {
+	return e.err
+}
+
+// Classify finds the kind of err.
+func Classify(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+
+	var tgErr *telegram.Error
+	if errors.Is(err, completion.ErrRateLimited) || errors.As(err, &tgErr) && tgErr.Code == http.StatusTooManyRequests {
+		return KindRateLimited
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return KindTimeout
+	case errors.Is(err, thread.ErrNotFound):
+		return KindNotFound
+	case errors.Is(err, completion.ErrAPI), errors.Is(err, completion.ErrNoChoices):
+		return KindUpstream
+	case errors.Is(err, ErrInvalidParameter), errors.Is(err, ErrMissingArgument), errors.Is(err, ErrNoContextBudget),
+		errors.Is(err, ErrNoConversationBudget), errors.Is(err, ErrAccessDenied), errors.Is(err, acl.ErrInvalidRole), errors.Is(err, acl.ErrFixedAdmin):
+		return KindUser
+	}
+
+	return KindInternal
+}
+
+var errorReplies = map[ErrorKind]string{
+	KindInternal:    "Something went wrong on my end, sorry.",
+	KindUser:        "I couldn't make sense of that, send /help to see how to use the command.",
+	KindUpstream:    "The language model failed to answer, try again in a moment.",
+	KindRateLimited: "I'm getting too many requests right now, try again in a minute.",
+	KindTimeout:     "That took too long and I gave up, try again later.",
+	KindNotFound:    "I couldn't find the thread history. I only keep a small sample of data around for future use, sorry 💩",
+}
+
+// ErrorReply is the reply telling the user about err. Replies to errors
+// operators may want to look into end with the correlation id, which is
+// logged along with the error.
+func ErrorReply(err error, correlationID string) string {
+	kind := Classify(err)
+	text := errorReplies[kind]
+	var e *Error
+	if errors.As(err, &e) && e.Message != "" {
+		// Errors with their own message explain themselves, such as the
+		// rate limits of the user.
+		return e.Message
+	}
+
+	if kind == KindUser || kind == KindNotFound || correlationID == "" {
+		return text
+	}
+
+	return fmt.Sprintf("%s (error id: %s)", text, correlationID)
+}
+
+// NewCorrelationID returns a short id identifying a single run of a command.
+func NewCorrelationID() string {
+	return uuid.NewString()[:8]
+}
+
+// HandleErrors gives every command run a correlation id and replies to the
+// command when it fails.
+func HandleErrors(next Handler) Handler {
+	return wrap(next, func(ctx Context, msg *thread.Message) error {
+		ctx.CorrelationID = NewCorrelationID()
+		err := next.Exec(ctx, msg)
+		if err == nil || errors.As(err, &reportedError{}) {
+			return err
+		}
+
+		// Commands cancelled by a shutdown are dropped without a reply.
+		if ctx.Context != nil && ctx.Context.Err() != nil {
+			return err
+		}
+
+		if replyErr := ctx.Runner.Reply(msg, ErrorReply(err, ctx.CorrelationID), thread.TypeInformational); replyErr != nil {
+			log.Printf("[%s] failed to reply to error: %s", ctx.CorrelationID, replyErr)
+		}
+
+		return err
+	})
+}
+
+// Recover turns a panic of a command into an internal error.
+func Recover(next Handler) Handler {
+	return wrap(next, func(ctx Context, msg *thread.Message) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("[%s] panic in handler '%s': %v\n%s", ctx.CorrelationID, next.Spec().Name, p, debug.Stack())
+				err = NewError(KindInternal, "", fmt.Errorf("%v: %w", p, ErrPanic))
+			}
+		}()
+
+		return next.Exec(ctx, msg)
+	})
+}
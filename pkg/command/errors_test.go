@@ -0,0 +1,179 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/thread"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		desc     string
+		err      error
+		expected ErrorKind
+	}{
+		{
+			desc:     "keeps the kind of typed errors",
+			err:      fmt.Errorf("wrapped: %w", NewError(KindUser, "nope", ErrInvalidParameter)),
+			expected: KindUser,
+		},
+		{
+			desc:     "reports rate limits of the completion api",
+			err:      fmt.Errorf("complete prompt: %w", completion.ErrRateLimited),
+			expected: KindRateLimited,
+		},
+		{
+			desc:     "reports rate limits of telegram",
+			err:      fmt.Errorf("send reply: %w", &telegram.Error{Code: 429, Message: "Too Many Requests"}),
+			expected: KindRateLimited,
+		},
+		{
+			desc:     "reports timeouts",
+			err:      fmt.Errorf("complete prompt: %w", context.DeadlineExceeded),
+			expected: KindTimeout,
+		},
+		{
+			desc:     "reports missing threads",
+			err:      fmt.Errorf("get thread: %w", thread.ErrNotFound),
+			expected: KindNotFound,
+		},
+		{
+			desc:     "reports completion api errors",
+			err:      fmt.Errorf("complete prompt: %w", completion.ErrAPI),
+			expected: KindUpstream,
+		},
+		{
+			desc:     "reports invalid arguments",
+			err:      ErrMissingArgument,
+			expected: KindUser,
+		},
+		{
+			desc:     "falls back to internal errors",
+			err:      errors.New("oops"),
+			expected: KindInternal,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if kind := Classify(tc.err); kind != tc.expected {
+				t.Errorf("expected '%v', got '%v'", tc.expected, kind)
+			}
+		})
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	cases := []struct {
+		desc     string
+		err      error
+		expected string
+	}{
+		{
+			desc:     "adds the correlation id",
+			err:      completion.ErrAPI,
+			expected: "The language model failed to answer, try again in a moment. (error id: abc)",
+		},
+		{
+			desc:     "leaves the correlation id out of user errors",
+			err:      NewError(KindUser, "Try again.", nil),
+			expected: "Try again.",
+		},
+		{
+			desc:     "keeps the not found reply",
+			err:      thread.ErrNotFound,
+			expected: errorReplies[KindNotFound],
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if reply := ErrorReply(tc.err, "abc"); reply != tc.expected {
+				t.Errorf("expected '%v', got '%v'", tc.expected, reply)
+			}
+		})
+	}
+}
+
+func TestCommandRunner_ErrorReplies(t *testing.T) {
+	cases := []struct {
+		desc      string
+		text      string
+		steps     []completion.Step
+		streaming bool
+		expected  string
+	}{
+		{
+			desc:     "replies to upstream errors",
+			text:     "/prompt Hello",
+			steps:    []completion.Step{{Err: fmt.Errorf("status 500: %w", completion.ErrAPI)}},
+			expected: "The language model failed to answer",
+		},
+		{
+			desc:     "replies to rate limits",
+			text:     "/prompt Hello",
+			steps:    []completion.Step{{Err: completion.ErrRateLimited}},
+			expected: "I'm getting too many requests right now",
+		},
+		{
+			desc:      "shows errors in the streamed reply",
+			text:      "/prompt Hello",
+			steps:     []completion.Step{{Err: completion.ErrAPI}},
+			streaming: true,
+			expected:  "The language model failed to answer",
+		},
+		{
+			desc:     "recovers from panics",
+			text:     "/panic",
+			expected: "Something went wrong on my end",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx, srv := newTestContext(t, &completion.Fake{Steps: tc.steps})
+			runner := ctx.Runner
+			runner.streaming = tc.streaming
+			runner.editInterval = time.Millisecond
+			panicking := HandlerFunc(Spec{Name: "panic", Summary: "Panics"}, func(Context, *thread.Message) error {
+				var choices []string
+				_ = choices[0]
+				return nil
+			})
+			handlers, err := NewRegistry(Prompt{}, panicking)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			handlers.Use(HandleErrors, Logging, Recover)
+			runner.handlers = handlers
+			runTestRunner(t, runner)
+
+			srv.Post(3, telegram.User{ID: 2, FirstName: "Foo"}, tc.text, nil)
+			reply := waitForSent(t, srv, 1)
+			if tc.streaming {
+				if _, err := srv.WaitFor("editMessageText", 1, 5*time.Second); err != nil {
+					t.Fatalf("expected the placeholder to be edited: %v", err)
+				}
+
+				edited, _ := srv.Message(reply.Chat.ID, reply.MessageID)
+				reply = &edited
+			}
+
+			if !strings.Contains(reply.Text, tc.expected) || !strings.Contains(reply.Text, "(error id: ") {
+				t.Errorf("expected reply to contain '%s' and an error id, got '%s'", tc.expected, reply.Text)
+			}
+
+			if sent := srv.Sent(); len(sent) != 1 {
+				t.Errorf("expected a single reply, got '%v'", sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"telegram-bot/pkg/export"
+	"telegram-bot/pkg/thread"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type Export struct{}
+
+func (Export) Exec(ctx Context, msg *thread.Message) error {
+	format := export.Formats[0]
+	if arg := strings.TrimSpace(msg.Text); arg != "" {
+		format = export.Format(strings.ToLower(arg))
+	}
+
+	t, err := ctx.Threads.GetThread(msg.ThreadID)
+	if err != nil {
+		return fmt.Errorf("get thread: %w", err)
+	}
+
+	data, err := export.Build(t, time.Now()).Render(format)
+	if errors.Is(err, export.ErrUnknownFormat) {
+		return NewError(KindUser, "Threads are exported to md, json or html.", err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("export thread: %w", err)
+	}
+
+	doc := telegram.NewDocument(msg.ID.ChannelID, telegram.FileBytes{
+		Name:  fmt.Sprintf("thread-%s.%s", t.ID, format),
+		Bytes: data,
+	})
+	doc.ReplyToMessageID = msg.ID.MessageID
+	if _, err := ctx.Telegram.Send(doc); err != nil {
+		return fmt.Errorf("send thread export: %w", err)
+	}
+
+	return nil
+}
+
+func (Export) Spec() Spec {
+	return Spec{
+		Name:      "export",
+		Summary:   "Send the whole thread as a Markdown, JSON or HTML document",
+		Usage:     "Sends every message of the thread, branches included, as a document with who sent each message, when and of what type, along with the settings of the thread. The JSON document follows a versioned schema that /import restores.",
+		Args:      []Arg{{Name: "md|json|html", Description: "The format of the document, md when left out", Optional: true}},
+		ReplyOnly: true,
+	}
+}
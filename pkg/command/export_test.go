@@ -0,0 +1,189 @@
+package command
+
+import (
+	"errors"
+	"strings"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/export"
+	"telegram-bot/pkg/telegramtest"
+	"telegram-bot/pkg/thread"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestExport(t *testing.T) {
+	_, srv := startTestRunner(t, completion.NewFake("Hi there"))
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(-3, user, "/prompt Hello", nil)
+	reply := waitForSent(t, srv, 1)
+	srv.Post(-3, user, "/export pdf", reply)
+	denied := waitForSent(t, srv, 2)
+	if expected := "Threads are exported to md, json or html."; denied.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, denied.Text)
+	}
+
+	srv.Post(-3, user, "/export", reply)
+	srv.Post(-3, user, "/export json", reply)
+	calls, err := srv.WaitFor("sendDocument", 2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the exports to be sent: %v", err)
+	}
+
+	markdown := calls[0].Files["document"]
+	if !strings.HasSuffix(markdown.Name, ".md") || !strings.Contains(string(markdown.Data), "- **Bot** (response, ") {
+		t.Errorf("expected a markdown document with the response, got '%s': '%s'", markdown.Name, markdown.Data)
+	}
+
+	doc, err := export.Parse(calls[1].Files["document"].Data)
+	if err != nil {
+		t.Fatalf("unexpected error parsing the json export: %v", err)
+	}
+
+	if root := doc.Thread.Root; root.Text != "Hello" || len(root.Replies) == 0 || root.Replies[0].Text != "Hi there" {
+		t.Errorf("expected the exported thread to start with the prompt and its response, got '%v'", root)
+	}
+}
+
+func TestImport(t *testing.T) {
+	_, exported := startTestRunner(t, completion.NewFake("Hi there"))
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+	exported.Post(-3, user, "/prompt Hello", nil)
+	reply := waitForSent(t, exported, 1)
+	exported.Post(-3, user, "/export json", reply)
+	calls, err := exported.WaitFor("sendDocument", 1, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the export to be sent: %v", err)
+	}
+
+	file := calls[0].Files["document"]
+	provider := completion.NewFake("Welcome back")
+	runner, srv := startTestRunner(t, provider)
+	srv.Post(-4, user, "/import", nil)
+	denied := waitForSent(t, srv, 1)
+	if expected := "Reply with /import to a JSON document sent by /export json."; denied.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, denied.Text)
+	}
+
+	foreign := srv.PostDocument(-4, user, file, nil)
+	srv.Post(-4, user, "/import", &foreign)
+	refused := waitForSent(t, srv, 2)
+	if expected := "That thread was exported from another chat, it can only be imported there."; refused.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, refused.Text)
+	}
+
+	doc := srv.PostDocument(-3, user, file, nil)
+	srv.Post(-3, user, "/import", &doc)
+	imported := waitForSent(t, srv, 3)
+	if imported.Text != ImportedReply {
+		t.Fatalf("expected '%s', got '%s'", ImportedReply, imported.Text)
+	}
+
+	srv.Post(-3, user, "/import", &doc)
+	again := waitForSent(t, srv, 4)
+	if expected := "That thread is still here, reply to one of its messages to continue it."; again.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, again.Text)
+	}
+
+	srv.Post(-3, user, "How are you?", imported)
+	waitForSent(t, srv, 5)
+	if len(provider.Requests) != 1 {
+		t.Fatalf("expected one completion, got %d", len(provider.Requests))
+	}
+
+	contents := []string{}
+	for _, m := range provider.Requests[0].Messages {
+		contents = append(contents, m.Content)
+	}
+
+	if history := strings.Join(contents, "|"); !strings.HasSuffix(history, "Hello|Hi there|How are you?") {
+		t.Errorf("expected the prompt to continue the imported conversation, got '%s'", history)
+	}
+
+	parsed, err := export.Parse(file.Data)
+	if err != nil {
+		t.Fatalf("unexpected error parsing the export: %v", err)
+	}
+
+	postDocument := func(doc export.Document) *telegram.Message {
+		data, err := doc.Render(export.FormatJSON)
+		if err != nil {
+			t.Fatalf("unexpected error rendering: %v", err)
+		}
+
+		sent := srv.PostDocument(-3, user, telegramtest.File{Name: "thread.json", Data: data}, nil)
+		return &sent
+	}
+
+	// A new root whose reply is already in the repository.
+	colliding := parsed
+	root := *parsed.Thread.Root
+	root.ID.MessageID = 1000
+	colliding.Thread.Root = &root
+	srv.Post(-3, user, "/import", postDocument(colliding))
+	collided := waitForSent(t, srv, 6)
+	if collided.Text != again.Text {
+		t.Errorf("expected '%s', got '%s'", again.Text, collided.Text)
+	}
+
+	invalid := parsed
+	root = *parsed.Thread.Root
+	root.ID.MessageID = 2000
+	root.Replies = nil
+	invalid.Thread.Root = &root
+	invalid.Thread.Settings.Model = "davinci-from-elsewhere"
+	srv.Post(-3, user, "/import", postDocument(invalid))
+	rejected := waitForSent(t, srv, 7)
+	if expected := "The settings of that thread aren't ones /tweak accepts."; rejected.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, rejected.Text)
+	}
+
+	for _, id := range []int{1000, 2000} {
+		if _, err := runner.repo.GetMessage(thread.MessageID{ChannelID: -3, FromID: user.ID, MessageID: id}); !errors.Is(err, thread.ErrNotFound) {
+			t.Errorf("expected nothing of the refused document with root %d to be imported, got '%v'", id, err)
+		}
+	}
+}
+
+func TestImport_SettingsNeedTweak(t *testing.T) {
+	ctx, srv := newTestContext(t, completion.NewFake())
+	runner := ctx.Runner
+	var err error
+	if runner.acl, err = acl.New(nil, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	runner.acl.Grant(-3, acl.RoleUser)
+	runTestRunner(t, runner)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	exported := thread.NewMemoryRepository()
+	prompt := &telegram.Message{MessageID: 1, From: &user, Chat: &telegram.Chat{ID: -3}, Text: "Hello"}
+	root, _ := exported.AddMessage(prompt, thread.TypePrompt)
+	th, _ := exported.GetThread(root.ThreadID)
+	th.Settings.Model = "gpt-4"
+	th.Settings.MaxTokens = 9000
+	th.SetSource(thread.SourceThread, "Model", "MaxTokens")
+	exported.Set(th)
+	th, _ = exported.GetThread(root.ThreadID)
+	data, _ := export.Build(th, time.Now()).Render(export.FormatJSON)
+
+	doc := srv.PostDocument(-3, user, telegramtest.File{Name: "thread.json", Data: data}, nil)
+	srv.Post(-3, user, "/import", &doc)
+	if imported := waitForSent(t, srv, 1); imported.Text != ImportedReply {
+		t.Fatalf("expected '%s', got '%s'", ImportedReply, imported.Text)
+	}
+
+	msg, err := runner.repo.GetMessage(thread.GetMessageID(prompt))
+	if err != nil {
+		t.Fatalf("expected the thread to be imported: %v", err)
+	}
+
+	restored, _ := runner.repo.GetThread(msg.ThreadID)
+	if restored.Settings != thread.DefaultOpenAISettings || restored.Source("Model") != thread.SourceGlobal {
+		t.Errorf("expected users who can't /tweak to import the settings of the chat, got '%v' '%v'", restored.Settings, restored.Sources)
+	}
+}
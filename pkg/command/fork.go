@@ -0,0 +1,80 @@
+package command
+
+import (
+	"fmt"
+	"telegram-bot/pkg/thread"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ForkQuoteLength is how many characters of the message a thread was forked
+// at are quoted by the root of the fork.
+const ForkQuoteLength int = 64
+
+type Fork struct{}
+
+func (Fork) Exec(ctx Context, msg *thread.Message) error {
+	at := msg.Parent()
+	if at == nil {
+		return thread.ErrNotFound
+	}
+
+	t, err := ctx.Threads.GetThread(msg.ThreadID)
+	if err != nil {
+		return fmt.Errorf("get thread: %w", err)
+	}
+
+	// A response showing another alternative forks from the one shown.
+	if branch, ok := t.Selected[at.ID.MessageID]; ok {
+		if shown, err := ctx.Threads.GetMessage(branch); err == nil {
+			at = shown
+		}
+	}
+
+	text := fmt.Sprintf("Forked the conversation up to \"%s\" into a new thread, reply to this message to continue from there.", quote(at.Text, ForkQuoteLength))
+	sent, err := ctx.Telegram.Send(telegram.NewMessage(msg.ID.ChannelID, text))
+	if err != nil {
+		return fmt.Errorf("send fork root: %w", err)
+	}
+
+	root, err := ctx.Threads.AddMessage(&sent, thread.TypeInformational)
+	if err != nil {
+		return fmt.Errorf("add fork root: %w", err)
+	}
+
+	forked, err := ctx.Threads.GetThread(root.ThreadID)
+	if err != nil {
+		return fmt.Errorf("get forked thread: %w", err)
+	}
+
+	forked.Settings = t.Settings
+	forked.Summary = t.Summary
+	forked.Persona = t.Persona
+	forked.Language = t.Language
+	forked.Sources = t.Sources
+	forked.Fork = &thread.Fork{ThreadID: t.ID, MessageID: at.ID, History: t.Turns(at)}
+	if err := ctx.Threads.Set(forked); err != nil {
+		return fmt.Errorf("save forked thread: %w", err)
+	}
+
+	return nil
+}
+
+// quote shortens text to at most length characters.
+func quote(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+
+	return string(runes[:length-1]) + "…"
+}
+
+func (Fork) Spec() Spec {
+	return Spec{
+		Name:      "fork",
+		Summary:   "Continue the conversation up to a message in a new thread",
+		Usage:     "Reply with /fork to any message of a thread to start a new thread from the conversation leading up to it, with the same settings. The new thread starts with a fresh message, replies to it continue from the forked conversation while the original thread stays as it was.",
+		ReplyOnly: true,
+	}
+}
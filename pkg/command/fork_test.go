@@ -0,0 +1,64 @@
+package command
+
+import (
+	"reflect"
+	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/thread"
+	"testing"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestFork(t *testing.T) {
+	provider := completion.NewFake("First", "Second", "Third")
+	runner, srv := startTestRunner(t, provider)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(-3, user, "/prompt Hello", nil)
+	first := waitForSent(t, srv, 1)
+	srv.Post(-3, user, "Tell me more", first)
+	waitForSent(t, srv, 2)
+
+	answer, _ := runner.repo.GetMessage(thread.GetMessageID(first))
+	original, _ := runner.repo.GetThread(answer.ThreadID)
+	original.Settings.MaxTokens = 100
+	runner.repo.Set(original)
+
+	srv.Post(-3, user, "/fork", first)
+	root := waitForSent(t, srv, 3)
+	if root.ReplyToMessage != nil || !strings.Contains(root.Text, "\"First\"") {
+		t.Errorf("expected a fresh message quoting 'First', got '%v'", root)
+	}
+
+	srv.Post(-3, user, "Something else", root)
+	waitForSent(t, srv, 4)
+	expected := []completion.Message{
+		{Role: completion.RoleUser, Name: "Foo", Content: "Hello"},
+		{Role: completion.RoleAssistant, Content: "First"},
+		{Role: completion.RoleUser, Name: "Foo", Content: "Something else"},
+	}
+	if messages := provider.Requests[2].Messages; !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, messages)
+	}
+
+	if maxTokens := provider.Requests[2].MaxTokens; maxTokens != 100 {
+		t.Errorf("expected '%d', got '%d'", 100, maxTokens)
+	}
+
+	forkRoot, err := runner.repo.GetMessage(thread.GetMessageID(root))
+	if err != nil {
+		t.Fatalf("unexpected error getting fork root: %v", err)
+	}
+
+	forked, _ := runner.repo.GetThread(forkRoot.ThreadID)
+	if forked.ID == original.ID || forked.Fork == nil || forked.Fork.ThreadID != original.ID {
+		t.Errorf("expected a new thread forked from '%s', got '%v'", original.ID, forked)
+	}
+
+	srv.Post(-3, user, "/dump", root)
+	dump := waitForSent(t, srv, 5)
+	if expected := "Forked from:\t\t" + original.ID.String(); !strings.Contains(dump.Text, expected) {
+		t.Errorf("expected the dump to contain '%s', got '%s'", expected, dump.Text)
+	}
+}
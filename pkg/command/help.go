@@ -1,32 +1,37 @@
 package command
 
 import (
+	"fmt"
 	"strings"
+	"telegram-bot/pkg/acl"
 	"telegram-bot/pkg/thread"
 )
 
 type Help struct{}
 
 func (Help) Exec(ctx Context, msg *thread.Message) error {
-	ctx.Runner.Reply(msg, PrintHelp(), thread.TypeInformational)
-	return nil
-}
+	name := strings.TrimPrefix(strings.TrimSpace(msg.Text), "/")
+	if name == "" {
+		ctx.Runner.Reply(msg, PrintHelp(ctx.Runner.handlers, ctx.Scope), thread.TypeInformational)
+		return nil
+	}
 
-func PrintHelp() string {
-	var b strings.Builder
-	b.WriteString("```\n")
-	b.WriteString("Commands:\n")
-	b.WriteString("  /prompt <text>: Initate a new thread starting with the provided prompt.\n")
-	b.WriteString("  /echo <text>:   Reply with the exact text (starts a new thread without prompt)\n")
-	b.WriteString("  /help:          Prints this text\n")
-	b.WriteString("\n")
-	b.WriteString("Reply only commands:\n")
-	b.WriteString("  /dump: Dumps out technical information about the current conversation thread\n")
-	b.WriteString(TweakParamHelp)
-	b.WriteString("```\n")
-	return b.String()
+	handler, ok := ctx.Runner.handlers.Lookup(name)
+	if !ok {
+		ctx.Runner.Reply(msg, fmt.Sprintf("I don't know the command /%s, send /help to see the ones I know.", name), thread.TypeInformational)
+		return nil
+	}
+
+	ctx.Runner.Reply(msg, CommandHelp(handler.Spec()), thread.TypeInformational)
+	return nil
 }
 
-func (Help) IsReplyOnly() bool {
-	return false
+func (Help) Spec() Spec {
+	return Spec{
+		Name:    "help",
+		Aliases: []string{"start"},
+		Summary: "List the commands or explain one of them",
+		Args:    []Arg{{Name: "command", Description: "The command to explain", Optional: true}},
+		Role:    acl.RoleNone,
+	}
 }
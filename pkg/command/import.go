@@ -0,0 +1,188 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"telegram-bot/pkg/export"
+	"telegram-bot/pkg/settings"
+	"telegram-bot/pkg/thread"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MaxImportSize is the largest document /import downloads, far more than the
+// export of any thread the repository keeps.
+const MaxImportSize int = 4 << 20
+
+// ImportedReply is sent once a thread is imported, the restored conversation
+// continues from replies to it.
+const ImportedReply string = "Imported the thread, reply to this message to continue it."
+
+var (
+	ErrNoDocument       = errors.New("no document to import")
+	ErrDocumentTooLarge = errors.New("document too large to import")
+)
+
+type Import struct{}
+
+func (Import) Exec(ctx Context, msg *thread.Message) error {
+	var doc *telegram.Document
+	if ctx.Source != nil && ctx.Source.ReplyToMessage != nil {
+		doc = ctx.Source.ReplyToMessage.Document
+	}
+
+	if doc == nil || !strings.HasSuffix(strings.ToLower(doc.FileName), ".json") {
+		return NewError(KindUser, "Reply with /import to a JSON document sent by /export json.", ErrNoDocument)
+	}
+
+	if doc.FileSize > MaxImportSize {
+		return NewError(KindUser, "That document is too large to be a thread export.", fmt.Errorf("%d bytes: %w", doc.FileSize, ErrDocumentTooLarge))
+	}
+
+	data, err := ctx.Runner.download(ctx.Context, doc.FileID)
+	if err != nil {
+		return fmt.Errorf("download document: %w", err)
+	}
+
+	parsed, err := export.Parse(data)
+	if err != nil {
+		return NewError(KindUser, "That document isn't a thread export I can read.", err)
+	}
+
+	// Settings are only imported from those who could /tweak them, the
+	// others get the settings new threads of the chat start with.
+	if err := ctx.Runner.authorize(Tweak{}.Spec(), ctx.Source); err != nil {
+		parsed.Thread.Settings = ctx.Runner.chatDefaults(msg.ID.ChannelID)
+	} else if err := checkSettings(parsed.Thread.Settings); err != nil {
+		return NewError(KindUser, "The settings of that thread aren't ones /tweak accepts.", err)
+	}
+
+	t, err := parsed.Restore(ctx.Threads, msg.ID.ChannelID)
+	if errors.Is(err, export.ErrExists) {
+		return NewError(KindUser, "That thread is still here, reply to one of its messages to continue it.", err)
+	}
+
+	if errors.Is(err, export.ErrForeignChat) {
+		return NewError(KindUser, "That thread was exported from another chat, it can only be imported there.", err)
+	}
+
+	if errors.Is(err, thread.ErrThreadExpired) {
+		return NewError(KindUser, "That thread is longer than the threads I keep.", err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("restore thread: %w", err)
+	}
+
+	reply := telegram.NewMessage(msg.ID.ChannelID, ImportedReply)
+	reply.ReplyToMessageID = msg.ID.MessageID
+	sent, err := ctx.Telegram.Send(reply)
+	if err != nil {
+		return fmt.Errorf("send import reply: %w", err)
+	}
+
+	// The reply joins the restored thread at the end of its latest branch,
+	// so replying to it continues the imported conversation.
+	sent.ReplyToMessage = replyTarget(latest(t.Root))
+	if _, err := ctx.Threads.AddMessage(&sent, thread.TypeInformational); err != nil {
+		return fmt.Errorf("add import reply: %w", err)
+	}
+
+	return nil
+}
+
+// checkSettings checks the settings of an imported thread the way /tweak
+// checks those it sets.
+func checkSettings(s export.Settings) error {
+	if err := CheckParameters(s.Parameters()); err != nil {
+		return err
+	}
+
+	for key, source := range s.Sources {
+		if !settings.IsKey(key) {
+			return fmt.Errorf("source of '%s': %w", key, ErrInvalidParameter)
+		}
+
+		switch source {
+		case thread.SourceGlobal, thread.SourceChat, thread.SourceThread:
+		default:
+			return fmt.Errorf("source '%s' of %s: %w", source, key, ErrInvalidParameter)
+		}
+	}
+
+	return nil
+}
+
+// chatDefaults returns the settings new threads of chatID start with, the
+// persona of the chat aside.
+func (r *CommandRunner) chatDefaults(chatID int64) export.Settings {
+	t := thread.Thread{Settings: thread.DefaultOpenAISettings}
+	if r.chatSettings != nil {
+		if err := ApplyChatDefaults(&t, r.chatSettings.Get(chatID), nil); err != nil {
+			log.Printf("failed to apply the settings of chat %d: %s", chatID, err)
+		}
+	}
+
+	return export.SettingsOf(t)
+}
+
+// latest returns the end of the branch of m that was added last.
+func latest(m *thread.Message) *thread.Message {
+	for children := m.Children(); len(children) > 0; children = m.Children() {
+		m = children[len(children)-1]
+	}
+
+	return m
+}
+
+// download fetches the file with fileID from Telegram.
+func (r *CommandRunner) download(ctx context.Context, fileID string) ([]byte, error) {
+	file, err := r.bot.GetFile(telegram.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, fmt.Errorf("get file: %w", err)
+	}
+
+	endpoint := r.fileEndpoint
+	if endpoint == "" {
+		endpoint = telegram.FileEndpoint
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(endpoint, r.bot.Token, file.FilePath), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := r.bot.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch file: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(MaxImportSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	if len(data) > MaxImportSize {
+		return nil, fmt.Errorf("more than %d bytes: %w", MaxImportSize, ErrDocumentTooLarge)
+	}
+
+	return data, nil
+}
+
+func (Import) Spec() Spec {
+	return Spec{
+		Name:    "import",
+		Summary: "Restore a thread from its JSON export",
+		Usage:   "Reply with /import to a JSON document sent by /export json to restore the thread, branches and settings included. I answer with a fresh message, replies to it continue from the end of the latest branch of the imported thread. Threads are only imported into the chat they were exported from, their settings only from those who can /tweak.",
+	}
+}
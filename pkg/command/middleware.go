@@ -0,0 +1,149 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"telegram-bot/pkg/thread"
+	"time"
+)
+
+var ErrUnknownCommand = errors.New("unknown command")
+
+// Middleware wraps a handler to add behaviour shared between commands, such as
+// logging or checks that can stop the handler from running.
+type Middleware func(Handler) Handler
+
+// HandlerFunc turns a function into the Exec of a handler with spec.
+func HandlerFunc(spec Spec, exec func(Context, *thread.Message) error) Handler {
+	return funcHandler{spec: spec, exec: exec}
+}
+
+type funcHandler struct {
+	spec Spec
+	exec func(Context, *thread.Message) error
+}
+
+func (h funcHandler) Exec(ctx Context, msg *thread.Message) error {
+	return h.exec(ctx, msg)
+}
+
+func (h funcHandler) Spec() Spec {
+	return h.spec
+}
+
+// wrap returns a handler with the spec of next running exec.
+func wrap(next Handler, exec func(Context, *thread.Message) error) Handler {
+	return HandlerFunc(next.Spec(), exec)
+}
+
+// Chain wraps h in middlewares, the first middleware is the outermost and
+// runs first.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// Use adds middlewares run around every command, after the ones added before.
+func (r *Registry) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// UseFor adds middlewares run around a single command, inside the ones run
+// around every command.
+func (r *Registry) UseFor(name string, middlewares ...Middleware) error {
+	h, ok := r.Lookup(name)
+	if !ok {
+		return fmt.Errorf("'%s': %w", name, ErrUnknownCommand)
+	}
+
+	spec := h.Spec()
+	r.commandMiddlewares[spec.Name] = append(r.commandMiddlewares[spec.Name], middlewares...)
+	return nil
+}
+
+// Wrap wraps h in the middlewares of every command followed by its own.
+func (r *Registry) Wrap(h Handler) Handler {
+	middlewares := append([]Middleware{}, r.middlewares...)
+	middlewares = append(middlewares, r.commandMiddlewares[h.Spec().Name]...)
+	return Chain(h, middlewares...)
+}
+
+// Logging logs every command along with how it ended.
+func Logging(next Handler) Handler {
+	return wrap(next, func(ctx Context, msg *thread.Message) error {
+		log.Printf("[%s] Handle command [%s] %s: %s", ctx.CorrelationID, msg.Sender.DisplayName(), next.Spec().Name, msg.Text)
+		start := time.Now()
+		err := next.Exec(ctx, msg)
+		if err != nil {
+			log.Printf("[%s] %s error in handler '%s' after %s: %s", ctx.CorrelationID, Classify(err), next.Spec().Name, time.Since(start), err)
+		}
+
+		return err
+	})
+}
+
+// Timeout cancels the context of a command running longer than d.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return wrap(next, func(ctx Context, msg *thread.Message) error {
+			timeout, cancel := context.WithTimeout(ctx.Context, d)
+			defer cancel()
+
+			ctx.Context = timeout
+			err := next.Exec(ctx, msg)
+			if errors.Is(timeout.Err(), context.DeadlineExceeded) {
+				log.Printf("command '%s' timed out after %s", next.Spec().Name, d)
+			}
+
+			return err
+		})
+	}
+}
+
+// ChatActivity shows action in the chat while a command runs. Handlers can
+// switch the action through Context.Activity.
+func ChatActivity(action string) Middleware {
+	return func(next Handler) Handler {
+		return wrap(next, func(ctx Context, msg *thread.Message) error {
+			ctx.Activity = ctx.Runner.StartActivity(ctx.Context, msg.ID.ChannelID, action)
+			defer ctx.Activity.Stop()
+			return next.Exec(ctx, msg)
+		})
+	}
+}
+
+// ReplyOnly stops reply only commands sent outside of a thread.
+func ReplyOnly(next Handler) Handler {
+	return wrap(next, func(ctx Context, msg *thread.Message) error {
+		if next.Spec().ReplyOnly && ctx.Source != nil && ctx.Source.ReplyToMessage == nil {
+			log.Printf("attempted to call a reply only handler without a reply message, skipping")
+			ctx.Runner.Reply(msg, "That command can only be used in the context of a thread, try replying to an existing message.", thread.TypeInformational)
+			return nil
+		}
+
+		return next.Exec(ctx, msg)
+	})
+}
+
+// ValidateArgs stops commands sent without their required arguments.
+func ValidateArgs(next Handler) Handler {
+	return wrap(next, func(ctx Context, msg *thread.Message) error {
+		spec := next.Spec()
+		if ctx.Source == nil || !ctx.Source.IsCommand() {
+			return next.Exec(ctx, msg)
+		}
+
+		if err := spec.Validate(msg.Text); err != nil {
+			log.Printf("invalid use of command '%s': %s", spec.Name, err)
+			ctx.Runner.Reply(msg, "Incorrect usage of command, the correct syntax is "+spec.Synopsis()+". Send /help "+spec.Name+" to learn more.", thread.TypeInformational)
+			return nil
+		}
+
+		return next.Exec(ctx, msg)
+	})
+}
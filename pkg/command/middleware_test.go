@@ -0,0 +1,84 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"telegram-bot/pkg/thread"
+	"testing"
+	"time"
+)
+
+// recordingMiddleware appends name to calls before and after running the
+// handler it wraps.
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next Handler) Handler {
+		return wrap(next, func(ctx Context, msg *thread.Message) error {
+			*calls = append(*calls, name+" before")
+			err := next.Exec(ctx, msg)
+			*calls = append(*calls, name+" after")
+			return err
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	calls := []string{}
+	spec := Spec{Name: "foo", Summary: "Does foo"}
+	h := HandlerFunc(spec, func(Context, *thread.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+
+	chained := Chain(h, recordingMiddleware("outer", &calls), recordingMiddleware("inner", &calls))
+	if err := chained.Exec(Context{}, &thread.Message{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, calls)
+	}
+
+	if !reflect.DeepEqual(chained.Spec(), spec) {
+		t.Errorf("expected middlewares to keep the spec '%v', got '%v'", spec, chained.Spec())
+	}
+}
+
+func TestRegistry_UseFor(t *testing.T) {
+	calls := []string{}
+	foo := HandlerFunc(Spec{Name: "foo", Aliases: []string{"f"}, Summary: "Does foo"}, func(Context, *thread.Message) error { return nil })
+	bar := HandlerFunc(Spec{Name: "bar", Summary: "Does bar"}, func(Context, *thread.Message) error { return nil })
+	r, err := NewRegistry(foo, bar)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r.Use(recordingMiddleware("global", &calls))
+	if err := r.UseFor("f", recordingMiddleware("foo", &calls)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := r.UseFor("baz", recordingMiddleware("baz", &calls)); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("expected unknown command, got '%v'", err)
+	}
+
+	r.Wrap(foo).Exec(Context{}, &thread.Message{})
+	r.Wrap(bar).Exec(Context{}, &thread.Message{})
+	expected := []string{"global before", "foo before", "foo after", "global after", "global before", "global after"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, calls)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	h := Chain(HandlerFunc(Spec{Name: "slow"}, func(ctx Context, msg *thread.Message) error {
+		<-ctx.Context.Done()
+		return ctx.Context.Err()
+	}), Timeout(10*time.Millisecond))
+
+	err := h.Exec(Context{Context: context.Background()}, &thread.Message{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the command to time out, got '%v'", err)
+	}
+}
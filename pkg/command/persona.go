@@ -0,0 +1,298 @@
+package command
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"telegram-bot/pkg/persona"
+	"telegram-bot/pkg/settings"
+	"telegram-bot/pkg/thread"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+// PersonaHelp explains how personas are saved.
+const PersonaHelp string = `/persona save <name> [<setting>=<value>;]
+<system prompt>
+
+Settings:
+	DisplayName:      <the name the bot goes by>
+	Model and the other /tweak parameters
+`
+
+var ErrNoPersonas = errors.New("no persona library")
+
+// personaActions are the words /persona takes instead of a persona name.
+var personaActions = map[string]bool{"save": true, "delete": true, "show": true, "none": true}
+
+// PersonasFromEnv opens the library of personas saved with /persona save,
+// which starts empty on every run when threads are kept in memory.
+func PersonasFromEnv(st Storage) (*persona.Library, error) {
+	store, err := openStore[persona.Store](st, ".personas", nil,
+		func(path string) (persona.Store, error) { return persona.NewFileStore(path), nil },
+		func(db *sql.DB) (persona.Store, error) {
+			s, err := persona.NewSQLStore(db)
+			return s, err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return persona.NewLibrary(store)
+}
+
+// mentionedPersona finds the persona a /prompt starts with, as in
+// "/prompt @pirate Ahoy". It returns the message without the mention so it
+// isn't part of the conversation.
+func (r *CommandRunner) mentionedPersona(source *telegram.Message) (*telegram.Message, *persona.Persona, error) {
+	args := source.CommandArguments()
+	name, rest, ok := persona.Mention(args)
+	if !ok || r.personas == nil {
+		return source, nil, nil
+	}
+
+	p, err := r.personas.Get(name)
+	if err != nil {
+		return source, nil, unknownPersona(name, err)
+	}
+
+	stripped := *source
+	stripped.Text = source.Text[:len(source.Text)-len(args)] + rest
+	return &stripped, &p, nil
+}
+
+func unknownPersona(name string, err error) error {
+	return NewError(KindUser, fmt.Sprintf("I don't know the persona @%s, send /persona to see the saved ones.", name), err)
+}
+
+// setPersona gives the thread p, along with its model and parameters.
+func setPersona(threads thread.Repository, threadID uuid.UUID, p persona.Persona) error {
+	t, err := threads.GetThread(threadID)
+	if err != nil {
+		return fmt.Errorf("get thread: %w", err)
+	}
+
+	if err := applyPersona(&t, p, thread.SourceThread); err != nil {
+		return err
+	}
+
+	if err := threads.Set(t); err != nil {
+		return fmt.Errorf("save thread persona: %w", err)
+	}
+
+	return nil
+}
+
+// applyPersona gives t the persona p along with its model and parameters,
+// recording that they come from source.
+func applyPersona(t *thread.Thread, p persona.Persona, source thread.Source) error {
+	if p.Model != "" {
+		t.Settings.Model = p.Model
+		t.SetSource(source, settings.KeyModel)
+	}
+
+	var err error
+	if t.Settings, err = ApplyTweaks(t.Settings, p.Params); err != nil {
+		return fmt.Errorf("apply parameters of persona %s: %w", p.Name, err)
+	}
+
+	t.Persona = &thread.Persona{Name: p.Name, DisplayName: p.DisplayName, SystemPrompt: p.SystemPrompt}
+	t.SetSource(source, append(TweakKeys(p.Params), settings.KeyPersona)...)
+	return nil
+}
+
+type Persona struct{}
+
+func (Persona) Exec(ctx Context, msg *thread.Message) error {
+	library := ctx.Runner.personas
+	if library == nil {
+		return NewError(KindUser, "There are no personas.", ErrNoPersonas)
+	}
+
+	firstLine, body, _ := strings.Cut(msg.Text, "\n")
+	args := strings.Fields(firstLine)
+	if len(args) == 0 {
+		ctx.Runner.Reply(msg, BuildPersonaList(library.List()), thread.TypeInformational)
+		return nil
+	}
+
+	action := strings.ToLower(strings.TrimPrefix(args[0], "@"))
+	switch action {
+	case "save":
+		if err := requireAdmin(ctx, msg, "Only admins can save personas."); err != nil {
+			return err
+		}
+
+		p, err := ParsePersona(strings.Join(args[1:], " "), body)
+		if err != nil {
+			return err
+		}
+
+		if err := library.Save(p); err != nil {
+			return err
+		}
+
+		ctx.Runner.Reply(msg, fmt.Sprintf("Saved @%s.", p.Name), thread.TypeInformational)
+	case "delete":
+		if err := requireAdmin(ctx, msg, "Only admins can delete personas."); err != nil {
+			return err
+		}
+
+		if len(args) != 2 {
+			return fmt.Errorf("name: %w", ErrMissingArgument)
+		}
+
+		name := strings.TrimPrefix(args[1], "@")
+		if err := library.Delete(name); err != nil {
+			return unknownPersona(name, err)
+		}
+
+		ctx.Runner.Reply(msg, fmt.Sprintf("Deleted @%s.", name), thread.TypeInformational)
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf("name: %w", ErrMissingArgument)
+		}
+
+		name := strings.TrimPrefix(args[1], "@")
+		p, err := library.Get(name)
+		if err != nil {
+			return unknownPersona(name, err)
+		}
+
+		ctx.Runner.Reply(msg, BuildPersonaReport(p), thread.TypeInformational)
+	default:
+		return switchPersona(ctx, msg, action)
+	}
+
+	return nil
+}
+
+// switchPersona gives the thread of msg the persona called name, or takes its
+// persona away for "none".
+func switchPersona(ctx Context, msg *thread.Message, name string) error {
+	if msg.Parent() == nil {
+		return NewError(KindUser, "Reply to a message of a thread to switch its persona.", thread.ErrNotFound)
+	}
+
+	if name == "none" {
+		t, err := ctx.Threads.GetThread(msg.ThreadID)
+		if err != nil {
+			return fmt.Errorf("get thread: %w", err)
+		}
+
+		t.Persona = nil
+		t.SetSource(thread.SourceThread, settings.KeyPersona)
+		if err := ctx.Threads.Set(t); err != nil {
+			return fmt.Errorf("save thread persona: %w", err)
+		}
+
+		ctx.Runner.Reply(msg, "This thread no longer has a persona.", thread.TypeInformational)
+		return nil
+	}
+
+	p, err := ctx.Runner.personas.Get(name)
+	if err != nil {
+		return unknownPersona(name, err)
+	}
+
+	if err := setPersona(ctx.Threads, msg.ThreadID, p); err != nil {
+		return err
+	}
+
+	ctx.Runner.Reply(msg, fmt.Sprintf("This thread now talks as @%s.", p.Name), thread.TypeInformational)
+	return nil
+}
+
+// ParsePersona reads a persona from the name and settings following
+// "/persona save" and the system prompt on the lines below.
+func ParsePersona(header string, systemPrompt string) (persona.Persona, error) {
+	name, settings, _ := strings.Cut(strings.TrimSpace(header), " ")
+	p := persona.Persona{Name: strings.TrimPrefix(name, "@"), SystemPrompt: strings.TrimSpace(systemPrompt)}
+	if err := persona.ValidateName(p.Name); err != nil || personaActions[p.Name] {
+		return p, NewError(KindUser, "Persona names are up to 32 lower case letters, digits, dashes and underscores, and can't be save, delete, show or none.", persona.ErrInvalidName)
+	}
+
+	if p.SystemPrompt == "" {
+		return p, NewError(KindUser, "Incorrect usage of command, the correct syntax is "+PersonaHelp, ErrMissingArgument)
+	}
+
+	var params []string
+	for _, setter := range strings.Split(settings, ";") {
+		key, val, _ := strings.Cut(setter, "=")
+		switch strings.TrimSpace(key) {
+		case "":
+		case "DisplayName":
+			p.DisplayName = strings.TrimSpace(val)
+		case "Model":
+			p.Model = strings.TrimSpace(val)
+		default:
+			params = append(params, strings.TrimSpace(setter))
+		}
+	}
+
+	// The settings are checked now, so the persona can always be applied.
+	p.Params = strings.Join(params, ";")
+	if _, err := setModel(thread.DefaultOpenAISettings, p.Model); p.Model != "" && err != nil {
+		return p, NewError(KindUser, "Incorrect usage of command, the correct syntax is "+PersonaHelp, err)
+	}
+
+	if _, err := ApplyTweaks(thread.DefaultOpenAISettings, p.Params); p.Params != "" && err != nil {
+		return p, NewError(KindUser, "Incorrect usage of command, the correct syntax is "+PersonaHelp, err)
+	}
+
+	return p, nil
+}
+
+// BuildPersonaList lists the saved personas along with how to use them.
+func BuildPersonaList(personas []persona.Persona) string {
+	if len(personas) == 0 {
+		return "There are no saved personas yet, admins can save them with " + PersonaHelp
+	}
+
+	var b strings.Builder
+	b.WriteString("Saved personas:\n")
+	for _, p := range personas {
+		b.WriteString("  @" + p.Name)
+		if p.DisplayName != "" {
+			b.WriteString(" (" + p.DisplayName + ")")
+		}
+
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\nStart a thread with /prompt @<name> <text>, or reply to a thread with /persona <name> to switch it.\n")
+	return b.String()
+}
+
+// BuildPersonaReport describes everything a persona is made of.
+func BuildPersonaReport(p persona.Persona) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("Persona @%s:\n", p.Name))
+	if p.DisplayName != "" {
+		b.WriteString(fmt.Sprintf("    Display name:\t\t%s\n", p.DisplayName))
+	}
+
+	if p.Model != "" {
+		b.WriteString(fmt.Sprintf("    Model:\t\t%s\n", p.Model))
+	}
+
+	if p.Params != "" {
+		b.WriteString(fmt.Sprintf("    Parameters:\t\t%s\n", p.Params))
+	}
+
+	b.WriteString(fmt.Sprintf("    System prompt:\n%s\n", p.SystemPrompt))
+	return b.String()
+}
+
+func (Persona) Spec() Spec {
+	return Spec{
+		Name:    "persona",
+		Summary: "List, save or switch the personas the bot plays",
+		Usage:   "Lists the saved personas, or shows one. Reply to a thread with a persona name to switch the thread to it, or with none to drop its persona. Admins save and delete personas:\n" + PersonaHelp,
+		Args: []Arg{
+			{Name: "name", Description: "The persona to switch to, or save, delete or show followed by a persona name", Optional: true},
+		},
+	}
+}
@@ -0,0 +1,144 @@
+package command
+
+import (
+	"errors"
+	"strings"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/persona"
+	"testing"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestParsePersona(t *testing.T) {
+	cases := []struct {
+		desc        string
+		header      string
+		prompt      string
+		expected    persona.Persona
+		expectedErr error
+	}{
+		{
+			desc:   "reads the settings",
+			header: "pirate DisplayName=Captain Jack; Model=gpt-4; Temperature=0.9",
+			prompt: "Talk like a pirate.\n",
+			expected: persona.Persona{
+				Name:         "pirate",
+				DisplayName:  "Captain Jack",
+				SystemPrompt: "Talk like a pirate.",
+				Model:        "gpt-4",
+				Params:       "Temperature=0.9",
+			},
+		},
+		{
+			desc:     "needs no settings",
+			header:   "@chef",
+			prompt:   "You are a chef.",
+			expected: persona.Persona{Name: "chef", SystemPrompt: "You are a chef."},
+		},
+		{
+			desc:        "rejects invalid names",
+			header:      "Pirate",
+			prompt:      "Talk like a pirate.",
+			expectedErr: persona.ErrInvalidName,
+		},
+		{
+			desc:        "rejects the names of actions",
+			header:      "none",
+			prompt:      "Talk like a pirate.",
+			expectedErr: persona.ErrInvalidName,
+		},
+		{
+			desc:        "needs a system prompt",
+			header:      "pirate",
+			expectedErr: ErrMissingArgument,
+		},
+		{
+			desc:        "rejects invalid parameters",
+			header:      "pirate Temperature=9",
+			prompt:      "Talk like a pirate.",
+			expectedErr: ErrInvalidParameter,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := ParsePersona(tc.header, tc.prompt)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if err == nil && p != tc.expected {
+				t.Errorf("expected '%v', got '%v'", tc.expected, p)
+			}
+		})
+	}
+}
+
+func TestPersona(t *testing.T) {
+	provider := completion.NewFake("Ahoy!", "Bonjour!")
+	ctx, srv := newTestContext(t, provider)
+	runner := ctx.Runner
+	var err error
+	if runner.personas, err = persona.NewLibrary(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if runner.acl, err = acl.New(nil, 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	runTestRunner(t, runner)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/persona save pirate DisplayName=Captain; Model=gpt-4\nTalk like a pirate.", nil)
+	waitForSent(t, srv, 1)
+
+	srv.Post(3, user, "/prompt @unknown Hello", nil)
+	unknown := waitForSent(t, srv, 2)
+	if expected := "I don't know the persona @unknown, send /persona to see the saved ones."; unknown.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, unknown.Text)
+	}
+
+	srv.Post(3, user, "/prompt @pirate Where is the treasure?", nil)
+	reply := waitForSent(t, srv, 3)
+	if len(provider.Requests) != 1 {
+		t.Fatalf("expected a single completion, got '%v'", provider.Requests)
+	}
+
+	req := provider.Requests[0]
+	if req.Model != "gpt-4" {
+		t.Errorf("expected the model of the persona, got '%s'", req.Model)
+	}
+
+	expected := []completion.Message{
+		{Role: completion.RoleSystem, Content: "Talk like a pirate."},
+		{Role: completion.RoleUser, Name: "Foo", Content: "Where is the treasure?"},
+	}
+	if len(req.Messages) != 2 || req.Messages[0] != expected[0] || req.Messages[1] != expected[1] {
+		t.Errorf("expected '%v', got '%v'", expected, req.Messages)
+	}
+
+	if !strings.HasSuffix(req.Prompt, "Captain:") {
+		t.Errorf("expected the prompt to cue the persona, got '%s'", req.Prompt)
+	}
+
+	srv.Post(3, user, "/dump", reply)
+	dump := waitForSent(t, srv, 4)
+	if !strings.Contains(dump.Text, "Thread Persona:") || !strings.Contains(dump.Text, "@pirate") {
+		t.Errorf("expected the dump to show the persona, got '%s'", dump.Text)
+	}
+
+	srv.Post(3, user, "/persona none", reply)
+	switched := waitForSent(t, srv, 5)
+	if expected := "This thread no longer has a persona."; switched.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, switched.Text)
+	}
+
+	srv.Post(3, user, "Do you speak French?", reply)
+	waitForSent(t, srv, 6)
+	if req := provider.Requests[1]; req.Messages[0].Role == completion.RoleSystem {
+		t.Errorf("expected the persona to be gone, got '%v'", req.Messages)
+	}
+}
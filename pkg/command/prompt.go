@@ -1,43 +1,217 @@
 package command
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/summary"
 	"telegram-bot/pkg/thread"
-
-	"github.com/PullRequestInc/go-gpt3"
+	"telegram-bot/pkg/tokens"
+	"telegram-bot/pkg/usage"
 )
 
 type Prompt struct{}
 
 func (Prompt) Exec(ctx Context, msg *thread.Message) error {
+	return answer(ctx, msg, msg)
+}
+
+// answer replies to prompt with the completion of the conversation leading up
+// to it. The tokens of the answer, and of the summary the thread may need
+// first, are charged to the quota of the sender of msg, the command asking for
+// the answer.
+func answer(ctx Context, msg *thread.Message, prompt *thread.Message) error {
 	stopTokens := []string{}
-	currentThread, err := ctx.Threads.GetThread(msg.ThreadID)
+	currentThread, err := ctx.Threads.GetThread(prompt.ThreadID)
 	if err != nil {
 		return fmt.Errorf("get thread: %w", err)
 	}
 
-	prompts := msg.History()
-	bot := thread.User(ctx.Telegram.Self)
-	prompts = append(prompts, bot.DisplayName()+":")
-	prompt := strings.Join(prompts, "\n\n")
-	resp, err := ctx.GPT3.CompletionWithEngine(ctx.Context, currentThread.Settings.Model, gpt3.CompletionRequest{
-		Prompt:           []string{prompt},
-		MaxTokens:        &currentThread.Settings.MaxTokens,
-		Temperature:      &currentThread.Settings.Temperature,
+	budget := tokens.Budget(currentThread.Settings.Model, currentThread.Settings.MaxTokens)
+	if budget <= tokens.Count(nil) {
+		return NewError(KindUser, "MaxTokens leaves no room for the conversation in this model's context, lower it with /tweak.", ErrNoContextBudget)
+	}
+
+	if err := ctx.Runner.checkQuota(msg); err != nil {
+		return err
+	}
+
+	turns := currentThread.Turns(prompt)
+	updated, used, err := ctx.Summarizer.Summarize(ctx.Context, &currentThread, turns)
+	if err != nil {
+		log.Printf("failed to summarize thread %s: %s", currentThread.ID, err)
+	}
+
+	if used > 0 {
+		ctx.Runner.chargeQuota(msg, used)
+	}
+
+	if updated {
+		if err := ctx.Threads.Set(currentThread); err != nil {
+			log.Printf("failed to save thread summary: %s", err)
+		}
+	}
+
+	turns, _, err = PromptTurns(currentThread, turns, budget)
+	if err != nil {
+		return NewError(KindUser, "The persona, language and summary of this thread leave no room for the conversation in this model's context, lower MaxTokens with /tweak or pick a shorter persona.", err)
+	}
+
+	bot := thread.User(ctx.Self)
+	botName := bot.DisplayName()
+	if p := currentThread.Persona; p != nil && p.DisplayName != "" {
+		botName = p.DisplayName
+	}
+
+	req := completion.Request{
+		Model:            currentThread.Settings.Model,
+		Prompt:           FlattenTurns(turns, botName),
+		Messages:         ChatMessages(turns),
+		MaxTokens:        currentThread.Settings.MaxTokens,
+		Temperature:      currentThread.Settings.Temperature,
 		FrequencyPenalty: currentThread.Settings.FrequencyPenalty,
 		PresencePenalty:  currentThread.Settings.PressencePenalty,
-		TopP:             &currentThread.Settings.TopP,
+		TopP:             currentThread.Settings.TopP,
 		Stop:             stopTokens,
+	}
+
+	resp, err := complete(ctx, prompt, req)
+	if resp.Text != "" {
+		ctx.Runner.chargeQuota(msg, usage.Of(req, resp).TotalTokens)
+	}
+
+	// The thread was evicted while the completion ran, the answer is shown
+	// but nothing can follow it.
+	if errors.Is(err, thread.ErrThreadExpired) {
+		return NewError(KindUser, ExpiredThreadReply, err)
+	}
+
+	return err
+}
+
+// complete sends req to the provider and replies with the response, streamed
+// into the reply when the provider supports it. The response is returned even
+// when replying fails, its tokens have been used either way.
+func complete(ctx Context, msg *thread.Message, req completion.Request) (completion.Response, error) {
+	if streamer, ok := ctx.Completions.(completion.Streamer); ok && ctx.Runner.streaming {
+		return streamPrompt(ctx, msg, streamer, req)
+	}
+
+	resp, err := ctx.Completions.Complete(ctx.Context, req)
+	if err != nil {
+		return resp, fmt.Errorf("complete prompt: %w", err)
+	}
+
+	return resp, ctx.Runner.Reply(msg, resp.Text, thread.TypeResponse)
+}
+
+func streamPrompt(ctx Context, msg *thread.Message, streamer completion.Streamer, req completion.Request) (completion.Response, error) {
+	reply, err := ctx.Runner.StartReply(msg)
+	if err != nil {
+		return completion.Response{}, err
+	}
+
+	var text strings.Builder
+	resp, err := streamer.Stream(ctx.Context, req, func(delta string) {
+		text.WriteString(delta)
+		reply.Update(text.String())
 	})
 	if err != nil {
-		return fmt.Errorf("call gpt3 api: %w", err)
+		// The placeholder is already sent, it shows the error instead of a
+		// new reply.
+		err = fmt.Errorf("stream prompt: %w", err)
+		if finishErr := reply.Finish(ErrorReply(err, ctx.CorrelationID), thread.TypeInformational); finishErr != nil {
+			return resp, err
+		}
+
+		return resp, reportedError{err}
 	}
 
-	ctx.Runner.Reply(msg, resp.Choices[0].Text, thread.TypeResponse)
-	return nil
+	return resp, reply.Finish(resp.Text, thread.TypeResponse)
 }
 
-func (Prompt) IsReplyOnly() bool {
-	return false
+// PromptTurns returns the conversation sent to continue turns of t. The
+// instructions and the summary are always sent, only the turns following them
+// have to fit into what is left of budget. It reports whether older turns were
+// left out to make them fit. ErrNoConversationBudget is returned, along with
+// the instructions and summary alone, when they leave no room for the last
+// turn.
+func PromptTurns(t thread.Thread, turns []thread.Turn, budget int) ([]thread.Turn, bool, error) {
+	head, rest := summary.Split(t.Summary, turns)
+	head = append(SystemTurns(t), head...)
+	room := budget - tokens.Count(head) + tokens.Count(nil)
+	if len(rest) > 0 {
+		last := rest[len(rest)-1]
+		last.Content = ""
+		if room <= tokens.Count([]thread.Turn{last}) {
+			return head, true, fmt.Errorf("%d tokens of instructions for a budget of %d: %w", tokens.Count(head), budget, ErrNoConversationBudget)
+		}
+	}
+
+	kept, _ := tokens.Fit(rest, room)
+	return append(head, kept...), len(kept) < len(rest), nil
+}
+
+// SystemTurns returns the instructions put ahead of the conversation of t:
+// the system prompt of its persona and the language to reply in.
+func SystemTurns(t thread.Thread) []thread.Turn {
+	turns := []thread.Turn{}
+	if p := t.Persona; p != nil && p.SystemPrompt != "" {
+		turns = append(turns, thread.Turn{Role: thread.RoleSystem, Content: p.SystemPrompt})
+	}
+
+	if t.Language != "" {
+		turns = append(turns, thread.Turn{Role: thread.RoleSystem, Content: fmt.Sprintf("Always reply in %s.", t.Language)})
+	}
+
+	return turns
+}
+
+var (
+	ErrNoContextBudget      error = errors.New("no context left for the prompt")
+	ErrNoConversationBudget error = errors.New("no context left for the conversation")
+)
+
+// FlattenTurns renders a conversation as a completion prompt, one
+// "Name: text" paragraph per turn, ending with a cue for the bot to reply.
+func FlattenTurns(turns []thread.Turn, botName string) string {
+	prompts := make([]string, 0, len(turns)+1)
+	for _, t := range turns {
+		switch t.Role {
+		case thread.RoleSystem:
+			prompts = append(prompts, t.Content)
+		case thread.RoleAssistant:
+			prompts = append(prompts, fmt.Sprintf("%s: %s", botName, t.Content))
+		default:
+			prompts = append(prompts, fmt.Sprintf("%s: %s", t.Name, t.Content))
+		}
+	}
+
+	prompts = append(prompts, botName+":")
+	return strings.Join(prompts, "\n\n")
+}
+
+func ChatMessages(turns []thread.Turn) []completion.Message {
+	messages := make([]completion.Message, 0, len(turns))
+	for _, t := range turns {
+		messages = append(messages, completion.Message{
+			Role:    completion.Role(t.Role),
+			Name:    t.Name,
+			Content: t.Content,
+		})
+	}
+
+	return messages
+}
+
+func (Prompt) Spec() Spec {
+	return Spec{
+		Name:    "prompt",
+		Aliases: []string{"ask"},
+		Summary: "Start a new thread with a prompt",
+		Usage:   "Sends the prompt to the language model and replies with its answer. Reply to any message of the thread to continue the conversation.",
+		Args:    []Arg{{Name: "text", Description: "The prompt starting the conversation"}},
+	}
 }
@@ -0,0 +1,218 @@
+package command
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"telegram-bot/pkg/quota"
+	"telegram-bot/pkg/thread"
+	"time"
+)
+
+const (
+	DefaultUserRate string = "10/1m"
+	DefaultChatRate string = "30/1m"
+)
+
+var ErrTooFast = errors.New("too many commands")
+
+// LimitersFromEnv creates the rate limiters of users and chats from
+// RATE_LIMIT_USER and RATE_LIMIT_CHAT.
+func LimitersFromEnv() (user *quota.Limiter, chat *quota.Limiter, err error) {
+	rates := []struct {
+		name     string
+		fallback string
+		limiter  **quota.Limiter
+	}{
+		{"RATE_LIMIT_USER", DefaultUserRate, &user},
+		{"RATE_LIMIT_CHAT", DefaultChatRate, &chat},
+	}
+
+	for _, r := range rates {
+		val := os.Getenv(r.name)
+		if val == "" {
+			val = r.fallback
+		}
+
+		rate, err := quota.ParseRate(val)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse %s: %w", r.name, err)
+		}
+
+		*r.limiter = quota.NewLimiter(rate)
+	}
+
+	return user, chat, nil
+}
+
+// QuotasFromEnv reads the daily and monthly token quotas of users and chats,
+// quotas that aren't set are unlimited. The tokens already used only count
+// again after a restart when threads are stored durably.
+func QuotasFromEnv(st Storage) (*quota.Quotas, error) {
+	var user, chat quota.Limits
+	ints := map[string]*int{
+		"QUOTA_USER_DAILY":   &user.Daily,
+		"QUOTA_USER_MONTHLY": &user.Monthly,
+		"QUOTA_CHAT_DAILY":   &chat.Daily,
+		"QUOTA_CHAT_MONTHLY": &chat.Monthly,
+	}
+
+	for name, field := range ints {
+		val := os.Getenv(name)
+		if val == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+
+		if n < 0 {
+			return nil, fmt.Errorf("%s must not be negative", name)
+		}
+
+		*field = n
+	}
+
+	store, err := openStore[quota.Store](st, ".quota", quota.NewMemoryStore(),
+		func(path string) (quota.Store, error) {
+			s, err := quota.OpenFileStore(path)
+			return s, err
+		},
+		func(db *sql.DB) (quota.Store, error) {
+			s, err := quota.NewSQLStore(db)
+			return s, err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return quota.New(store, user, chat), nil
+}
+
+// RateLimit stops users and chats sending a command faster than their rate
+// allows, every command has its own buckets.
+func RateLimit(next Handler) Handler {
+	return wrap(next, func(ctx Context, msg *thread.Message) error {
+		name := next.Spec().Name
+		limits := []struct {
+			limiter *quota.Limiter
+			key     string
+			who     string
+		}{
+			{ctx.Runner.userLimiter, fmt.Sprintf("%d:%s", msg.ID.FromID, name), "You're"},
+			{ctx.Runner.chatLimiter, fmt.Sprintf("%d:%s", msg.ID.ChannelID, name), "This chat is"},
+		}
+
+		for _, l := range limits {
+			if l.limiter == nil {
+				continue
+			}
+
+			if ok, wait := l.limiter.Allow(l.key); !ok {
+				text := fmt.Sprintf("%s sending /%s too fast, try again in %s.", l.who, name, roundUp(wait, time.Second))
+				return NewError(KindRateLimited, text, ErrTooFast)
+			}
+		}
+
+		return next.Exec(ctx, msg)
+	})
+}
+
+// roundUp rounds d up to a multiple of m, so waiting that long is enough.
+func roundUp(d time.Duration, m time.Duration) time.Duration {
+	if r := d % m; r != 0 {
+		return d + m - r
+	}
+
+	return d
+}
+
+// checkQuota returns an error telling the sender of msg when their quota, or
+// the one of the chat, resets if it is used up.
+func (r *CommandRunner) checkQuota(msg *thread.Message) error {
+	if r.quotas == nil {
+		return nil
+	}
+
+	err := r.quotas.Check(msg.ID.ChannelID, msg.ID.FromID)
+	var exceeded *quota.ExceededError
+	if !errors.As(err, &exceeded) {
+		return err
+	}
+
+	whose := "your"
+	if exceeded.Subject == quota.SubjectChat {
+		whose = "this chat's"
+	}
+
+	text := fmt.Sprintf("You've used up %s %s quota of %d tokens, it resets in %s.", whose, exceeded.Period, exceeded.Limit, roundUp(time.Until(exceeded.Resets), time.Minute))
+	return NewError(KindRateLimited, text, err)
+}
+
+// chargeQuota counts tokens against the quotas of the sender of msg and the
+// chat.
+func (r *CommandRunner) chargeQuota(msg *thread.Message, tokens int) {
+	if r.quotas == nil {
+		return
+	}
+
+	if err := r.quotas.Add(msg.ID.ChannelID, msg.ID.FromID, tokens); err != nil {
+		log.Printf("failed to charge %d tokens to the quota of %d: %s", tokens, msg.ID.FromID, err)
+	}
+}
+
+type Quota struct{}
+
+func (Quota) Exec(ctx Context, msg *thread.Message) error {
+	if ctx.Runner.quotas == nil {
+		ctx.Runner.Reply(msg, "There are no token quotas.", thread.TypeInformational)
+		return nil
+	}
+
+	report, err := ctx.Runner.quotas.Report(msg.ID.ChannelID, msg.ID.FromID)
+	if err != nil {
+		return fmt.Errorf("report quotas: %w", err)
+	}
+
+	ctx.Runner.Reply(msg, BuildQuotaReport(report), thread.TypeInformational)
+	return nil
+}
+
+// BuildQuotaReport describes the tokens used and left of every quota.
+func BuildQuotaReport(report []quota.Status) string {
+	var b strings.Builder
+	b.WriteString("```\n")
+	for i, s := range report {
+		if i == 0 || report[i-1].Subject != s.Subject {
+			if s.Subject == quota.SubjectUser {
+				b.WriteString("Your tokens:\n")
+			} else {
+				b.WriteString("\nThis chat's tokens:\n")
+			}
+		}
+
+		left := "unlimited"
+		if s.Remaining() >= 0 {
+			left = fmt.Sprintf("%d of %d left, resets %s", s.Remaining(), s.Limit, s.Resets.Format("2006-01-02 15:04 MST"))
+		}
+
+		b.WriteString(fmt.Sprintf("  %-8s %d used, %s\n", s.Period+":", s.Used, left))
+	}
+
+	b.WriteString("```\n")
+	return b.String()
+}
+
+func (Quota) Spec() Spec {
+	return Spec{
+		Name:    "quota",
+		Summary: "Show the tokens you and the chat used and have left",
+		Usage:   "Shows the tokens used today and this month by you and, in group chats, by the whole chat, along with what is left of the quotas and when they reset.",
+	}
+}
@@ -0,0 +1,95 @@
+package command
+
+import (
+	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/quota"
+	"telegram-bot/pkg/summary"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestRateLimit(t *testing.T) {
+	ctx, srv := newTestContext(t, completion.NewFake())
+	ctx.Runner.userLimiter = quota.NewLimiter(quota.Rate{Burst: 1, Per: time.Hour})
+	runTestRunner(t, ctx.Runner)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/echo one", nil)
+	srv.Post(3, user, "/echo two", nil)
+	srv.Post(3, user, "/help", nil)
+	waitForSent(t, srv, 3)
+
+	sent := srv.Sent()
+	if sent[0] != "one" {
+		t.Errorf("expected the first echo to be sent, got '%s'", sent[0])
+	}
+
+	if expected := "You're sending /echo too fast, try again in 1h0m0s."; sent[1] != expected {
+		t.Errorf("expected '%s', got '%s'", expected, sent[1])
+	}
+
+	if strings.Contains(sent[2], "too fast") {
+		t.Errorf("expected every command to have its own bucket, got '%s'", sent[2])
+	}
+}
+
+func TestQuota(t *testing.T) {
+	provider := &completion.Fake{Steps: []completion.Step{
+		{Response: completion.Response{Text: "Hi there", Usage: completion.Usage{TotalTokens: 7}}},
+	}}
+	ctx, srv := newTestContext(t, provider)
+	ctx.Runner.quotas = quota.New(quota.NewMemoryStore(), quota.Limits{Daily: 5}, quota.Limits{})
+	runTestRunner(t, ctx.Runner)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	srv.Post(3, user, "/prompt Hello again", nil)
+	srv.Post(3, user, "/quota", nil)
+	report := waitForSent(t, srv, 3)
+
+	sent := srv.Sent()
+	if !strings.HasPrefix(sent[1], "You've used up your daily quota of 5 tokens, it resets in ") {
+		t.Errorf("expected the quota to be used up, got '%s'", sent[1])
+	}
+
+	if len(provider.Requests) != 1 {
+		t.Errorf("expected a single completion, got '%v'", provider.Requests)
+	}
+
+	for _, expected := range []string{"Your tokens:", "daily:   7 used, 0 of 5 left", "monthly: 7 used, unlimited", "This chat's tokens:"} {
+		if !strings.Contains(report.Text, expected) {
+			t.Errorf("expected the report to contain '%s', got '%s'", expected, report.Text)
+		}
+	}
+}
+
+func TestQuota_ChargesSummaries(t *testing.T) {
+	provider := &completion.Fake{Steps: []completion.Step{
+		{Response: completion.Response{Text: "Hi there", Usage: completion.Usage{TotalTokens: 7}}},
+		{Response: completion.Response{Text: "Foo said hello", Usage: completion.Usage{TotalTokens: 11}}},
+		{Response: completion.Response{Text: "Sure", Usage: completion.Usage{TotalTokens: 13}}},
+	}}
+	ctx, srv := newTestContext(t, provider)
+	ctx.Runner.quotas = quota.New(quota.NewMemoryStore(), quota.Limits{}, quota.Limits{})
+	ctx.Runner.summarizer = &summary.Summarizer{Provider: provider, Threshold: 2, Keep: 1}
+	runTestRunner(t, ctx.Runner)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(3, user, "/prompt Hello", nil)
+	reply := waitForSent(t, srv, 1)
+	srv.Post(3, user, "Tell me more", reply)
+	waitForSent(t, srv, 2)
+	srv.Post(3, user, "/quota", nil)
+	report := waitForSent(t, srv, 3)
+
+	if len(provider.Requests) != 3 {
+		t.Fatalf("expected two answers and a summary, got '%v'", provider.Requests)
+	}
+
+	if expected := "daily:   31 used"; !strings.Contains(report.Text, expected) {
+		t.Errorf("expected the report to contain '%s', got '%s'", expected, report.Text)
+	}
+}
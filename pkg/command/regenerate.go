@@ -0,0 +1,239 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"telegram-bot/pkg/chunk"
+	"telegram-bot/pkg/thread"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// AlternativePrefix starts the data of the buttons switching between the
+// alternative responses to a prompt, followed by the index of the one to show.
+const AlternativePrefix string = "alt:"
+
+var (
+	ErrNotAResponse    = errors.New("not a response")
+	ErrUnknownCallback = errors.New("unknown callback")
+)
+
+type Regenerate struct{}
+
+func (Regenerate) Exec(ctx Context, msg *thread.Message) error {
+	target := msg.Parent()
+	if target == nil || target.Type != thread.TypeResponse {
+		return NewError(KindUser, "Reply with /regenerate to one of my answers.", ErrNotAResponse)
+	}
+
+	prompt := target.ResponseStart().Parent()
+	if prompt == nil {
+		return NewError(KindUser, "Reply with /regenerate to one of my answers.", ErrNotAResponse)
+	}
+
+	if err := answer(ctx, msg, prompt); err != nil {
+		return err
+	}
+
+	return ctx.Runner.showAlternatives(prompt.ID)
+}
+
+// showAlternatives adds the buttons switching between them to every response
+// to the prompt, once there is more than one.
+func (r *CommandRunner) showAlternatives(promptID thread.MessageID) error {
+	prompt, err := r.repo.GetMessage(promptID)
+	if err != nil {
+		return fmt.Errorf("get prompt: %w", err)
+	}
+
+	t, err := r.repo.GetThread(prompt.ThreadID)
+	if err != nil {
+		return fmt.Errorf("get thread: %w", err)
+	}
+
+	var responses []*thread.Message
+	for _, c := range prompt.Children() {
+		if c.Type == thread.TypeResponse {
+			responses = append(responses, c)
+		}
+	}
+
+	if len(responses) < 2 {
+		return nil
+	}
+
+	for _, m := range responses {
+		shown := shownAlternative(t, m)
+		edit := telegram.NewEditMessageReplyMarkup(m.ID.ChannelID, m.ID.MessageID, AlternativesKeyboard(shown, len(responses)))
+		if _, err := r.telegramClient.Request(edit); err != nil {
+			return fmt.Errorf("add alternatives keyboard: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// shownAlternative returns the index of the alternative the response m shows.
+func shownAlternative(t thread.Thread, m *thread.Message) int {
+	alternatives := m.Alternatives()
+	shown := m.ID
+	if branch, ok := t.Selected[m.ID.MessageID]; ok {
+		shown = branch
+	}
+
+	for i, alt := range alternatives {
+		if alt.ID == shown || alt.ResponseEnd().ID == shown {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// AlternativesKeyboard returns the "◀ 2/3 ▶" buttons of a response showing
+// the alternative at index shown out of count.
+func AlternativesKeyboard(shown int, count int) telegram.InlineKeyboardMarkup {
+	button := func(text string, index int) telegram.InlineKeyboardButton {
+		return telegram.NewInlineKeyboardButtonData(text, AlternativePrefix+strconv.Itoa(index))
+	}
+
+	return telegram.NewInlineKeyboardMarkup(telegram.NewInlineKeyboardRow(
+		button("◀", (shown+count-1)%count),
+		button(fmt.Sprintf("%d/%d", shown+1, count), shown),
+		button("▶", (shown+1)%count),
+	))
+}
+
+// handleCallback answers a button being pressed. The answer is sent even when
+// handling fails, so the client stops waiting for it.
+func (r *CommandRunner) handleCallback(query *telegram.CallbackQuery) {
+	text := ""
+	if err := r.showAlternative(query); err != nil {
+		log.Printf("failed to handle callback '%s': %s", query.Data, err)
+		var e *Error
+		if errors.As(err, &e) {
+			text = e.Message
+		}
+	}
+
+	if _, err := r.telegramClient.Request(telegram.NewCallback(query.ID, text)); err != nil {
+		log.Printf("failed to answer callback: %s", err)
+	}
+}
+
+// showAlternative edits the response the query came from to show the
+// alternative it asks for, replies to the response continue from it.
+func (r *CommandRunner) showAlternative(query *telegram.CallbackQuery) error {
+	if query.Message == nil || !strings.HasPrefix(query.Data, AlternativePrefix) {
+		return fmt.Errorf("'%s': %w", query.Data, ErrUnknownCallback)
+	}
+
+	index, err := strconv.Atoi(strings.TrimPrefix(query.Data, AlternativePrefix))
+	if err != nil {
+		return fmt.Errorf("'%s': %w", query.Data, ErrUnknownCallback)
+	}
+
+	source := &telegram.Message{From: query.From, Chat: query.Message.Chat}
+	if err := r.authorize(Regenerate{}.Spec(), source); err != nil {
+		return err
+	}
+
+	msg, err := r.repo.GetMessage(thread.GetMessageID(query.Message))
+	if err != nil {
+		return NewError(KindUser, "I no longer have the history of this thread.", err)
+	}
+
+	t, err := r.repo.GetThread(msg.ThreadID)
+	if err != nil {
+		return fmt.Errorf("get thread: %w", err)
+	}
+
+	alternatives := msg.Alternatives()
+	if index < 0 || index >= len(alternatives) {
+		return fmt.Errorf("alternative %d of %d: %w", index, len(alternatives), ErrUnknownCallback)
+	}
+
+	if index == shownAlternative(t, msg) {
+		return nil
+	}
+
+	alt := alternatives[index]
+	edit := telegram.NewEditMessageTextAndMarkup(msg.ID.ChannelID, msg.ID.MessageID, alternativeText(alt), AlternativesKeyboard(index, len(alternatives)))
+	if _, err := r.telegramClient.Send(edit); err != nil {
+		return fmt.Errorf("edit response: %w", err)
+	}
+
+	branch := alt.ResponseEnd().ID
+	if alt == msg {
+		branch = msg.ID
+	}
+
+	t.Select(msg.ID, branch)
+	if err := r.repo.Set(t); err != nil {
+		return fmt.Errorf("save selected alternative: %w", err)
+	}
+
+	return nil
+}
+
+// TruncatedNote ends an alternative that was sent in several messages, the
+// response switching to it only shows as much as fits in one.
+const TruncatedNote string = "\n\n[Truncated to fit one message, replies continue from the whole answer.]"
+
+// alternativeText returns the text of alt as the response switching to it
+// shows it, marked as truncated when it doesn't fit.
+func alternativeText(alt *thread.Message) string {
+	text := alt.ResponseText()
+	if len(chunk.Split(text, chunk.MaxMessageLength)) == 1 {
+		return text
+	}
+
+	return chunk.Split(text, chunk.MaxMessageLength-len(TruncatedNote))[0] + TruncatedNote
+}
+
+// continuedMessage points a reply to a response at the end of the answer it
+// belongs to: the end of the alternative shown, or the last message of an
+// answer too long for one message. The conversation then continues from
+// everything that was shown.
+func (r *CommandRunner) continuedMessage(source *telegram.Message) *telegram.Message {
+	if source.ReplyToMessage == nil {
+		return source
+	}
+
+	id := thread.GetMessageID(source.ReplyToMessage)
+	msg, err := r.repo.GetMessage(id)
+	if err != nil {
+		return source
+	}
+
+	t, err := r.repo.GetThread(msg.ThreadID)
+	if err != nil {
+		log.Printf("failed to get thread %s: %s", msg.ThreadID, err)
+		return source
+	}
+
+	branch, ok := t.Selected[id.MessageID]
+	if !ok && msg.Type == thread.TypeResponse {
+		branch, ok = msg.ResponseStart().ResponseEnd().ID, true
+	}
+
+	if !ok || branch == id {
+		return source
+	}
+
+	redirected := *source
+	redirected.ReplyToMessage = replyTarget(&thread.Message{ID: branch})
+	return &redirected
+}
+
+func (Regenerate) Spec() Spec {
+	return Spec{
+		Name:      "regenerate",
+		Summary:   "Answer the prompt of a response again",
+		Usage:     "Reply with /regenerate to one of my answers to get another answer to the same prompt, from the same history. The answers get ◀ ▶ buttons to switch between them, replies continue from the answer shown.",
+		ReplyOnly: true,
+	}
+}
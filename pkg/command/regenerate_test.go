@@ -0,0 +1,228 @@
+package command
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"telegram-bot/pkg/chunk"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/thread"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestAlternativesKeyboard(t *testing.T) {
+	cases := []struct {
+		desc     string
+		shown    int
+		count    int
+		expected []string
+	}{
+		{
+			desc:     "points the arrows at the neighbours",
+			shown:    1,
+			count:    3,
+			expected: []string{"◀", "alt:0", "2/3", "alt:1", "▶", "alt:2"},
+		},
+		{
+			desc:     "wraps around at the ends",
+			shown:    0,
+			count:    2,
+			expected: []string{"◀", "alt:1", "1/2", "alt:0", "▶", "alt:1"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result := []string{}
+			for _, button := range AlternativesKeyboard(tc.shown, tc.count).InlineKeyboard[0] {
+				result = append(result, button.Text, *button.CallbackData)
+			}
+
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	provider := completion.NewFake("First", "Second", "Go on")
+	runner, srv := startTestRunner(t, provider)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	prompt := srv.Post(-3, user, "/prompt Hello", nil)
+	first := waitForSent(t, srv, 1)
+	srv.Post(-3, user, "/regenerate", first)
+	second := waitForSent(t, srv, 2)
+	if second.Text != "Second" || second.ReplyToMessage == nil || second.ReplyToMessage.MessageID != prompt.MessageID {
+		t.Errorf("expected 'Second' replying to the prompt, got '%v'", second)
+	}
+
+	markups, err := srv.WaitFor("editMessageReplyMarkup", 2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected both answers to get buttons: %v", err)
+	}
+
+	for i, expected := range []int{first.MessageID, second.MessageID} {
+		if id := markups[i].Params.Get("message_id"); id != strconv.Itoa(expected) {
+			t.Errorf("expected '%d', got '%s'", expected, id)
+		}
+	}
+
+	srv.Press(-3, user, second.MessageID, "alt:0")
+	edits, err := srv.WaitFor("editMessageText", 1, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the answer to be edited: %v", err)
+	}
+
+	if text := edits[0].Params.Get("text"); text != "First" {
+		t.Errorf("expected '%s', got '%s'", "First", text)
+	}
+
+	if _, err := srv.WaitFor("answerCallbackQuery", 1, 5*time.Second); err != nil {
+		t.Errorf("expected the button press to be answered: %v", err)
+	}
+
+	reply := srv.Post(-3, user, "And then?", second)
+	waitForSent(t, srv, 3)
+	expected := []completion.Message{
+		{Role: completion.RoleUser, Name: "Foo", Content: "Hello"},
+		{Role: completion.RoleAssistant, Content: "First"},
+		{Role: completion.RoleUser, Name: "Foo", Content: "And then?"},
+	}
+	if messages := provider.Requests[2].Messages; !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, messages)
+	}
+
+	msg, err := runner.repo.GetMessage(thread.GetMessageID(&reply))
+	if err != nil {
+		t.Fatalf("unexpected error getting reply: %v", err)
+	}
+
+	if parent := msg.Parent(); parent == nil || parent.ID.MessageID != first.MessageID {
+		t.Errorf("expected the reply to continue from the first answer, got '%v'", parent)
+	}
+}
+
+func TestRegenerate_LongAlternative(t *testing.T) {
+	long := strings.Repeat("All work and no play. ", 300)
+	provider := completion.NewFake(long, "Short")
+	_, srv := startTestRunner(t, provider)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(-3, user, "/prompt Hello", nil)
+	first := waitForSent(t, srv, 1)
+	waitForSent(t, srv, 2)
+	srv.Post(-3, user, "/regenerate", first)
+	second := waitForSent(t, srv, 3)
+	if _, err := srv.WaitFor("editMessageReplyMarkup", 2, 5*time.Second); err != nil {
+		t.Fatalf("expected both answers to get buttons: %v", err)
+	}
+
+	srv.Press(-3, user, second.MessageID, "alt:0")
+	edits, err := srv.WaitFor("editMessageText", 1, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the answer to be edited: %v", err)
+	}
+
+	text := edits[0].Params.Get("text")
+	if !strings.HasSuffix(text, TruncatedNote) || len(text) > chunk.MaxMessageLength {
+		t.Errorf("expected the alternative to be marked as truncated within one message, got %d characters ending in '%s'", len(text), text[len(text)-80:])
+	}
+
+	if !strings.HasPrefix(long, strings.TrimSuffix(text, TruncatedNote)) {
+		t.Errorf("expected the start of the alternative, got '%s'", text)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	provider := completion.NewFake("First", "Second", "Third")
+	runner, srv := startTestRunner(t, provider)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(-3, user, "/prompt Hello", nil)
+	first := waitForSent(t, srv, 1)
+	srv.Post(-3, user, "/undo", first)
+	denied := waitForSent(t, srv, 2)
+	if expected := "The first exchange started this thread and can't be undone, start a new one with /prompt instead."; denied.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, denied.Text)
+	}
+
+	more := srv.Post(-3, user, "Tell me more", first)
+	second := waitForSent(t, srv, 3)
+	srv.Post(-3, user, "/undo", second)
+	undone := waitForSent(t, srv, 4)
+	if undone.ReplyToMessage == nil || undone.ReplyToMessage.MessageID != first.MessageID {
+		t.Errorf("expected the confirmation to reply to the first answer, got '%v'", undone)
+	}
+
+	if _, err := runner.repo.GetMessage(thread.GetMessageID(&more)); !errors.Is(err, thread.ErrNotFound) {
+		t.Errorf("expected error '%v', got '%v'", thread.ErrNotFound, err)
+	}
+
+	srv.Post(-3, user, "Something else", first)
+	waitForSent(t, srv, 5)
+	expected := []completion.Message{
+		{Role: completion.RoleUser, Name: "Foo", Content: "Hello"},
+		{Role: completion.RoleAssistant, Content: "First"},
+		{Role: completion.RoleUser, Name: "Foo", Content: "Something else"},
+	}
+	if messages := provider.Requests[2].Messages; !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, messages)
+	}
+}
+
+func TestUndo_Alternatives(t *testing.T) {
+	provider := completion.NewFake("First", "Second", "Third", "Fourth")
+	runner, srv := startTestRunner(t, provider)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(-3, user, "/prompt Hello", nil)
+	first := waitForSent(t, srv, 1)
+	srv.Post(-3, user, "Tell me more", first)
+	second := waitForSent(t, srv, 2)
+	srv.Post(-3, user, "/regenerate", second)
+	third := waitForSent(t, srv, 3)
+	if _, err := srv.WaitFor("editMessageReplyMarkup", 2, 5*time.Second); err != nil {
+		t.Fatalf("expected both answers to get buttons: %v", err)
+	}
+
+	srv.Press(-3, user, third.MessageID, "alt:0")
+	if _, err := srv.WaitFor("editMessageText", 1, 5*time.Second); err != nil {
+		t.Fatalf("expected the answer to be edited: %v", err)
+	}
+
+	srv.Post(-3, user, "/undo", third)
+	waitForSent(t, srv, 4)
+	srv.Post(-3, user, "Go on", third)
+	if undone := waitForSent(t, srv, 5); undone.Text != UndoneReply {
+		t.Errorf("expected '%s', got '%s'", UndoneReply, undone.Text)
+	}
+
+	root, err := runner.repo.GetMessage(thread.GetMessageID(first))
+	if err != nil {
+		t.Fatalf("unexpected error getting the first answer: %v", err)
+	}
+
+	if th, _ := runner.repo.GetThread(root.ThreadID); len(th.Selected) != 0 {
+		t.Errorf("expected the undone alternatives to be deselected, got '%v'", th.Selected)
+	}
+
+	srv.Post(-3, user, "Something else", first)
+	if answer := waitForSent(t, srv, 6); answer.Text != "Fourth" {
+		t.Errorf("expected the thread to continue, got '%s'", answer.Text)
+	}
+
+	expected := []completion.Message{
+		{Role: completion.RoleUser, Name: "Foo", Content: "Hello"},
+		{Role: completion.RoleAssistant, Content: "First"},
+		{Role: completion.RoleUser, Name: "Foo", Content: "Something else"},
+	}
+	if messages := provider.Requests[3].Messages; !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, messages)
+	}
+}
@@ -0,0 +1,333 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"telegram-bot/pkg/acl"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ChatScope is a kind of chat commands can be offered in.
+type ChatScope string
+
+const (
+	ScopePrivate ChatScope = "private"
+	ScopeGroup   ChatScope = "group"
+)
+
+// AllScopes lists every scope, in the order commands are published.
+var AllScopes = []ChatScope{ScopePrivate, ScopeGroup}
+
+var (
+	ErrInvalidSpec      = errors.New("invalid command spec")
+	ErrDuplicateCommand = errors.New("duplicate command")
+	ErrMissingArgument  = errors.New("missing argument")
+)
+
+// CommandRegex matches the command names Telegram accepts.
+var CommandRegex = regexp.MustCompile("^[a-z0-9_]{1,32}$")
+
+// Arg describes an argument following a command.
+type Arg struct {
+	Name        string
+	Description string
+	Optional    bool
+}
+
+// Spec describes a command, it is what /help and the command menu shown by
+// Telegram are generated from.
+type Spec struct {
+	Name    string
+	Aliases []string
+	// Summary is a single line describing the command, between 3 and 256
+	// characters as required by Telegram.
+	Summary string
+	// Usage explains the command in detail for /help <command>.
+	Usage     string
+	Args      []Arg
+	ReplyOnly bool
+	// Role is the least role allowed to run the command when access control
+	// is on, acl.RoleUser when empty. Admins can override it at runtime.
+	Role acl.Role
+	// Scopes are the chats the command is available in, every chat when
+	// empty.
+	Scopes []ChatScope
+}
+
+// Synopsis shows how the command is called, e.g. "/help [command]".
+func (s Spec) Synopsis() string {
+	parts := []string{"/" + s.Name}
+	for _, a := range s.Args {
+		if a.Optional {
+			parts = append(parts, "["+a.Name+"]")
+		} else {
+			parts = append(parts, "<"+a.Name+">")
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// InScope reports whether the command is available in scope.
+func (s Spec) InScope(scope ChatScope) bool {
+	if len(s.Scopes) == 0 {
+		return true
+	}
+
+	for _, sc := range s.Scopes {
+		if sc == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks that args, the text following the command, holds the
+// required arguments.
+func (s Spec) Validate(args string) error {
+	if strings.TrimSpace(args) != "" {
+		return nil
+	}
+
+	for _, a := range s.Args {
+		if !a.Optional {
+			return fmt.Errorf("%s: %w", a.Name, ErrMissingArgument)
+		}
+	}
+
+	return nil
+}
+
+func (s Spec) validate() error {
+	for _, name := range append([]string{s.Name}, s.Aliases...) {
+		if !CommandRegex.MatchString(name) {
+			return fmt.Errorf("command name '%s': %w", name, ErrInvalidSpec)
+		}
+	}
+
+	if len(s.Summary) < 3 || len(s.Summary) > 256 {
+		return fmt.Errorf("summary of '%s' must be 3 to 256 characters: %w", s.Name, ErrInvalidSpec)
+	}
+
+	return nil
+}
+
+// ScopeOf returns the scope of chat.
+func ScopeOf(chat *telegram.Chat) ChatScope {
+	if chat != nil && chat.IsPrivate() {
+		return ScopePrivate
+	}
+
+	return ScopeGroup
+}
+
+// Registry holds the handlers of the commands the bot supports.
+type Registry struct {
+	handlers []Handler
+	byName   map[string]Handler
+	// middlewares run around every command, commandMiddlewares around the
+	// command they are keyed by.
+	middlewares        []Middleware
+	commandMiddlewares map[string][]Middleware
+}
+
+// NewRegistry checks the specs of handlers and registers them under their
+// names and aliases.
+func NewRegistry(handlers ...Handler) (*Registry, error) {
+	r := &Registry{byName: map[string]Handler{}, commandMiddlewares: map[string][]Middleware{}}
+	for _, h := range handlers {
+		spec := h.Spec()
+		if err := spec.validate(); err != nil {
+			return nil, err
+		}
+
+		for _, name := range append([]string{spec.Name}, spec.Aliases...) {
+			if _, ok := r.byName[name]; ok {
+				return nil, fmt.Errorf("'%s': %w", name, ErrDuplicateCommand)
+			}
+
+			r.byName[name] = h
+		}
+
+		r.handlers = append(r.handlers, h)
+	}
+
+	return r, nil
+}
+
+// DefaultRegistry registers every command the bot supports along with the
+// built-in middlewares.
+func DefaultRegistry() *Registry {
+	r, err := NewRegistry(
+		Prompt{},
+		Echo{},
+		Help{},
+		Dump{},
+		Summary{},
+		Tweak{},
+		Think{},
+		Regenerate{},
+		Undo{},
+		Fork{},
+		Export{},
+		Import{},
+		Persona{},
+		Settings{},
+		Quota{},
+		Usage{},
+		Grant{},
+		Revoke{},
+		Access{},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	r.Use(
+		HandleErrors,
+		Logging,
+		Recover,
+		RateLimit,
+		Timeout(CommandTimeout),
+		ChatActivity(telegram.ChatTyping),
+		ReplyOnly,
+		ValidateArgs,
+	)
+
+	return r
+}
+
+// Lookup finds the handler of a command by its name or one of its aliases.
+func (r *Registry) Lookup(name string) (Handler, bool) {
+	h, ok := r.byName[strings.ToLower(name)]
+	return h, ok
+}
+
+// Handlers returns the registered handlers in the order they were registered.
+func (r *Registry) Handlers() []Handler {
+	return r.handlers
+}
+
+// BotCommands lists the commands available in scope the way they are shown
+// in Telegram's command menu.
+func (r *Registry) BotCommands(scope ChatScope) []telegram.BotCommand {
+	commands := []telegram.BotCommand{}
+	for _, h := range r.handlers {
+		spec := h.Spec()
+		if spec.InScope(scope) {
+			commands = append(commands, telegram.BotCommand{Command: spec.Name, Description: spec.Summary})
+		}
+	}
+
+	return commands
+}
+
+func botCommandScope(scope ChatScope) telegram.BotCommandScope {
+	if scope == ScopePrivate {
+		return telegram.NewBotCommandScopeAllPrivateChats()
+	}
+
+	return telegram.NewBotCommandScopeAllGroupChats()
+}
+
+// PublishCommands replaces the command menu Telegram shows in every scope
+// with the registered commands.
+func (r *CommandRunner) PublishCommands() error {
+	for _, scope := range AllScopes {
+		config := telegram.NewSetMyCommandsWithScope(botCommandScope(scope), r.handlers.BotCommands(scope)...)
+		if _, err := r.telegramClient.Request(config); err != nil {
+			return fmt.Errorf("set %s commands: %w", scope, err)
+		}
+	}
+
+	return nil
+}
+
+// PrintHelp lists the commands available in scope.
+func PrintHelp(r *Registry, scope ChatScope) string {
+	var commands, replyOnly []Spec
+	width := 0
+	for _, h := range r.Handlers() {
+		spec := h.Spec()
+		if !spec.InScope(scope) {
+			continue
+		}
+
+		if len(spec.Synopsis()) > width {
+			width = len(spec.Synopsis())
+		}
+
+		if spec.ReplyOnly {
+			replyOnly = append(replyOnly, spec)
+		} else {
+			commands = append(commands, spec)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("```\n")
+	for _, group := range []struct {
+		title string
+		specs []Spec
+	}{{"Commands", commands}, {"Reply only commands", replyOnly}} {
+		if len(group.specs) == 0 {
+			continue
+		}
+
+		b.WriteString(group.title + ":\n")
+		for _, spec := range group.specs {
+			b.WriteString(fmt.Sprintf("  %-*s  %s\n", width, spec.Synopsis(), spec.Summary))
+		}
+
+		b.WriteString("\n")
+	}
+
+	b.WriteString("Send /help <command> to learn more about a command.\n")
+	b.WriteString("```\n")
+	return b.String()
+}
+
+// CommandHelp explains a single command.
+func CommandHelp(spec Spec) string {
+	var b strings.Builder
+	b.WriteString("```\n")
+	b.WriteString(spec.Synopsis() + "\n")
+	b.WriteString(spec.Summary + "\n")
+	if len(spec.Aliases) > 0 {
+		aliases := append([]string{}, spec.Aliases...)
+		sort.Strings(aliases)
+		b.WriteString("Aliases: /" + strings.Join(aliases, ", /") + "\n")
+	}
+
+	if len(spec.Args) > 0 {
+		b.WriteString("\nArguments:\n")
+		for _, a := range spec.Args {
+			optional := ""
+			if a.Optional {
+				optional = " (optional)"
+			}
+
+			b.WriteString(fmt.Sprintf("  %s%s: %s\n", a.Name, optional, a.Description))
+		}
+	}
+
+	if spec.Usage != "" {
+		b.WriteString("\n" + strings.TrimSpace(spec.Usage) + "\n")
+	}
+
+	if spec.ReplyOnly {
+		b.WriteString("\nOnly works as a reply to a message of a thread.\n")
+	}
+
+	if spec.Role == acl.RoleAdmin {
+		b.WriteString("\nRequires the admin role unless an admin changed it.\n")
+	}
+
+	b.WriteString("```\n")
+	return b.String()
+}
@@ -0,0 +1,173 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/thread"
+	"testing"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type specHandler Spec
+
+func (h specHandler) Exec(Context, *thread.Message) error {
+	return nil
+}
+
+func (h specHandler) Spec() Spec {
+	return Spec(h)
+}
+
+func TestNewRegistry(t *testing.T) {
+	cases := []struct {
+		desc        string
+		handlers    []Handler
+		expectedErr error
+	}{
+		{
+			desc: "registers names and aliases",
+			handlers: []Handler{
+				specHandler{Name: "foo", Aliases: []string{"f"}, Summary: "Does foo"},
+				specHandler{Name: "bar", Summary: "Does bar"},
+			},
+			expectedErr: nil,
+		},
+		{
+			desc: "rejects duplicate names",
+			handlers: []Handler{
+				specHandler{Name: "foo", Summary: "Does foo"},
+				specHandler{Name: "bar", Aliases: []string{"foo"}, Summary: "Does bar"},
+			},
+			expectedErr: ErrDuplicateCommand,
+		},
+		{
+			desc:        "rejects names Telegram doesn't accept",
+			handlers:    []Handler{specHandler{Name: "Foo-Bar", Summary: "Does foo"}},
+			expectedErr: ErrInvalidSpec,
+		},
+		{
+			desc:        "rejects missing summaries",
+			handlers:    []Handler{specHandler{Name: "foo"}},
+			expectedErr: ErrInvalidSpec,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := NewRegistry(tc.handlers...)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	r := DefaultRegistry()
+	for _, name := range []string{"prompt", "ask", "echo", "help", "start", "dump", "summary", "tweak", "think", "TWEAK"} {
+		if _, ok := r.Lookup(name); !ok {
+			t.Errorf("expected command '%s' to be registered", name)
+		}
+	}
+
+	help := PrintHelp(r, ScopeGroup)
+	for _, expected := range []string{"/prompt <text>", "/tweak <settings>", "/help [command]", "Reply only commands:"} {
+		if !strings.Contains(help, expected) {
+			t.Errorf("expected help to contain '%s', got '%s'", expected, help)
+		}
+	}
+
+	if strings.Contains(help, "/think") {
+		t.Errorf("expected private chat commands to be left out of group help, got '%s'", help)
+	}
+}
+
+func TestSpec_Validate(t *testing.T) {
+	spec := Spec{Name: "foo", Args: []Arg{{Name: "text"}, {Name: "more", Optional: true}}}
+	if err := spec.Validate("  "); !errors.Is(err, ErrMissingArgument) {
+		t.Errorf("expected missing argument, got '%v'", err)
+	}
+
+	if err := spec.Validate("some text"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if synopsis := spec.Synopsis(); synopsis != "/foo <text> [more]" {
+		t.Errorf("unexpected synopsis '%s'", synopsis)
+	}
+}
+
+func TestCommandRunner_PublishesCommands(t *testing.T) {
+	_, srv := startTestRunner(t, completion.NewFake())
+	srv.Post(3, telegram.User{ID: 2, FirstName: "Foo"}, "/echo started", nil)
+	waitForSent(t, srv, 1)
+
+	published := map[string][]string{}
+	for _, c := range srv.Calls("setMyCommands") {
+		var scope telegram.BotCommandScope
+		var commands []telegram.BotCommand
+		json.Unmarshal([]byte(c.Params.Get("scope")), &scope)
+		json.Unmarshal([]byte(c.Params.Get("commands")), &commands)
+		for _, command := range commands {
+			published[scope.Type] = append(published[scope.Type], command.Command)
+		}
+	}
+
+	expected := map[string][]string{
+		"all_private_chats": {"prompt", "echo", "help", "dump", "summary", "tweak", "think", "regenerate", "undo", "fork", "export", "import", "persona", "settings", "quota", "usage", "grant", "revoke", "access"},
+		"all_group_chats":   {"prompt", "echo", "help", "dump", "summary", "tweak", "regenerate", "undo", "fork", "export", "import", "persona", "settings", "quota", "usage", "grant", "revoke", "access"},
+	}
+
+	if !reflect.DeepEqual(published, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, published)
+	}
+}
+
+func TestCommandRunner_Help(t *testing.T) {
+	cases := []struct {
+		desc     string
+		text     string
+		expected string
+	}{
+		{
+			desc:     "lists the commands",
+			text:     "/help",
+			expected: "Send /help <command> to learn more about a command.",
+		},
+		{
+			desc:     "explains a command",
+			text:     "/help tweak",
+			expected: "MaxTokens:",
+		},
+		{
+			desc:     "explains aliases",
+			text:     "/help /ask",
+			expected: "Aliases: /ask",
+		},
+		{
+			desc:     "reports unknown commands",
+			text:     "/help nope",
+			expected: "I don't know the command /nope",
+		},
+		{
+			desc:     "shows the usage of commands missing arguments",
+			text:     "/prompt",
+			expected: "the correct syntax is /prompt <text>",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, srv := startTestRunner(t, completion.NewFake())
+			srv.Post(3, telegram.User{ID: 2, FirstName: "Foo"}, tc.text, nil)
+			reply := waitForSent(t, srv, 1)
+			if !strings.Contains(reply.Text, tc.expected) {
+				t.Errorf("expected reply to contain '%s', got '%s'", tc.expected, reply.Text)
+			}
+		})
+	}
+}
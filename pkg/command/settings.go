@@ -0,0 +1,264 @@
+package command
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/persona"
+	"telegram-bot/pkg/settings"
+	"telegram-bot/pkg/thread"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// SettingsHelp explains how the defaults of a chat are changed.
+const SettingsHelp string = `/settings [<setting>=<value>;]
+/settings reset [<setting>]
+
+Settings:
+	Model and the other /tweak parameters
+	Persona:          <the name of a saved persona>
+	Language:         <the language to reply in>
+`
+
+var ErrNoChatSettings = errors.New("no chat settings")
+
+// ChatSettingsFromEnv opens the defaults chats set with /settings, they are
+// forgotten on restart when threads are kept in memory.
+func ChatSettingsFromEnv(st Storage) (*settings.Chats, error) {
+	store, err := openStore[settings.Store](st, ".settings", nil,
+		func(path string) (settings.Store, error) { return settings.NewFileStore(path), nil },
+		func(db *sql.DB) (settings.Store, error) {
+			s, err := settings.NewSQLStore(db)
+			return s, err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return settings.New(store)
+}
+
+// applyChatDefaults layers the defaults of the chat over the global settings
+// of the thread msg just started.
+func (r *CommandRunner) applyChatDefaults(msg *thread.Message) {
+	if r.chatSettings == nil {
+		return
+	}
+
+	defaults := r.chatSettings.Get(msg.ID.ChannelID)
+	if len(defaults) == 0 {
+		return
+	}
+
+	t, err := r.repo.GetThread(msg.ThreadID)
+	if err != nil {
+		log.Printf("failed to get thread %s: %s", msg.ThreadID, err)
+		return
+	}
+
+	if err := ApplyChatDefaults(&t, defaults, r.personas); err != nil {
+		log.Printf("failed to apply the settings of chat %d: %s", msg.ID.ChannelID, err)
+	}
+
+	if err := r.repo.Set(t); err != nil {
+		log.Printf("failed to save thread settings: %s", err)
+	}
+}
+
+// ApplyChatDefaults sets the defaults of a chat on t. The persona goes first
+// so the parameters set by the chat win over those of the persona. Defaults
+// that no longer apply, such as a deleted persona, are skipped.
+func ApplyChatDefaults(t *thread.Thread, defaults settings.Defaults, personas *persona.Library) error {
+	var errs []string
+	if name, ok := defaults[settings.KeyPersona]; ok && personas != nil {
+		p, err := personas.Get(name)
+		if err == nil {
+			err = applyPersona(t, p, thread.SourceChat)
+		}
+
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for _, key := range settings.Keys {
+		val, ok := defaults[key]
+		if !ok || key == settings.KeyPersona || key == settings.KeyLanguage {
+			continue
+		}
+
+		params, err := ApplyTweaks(t.Settings, key+"="+val)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", key, err))
+			continue
+		}
+
+		t.Settings = params
+		t.SetSource(thread.SourceChat, key)
+	}
+
+	if lang, ok := defaults[settings.KeyLanguage]; ok {
+		t.Language = lang
+		t.SetSource(thread.SourceChat, settings.KeyLanguage)
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// ParseChatSettings reads <setting>=<value> pairs separated by semicolons,
+// checking every value so it can be applied to new threads.
+func ParseChatSettings(text string, personas *persona.Library) (settings.Defaults, error) {
+	invalid := func(err error) error {
+		return NewError(KindUser, "Incorrect usage of command, the correct syntax is "+SettingsHelp, err)
+	}
+
+	defaults := settings.Defaults{}
+	for _, setter := range strings.Split(text, ";") {
+		if strings.TrimSpace(setter) == "" {
+			continue
+		}
+
+		key, val, ok := strings.Cut(setter, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || !settings.IsKey(key) {
+			return nil, invalid(fmt.Errorf("'%s': %w", key, settings.ErrUnknownKey))
+		}
+
+		switch key {
+		case settings.KeyPersona:
+			val = strings.TrimPrefix(val, "@")
+			if personas == nil {
+				return nil, unknownPersona(val, ErrNoPersonas)
+			}
+
+			if _, err := personas.Get(val); err != nil {
+				return nil, unknownPersona(val, err)
+			}
+		case settings.KeyLanguage:
+			if val == "" || len(val) > 32 {
+				return nil, invalid(fmt.Errorf("language: %w", ErrInvalidParameter))
+			}
+		default:
+			if _, err := ApplyTweaks(thread.DefaultOpenAISettings, key+"="+val); err != nil {
+				return nil, invalid(err)
+			}
+		}
+
+		defaults[key] = val
+	}
+
+	if len(defaults) == 0 {
+		return nil, invalid(ErrMissingArgument)
+	}
+
+	return defaults, nil
+}
+
+// isChatAdmin tells whether the sender of msg administers the chat: the user
+// of a private chat, an administrator of the group or an admin of the bot.
+func isChatAdmin(ctx Context, msg *thread.Message) (bool, error) {
+	if ctx.Scope == ScopePrivate {
+		return true, nil
+	}
+
+	if ctx.Runner.acl != nil && ctx.Runner.acl.Role(msg.ID.ChannelID, msg.ID.FromID) == acl.RoleAdmin {
+		return true, nil
+	}
+
+	resp, err := ctx.Telegram.Request(telegram.GetChatMemberConfig{
+		ChatConfigWithUser: telegram.ChatConfigWithUser{ChatID: msg.ID.ChannelID, UserID: msg.ID.FromID},
+	})
+	if err != nil {
+		return false, fmt.Errorf("get chat member: %w", err)
+	}
+
+	var member telegram.ChatMember
+	if err := json.Unmarshal(resp.Result, &member); err != nil {
+		return false, fmt.Errorf("decode chat member: %w", err)
+	}
+
+	return member.IsCreator() || member.IsAdministrator(), nil
+}
+
+// BuildSettingsReport lists every setting of t along with the layer it comes
+// from.
+func BuildSettingsReport(t thread.Thread) string {
+	var b strings.Builder
+	for _, key := range settings.Keys {
+		b.WriteString(fmt.Sprintf("    %s:\t\t%s (%s)\n", key, settings.Value(t, key), t.Source(key)))
+	}
+
+	return b.String()
+}
+
+type Settings struct{}
+
+func (Settings) Exec(ctx Context, msg *thread.Message) error {
+	chats := ctx.Runner.chatSettings
+	if chats == nil {
+		return NewError(KindUser, "Chat settings are off.", ErrNoChatSettings)
+	}
+
+	chatID := msg.ID.ChannelID
+	text := strings.TrimSpace(msg.Text)
+	if text != "" {
+		admin, err := isChatAdmin(ctx, msg)
+		if err != nil {
+			return err
+		}
+
+		if !admin {
+			return NewError(KindUser, "Only admins of this chat can change its settings.", ErrAccessDenied)
+		}
+
+		if err := changeChatSettings(ctx, chatID, text); err != nil {
+			return err
+		}
+	}
+
+	t := thread.Thread{Settings: thread.DefaultOpenAISettings}
+	if err := ApplyChatDefaults(&t, chats.Get(chatID), ctx.Runner.personas); err != nil {
+		log.Printf("failed to apply the settings of chat %d: %s", chatID, err)
+	}
+
+	ctx.Runner.Reply(msg, "New threads in this chat start with:\n"+BuildSettingsReport(t), thread.TypeInformational)
+	return nil
+}
+
+// changeChatSettings sets or, following "reset", removes defaults of the
+// chat.
+func changeChatSettings(ctx Context, chatID int64, text string) error {
+	chats := ctx.Runner.chatSettings
+	if fields := strings.Fields(text); fields[0] == "reset" {
+		if err := chats.Reset(chatID, fields[1:]...); err != nil {
+			return NewError(KindUser, "Incorrect usage of command, the correct syntax is "+SettingsHelp, err)
+		}
+
+		return nil
+	}
+
+	defaults, err := ParseChatSettings(text, ctx.Runner.personas)
+	if err != nil {
+		return err
+	}
+
+	return chats.Set(chatID, defaults)
+}
+
+func (Settings) Spec() Spec {
+	return Spec{
+		Name:    "settings",
+		Summary: "Show or change the settings new threads in the chat start with",
+		Usage:   "Shows the model, parameters, persona and language new threads in this chat start with, and whether each comes from the global configuration or the chat. Admins of the chat change them:\n" + SettingsHelp + "\nReplies to a thread can still /tweak its own settings.",
+		Args:    []Arg{{Name: "settings", Description: "<setting>=<value> pairs separated by semicolons, or reset", Optional: true}},
+	}
+}
@@ -0,0 +1,112 @@
+package command
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/persona"
+	"telegram-bot/pkg/settings"
+	"testing"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestParseChatSettings(t *testing.T) {
+	personas, _ := persona.NewLibrary(nil)
+	personas.Save(persona.Persona{Name: "pirate", SystemPrompt: "Talk like a pirate."})
+	cases := []struct {
+		desc        string
+		text        string
+		expected    settings.Defaults
+		expectedErr error
+	}{
+		{
+			desc:     "reads every kind of setting",
+			text:     "Model=gpt-4; Temperature=0.9; Persona=@pirate; Language=French;",
+			expected: settings.Defaults{"Model": "gpt-4", "Temperature": "0.9", "Persona": "pirate", "Language": "French"},
+		},
+		{
+			desc:        "rejects unknown settings",
+			text:        "Colour=blue",
+			expectedErr: settings.ErrUnknownKey,
+		},
+		{
+			desc:        "rejects invalid parameters",
+			text:        "Model=gpt-5",
+			expectedErr: ErrInvalidParameter,
+		},
+		{
+			desc:        "rejects unknown personas",
+			text:        "Persona=chef",
+			expectedErr: persona.ErrNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			defaults, err := ParseChatSettings(tc.text, personas)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if !reflect.DeepEqual(defaults, tc.expected) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, defaults)
+			}
+		})
+	}
+}
+
+func TestSettings(t *testing.T) {
+	provider := completion.NewFake("Arr!")
+	ctx, srv := newTestContext(t, provider)
+	runner := ctx.Runner
+	runner.personas, _ = persona.NewLibrary(nil)
+	runner.personas.Save(persona.Persona{Name: "pirate", SystemPrompt: "Talk like a pirate."})
+	runner.chatSettings, _ = settings.New(nil)
+	srv.SetChatAdmins(-3, 5)
+	runTestRunner(t, runner)
+	admin := telegram.User{ID: 5, FirstName: "Admin"}
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(-3, user, "/settings Model=gpt-4", nil)
+	denied := waitForSent(t, srv, 1)
+	if expected := "Only admins of this chat can change its settings."; denied.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, denied.Text)
+	}
+
+	srv.Post(-3, admin, "/settings Model=gpt-4; Persona=pirate; Language=French", nil)
+	report := waitForSent(t, srv, 2)
+	for _, expected := range []string{"Model:\t\tgpt-4 (chat)", "Persona:\t\t@pirate (chat)", "TopP:\t\t1.000000 (global)"} {
+		if !strings.Contains(report.Text, expected) {
+			t.Errorf("expected the report to contain '%s', got '%s'", expected, report.Text)
+		}
+	}
+
+	srv.Post(-3, user, "/prompt Hello", nil)
+	reply := waitForSent(t, srv, 3)
+	req := provider.Requests[0]
+	expected := []completion.Message{
+		{Role: completion.RoleSystem, Content: "Talk like a pirate."},
+		{Role: completion.RoleSystem, Content: "Always reply in French."},
+		{Role: completion.RoleUser, Name: "Foo", Content: "Hello"},
+	}
+	if req.Model != "gpt-4" || !reflect.DeepEqual(req.Messages, expected) {
+		t.Errorf("expected '%v' with gpt-4, got '%v' with '%s'", expected, req.Messages, req.Model)
+	}
+
+	tweak := srv.Post(-3, user, "/tweak MaxTokens=100; Language=German", reply)
+	srv.Post(-3, user, "/dump", &tweak)
+	dump := waitForSent(t, srv, 4)
+	for _, expected := range []string{"Model:\t\tgpt-4 (chat)", "MaxTokens:\t\t100 (thread)", "Temperature:\t\t0.500000 (global)", "Language:\t\tGerman (thread)"} {
+		if !strings.Contains(dump.Text, expected) {
+			t.Errorf("expected the dump to contain '%s', got '%s'", expected, dump.Text)
+		}
+	}
+
+	srv.Post(-3, admin, "/settings reset", nil)
+	report = waitForSent(t, srv, 5)
+	if strings.Contains(report.Text, "(chat)") {
+		t.Errorf("expected every setting to be global, got '%s'", report.Text)
+	}
+}
@@ -0,0 +1,118 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// DefaultShutdownTimeout leaves handlers most of the 30 seconds
+	// Kubernetes waits before killing a terminating pod, once the poll in
+	// flight returned.
+	DefaultShutdownTimeout time.Duration = 20 * time.Second
+	// cancelGracePeriod is how long cancelled handlers get to return.
+	cancelGracePeriod time.Duration = 2 * time.Second
+)
+
+// handlerContext returns the context every handler runs under, it is
+// cancelled when Shutdown gives up waiting for handlers.
+func (r *CommandRunner) handlerContext() context.Context {
+	r.handlersOnce.Do(func() {
+		r.handlersCtx, r.cancelHandlers = context.WithCancel(context.Background())
+	})
+
+	return r.handlersCtx
+}
+
+// Shutdown waits for the handlers running or queued once Start returned.
+// Handlers that don't finish within the shutdown timeout are cancelled. The
+// repository, the stores and the storage they share are closed afterwards,
+// flushing everything the handlers stored.
+func (r *CommandRunner) Shutdown() error {
+	timeout := r.shutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.inflight.Wait()
+		close(done)
+	}()
+
+	r.handlerContext()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("handlers still running after %s, cancelling them", timeout)
+		r.cancelHandlers()
+		select {
+		case <-done:
+		case <-time.After(cancelGracePeriod):
+			log.Printf("handlers didn't return after being cancelled")
+		}
+	}
+
+	r.cancelHandlers()
+	r.dispatcher.Close()
+	if err := r.repo.Close(); err != nil {
+		return fmt.Errorf("close thread repository: %w", err)
+	}
+
+	if r.quotas != nil {
+		if err := r.quotas.Close(); err != nil {
+			return fmt.Errorf("close quotas: %w", err)
+		}
+	}
+
+	if r.ledger != nil {
+		if err := r.ledger.Close(); err != nil {
+			return fmt.Errorf("close usage ledger: %w", err)
+		}
+	}
+
+	if r.personas != nil {
+		if err := r.personas.Close(); err != nil {
+			return fmt.Errorf("close personas: %w", err)
+		}
+	}
+
+	if r.chatSettings != nil {
+		if err := r.chatSettings.Close(); err != nil {
+			return fmt.Errorf("close chat settings: %w", err)
+		}
+	}
+
+	if r.acl != nil {
+		if err := r.acl.Close(); err != nil {
+			return fmt.Errorf("close acl: %w", err)
+		}
+	}
+
+	if err := r.storage.Close(); err != nil {
+		return fmt.Errorf("close storage: %w", err)
+	}
+
+	return nil
+}
+
+// commitOffset confirms every update up to the last one handled, so Telegram
+// doesn't deliver them again once the bot restarts. It polls for updates
+// itself, so it must only run once polling stopped.
+func (r *CommandRunner) commitOffset() error {
+	if r.lastUpdateID == 0 {
+		return nil
+	}
+
+	u := telegram.NewUpdate(r.lastUpdateID + 1)
+	u.Limit = 1
+	if _, err := r.bot.GetUpdates(u); err != nil {
+		return fmt.Errorf("commit update offset %d: %w", u.Offset, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"telegram-bot/pkg/completion"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// gatedProvider completes prompts once release is closed or the request is
+// cancelled.
+type gatedProvider struct {
+	started chan struct{}
+	release chan struct{}
+	err     chan error
+}
+
+func newGatedProvider() *gatedProvider {
+	return &gatedProvider{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		err:     make(chan error, 1),
+	}
+}
+
+func (p *gatedProvider) Complete(ctx context.Context, req completion.Request) (completion.Response, error) {
+	close(p.started)
+	select {
+	case <-p.release:
+		p.err <- nil
+		return completion.Response{Text: "Done"}, nil
+	case <-ctx.Done():
+		p.err <- ctx.Err()
+		return completion.Response{}, ctx.Err()
+	}
+}
+
+func TestCommandRunner_Shutdown(t *testing.T) {
+	cases := []struct {
+		desc         string
+		release      bool
+		expectedErr  error
+		expectedSent []string
+	}{
+		{
+			desc:         "waits for running handlers",
+			release:      true,
+			expectedErr:  nil,
+			expectedSent: []string{"Done"},
+		},
+		{
+			desc:         "cancels handlers running past the timeout",
+			release:      false,
+			expectedErr:  context.Canceled,
+			expectedSent: []string{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			provider := newGatedProvider()
+			ctx, srv := newTestContext(t, provider)
+			runner := ctx.Runner
+			runner.shutdownTimeout = 100 * time.Millisecond
+
+			running, stop := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() {
+				done <- runner.Start(running)
+			}()
+
+			srv.Post(3, telegram.User{ID: 2, FirstName: "Foo"}, "/prompt Hello", nil)
+			<-provider.started
+			stop()
+			if err := <-done; err != nil {
+				t.Fatalf("unexpected error from runner: %v", err)
+			}
+
+			if tc.release {
+				close(provider.release)
+			}
+
+			if err := runner.Shutdown(); err != nil {
+				t.Fatalf("unexpected error shutting down: %v", err)
+			}
+
+			if err := <-provider.err; !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected handler error '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if !reflect.DeepEqual(srv.Sent(), tc.expectedSent) {
+				t.Errorf("expected '%v', got '%v'", tc.expectedSent, srv.Sent())
+			}
+
+			if pending := srv.Pending(); len(pending) != 0 {
+				t.Errorf("expected handled updates to be confirmed, got '%v'", pending)
+			}
+		})
+	}
+}
+
+func TestCommandRunner_StopPolling(t *testing.T) {
+	ctx, srv := newTestContext(t, completion.NewFake())
+	runner := ctx.Runner
+	running, stop := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- runner.Start(running)
+	}()
+
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+	srv.Post(3, user, "/echo Hello", nil)
+	waitForSent(t, srv, 1)
+
+	// A poll is in flight when polling stops, the offset is only committed
+	// once it returned.
+	stop()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error from runner: %v", err)
+	}
+
+	if err := runner.Shutdown(); err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+
+	if pending := srv.Pending(); len(pending) != 0 {
+		t.Errorf("expected handled updates to be confirmed, got '%v'", pending)
+	}
+}
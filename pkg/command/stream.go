@@ -0,0 +1,98 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"telegram-bot/pkg/chunk"
+	"telegram-bot/pkg/thread"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	StreamPlaceholder   string        = "…"
+	DefaultEditInterval time.Duration = 1500 * time.Millisecond
+)
+
+// StreamingReply is a reply that is sent as a placeholder and then edited in
+// place as more of its text becomes available. Edits are throttled to stay
+// within Telegram's rate limits.
+type StreamingReply struct {
+	runner   *CommandRunner
+	parent   *thread.Message
+	sent     telegram.Message
+	shown    string
+	pending  string
+	lastEdit time.Time
+}
+
+func (r *CommandRunner) StartReply(msg *thread.Message) (*StreamingReply, error) {
+	reply := telegram.NewMessage(msg.ID.ChannelID, StreamPlaceholder)
+	reply.ReplyToMessageID = msg.ID.MessageID
+	sent, err := r.telegramClient.Send(reply)
+	if err != nil {
+		return nil, fmt.Errorf("send placeholder reply: %w", err)
+	}
+
+	return &StreamingReply{
+		runner:   r,
+		parent:   msg,
+		sent:     sent,
+		shown:    StreamPlaceholder,
+		lastEdit: time.Now(),
+	}, nil
+}
+
+// Update replaces the text of the reply, the edit is skipped if the previous
+// one was too recent and picked up by a later Update or Finish instead.
+func (s *StreamingReply) Update(text string) {
+	s.pending = text
+	if time.Since(s.lastEdit) < s.runner.editInterval {
+		return
+	}
+
+	if err := s.flush(); err != nil {
+		log.Printf("failed to update streaming reply: %s", err)
+	}
+}
+
+// flush edits the reply to show the pending text. Only as much of the text as
+// fits into a single message is shown, the rest is sent by Finish.
+func (s *StreamingReply) flush() error {
+	text := strings.TrimSpace(chunk.Split(s.pending, chunk.MaxMessageLength)[0])
+	if text == "" || text == s.shown {
+		return nil
+	}
+
+	edit := telegram.NewEditMessageText(s.sent.Chat.ID, s.sent.MessageID, text)
+	if _, err := s.runner.telegramClient.Send(edit); err != nil {
+		return fmt.Errorf("edit reply: %w", err)
+	}
+
+	s.shown = text
+	s.lastEdit = time.Now()
+	return nil
+}
+
+// Finish sets the final text of the reply and adds it to the thread. Text that
+// doesn't fit into the reply continues in a chain of replies to it.
+func (s *StreamingReply) Finish(text string, messageType thread.MessageType) error {
+	parts := chunk.Split(text, chunk.MaxMessageLength)
+	s.pending = parts[0]
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	final := s.sent
+	final.Text = s.shown
+	final.ReplyToMessage = replyTarget(s.parent)
+	added, err := s.runner.repo.AddMessage(&final, messageType)
+	if err != nil {
+		return fmt.Errorf("add message to thread: %w", err)
+	}
+
+	_, err = s.runner.replyChain(added, parts[1:], messageType)
+	return err
+}
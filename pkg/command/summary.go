@@ -0,0 +1,36 @@
+package command
+
+import (
+	"fmt"
+	"telegram-bot/pkg/thread"
+)
+
+type Summary struct{}
+
+func (Summary) Exec(ctx Context, msg *thread.Message) error {
+	if msg.Parent() == nil {
+		return thread.ErrNotFound
+	}
+
+	t, err := ctx.Threads.GetThread(msg.ThreadID)
+	if err != nil {
+		return fmt.Errorf("get thread: %w", err)
+	}
+
+	if t.Summary.Text == "" {
+		ctx.Runner.Reply(msg, "This thread hasn't been summarized yet, that happens once it grows too long to send in full.", thread.TypeInformational)
+		return nil
+	}
+
+	ctx.Runner.Reply(msg, "Summary of the earlier conversation:\n\n"+t.Summary.Text, thread.TypeInformational)
+	return nil
+}
+
+func (Summary) Spec() Spec {
+	return Spec{
+		Name:      "summary",
+		Summary:   "Show the summary kept of a long thread",
+		Usage:     "Once a thread grows long its older messages are summarized and the summary is sent in their place.",
+		ReplyOnly: true,
+	}
+}
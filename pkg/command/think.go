@@ -11,7 +11,12 @@ import (
 type Think struct{}
 
 func (Think) Exec(ctx Context, msg *thread.Message) error {
-	time.Sleep(5 * time.Second)
+	select {
+	case <-time.After(5 * time.Second):
+	case <-ctx.Context.Done():
+		return ctx.Context.Err()
+	}
+
 	reply := telegram.NewMessage(msg.ID.ChannelID, "had a good sleep")
 	if _, err := ctx.Telegram.Send(reply); err != nil {
 		return fmt.Errorf("send think reply: %w", err)
@@ -20,6 +25,11 @@ func (Think) Exec(ctx Context, msg *thread.Message) error {
 	return nil
 }
 
-func (Think) IsReplyOnly() bool {
-	return false
+func (Think) Spec() Spec {
+	return Spec{
+		Name:    "think",
+		Summary: "Wait for five seconds and reply",
+		Usage:   "Doesn't do anything particularly useful. To be removed in the future.",
+		Scopes:  []ChatScope{ScopePrivate},
+	}
 }
@@ -6,80 +6,154 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/settings"
 	"telegram-bot/pkg/thread"
 )
 
 type Tweak struct{}
 
-const TweakParamHelp string = `/tweak [<parameter>=<value>;]
-Parameters:
-	Model:            <text-davinci-003|text-curie-001|text-babbage-001|text-ada-001>
+const TweakParamHelp string = "/tweak [<parameter>=<value>;]\n" + TweakParameters
+
+const TweakParameters string = `Parameters:
+	Model:            <text-davinci-003|text-curie-001|text-babbage-001|text-ada-001|gpt-3.5-turbo|gpt-4, or any model of a compatible server>
 	MaxTokens:        < 0 - 4000 >
 	Temperature:      < 0.00 - 1.00 >
 	FrequencyPenalty: < -2.00 - 2.00 >
 	PressencePenalty: < -2.00 - 2.00 >
 	TopP:             < 0.00 - 1.00 >
+	Language:         <the language to reply in, empty for any>
 `
 
 var ErrInvalidParameter error = errors.New("invalid parameter")
 
 func (Tweak) Exec(ctx Context, msg *thread.Message) error {
 	if msg.Parent() == nil {
-		ctx.Runner.Reply(msg, "I couldn't find the thread history. I only keep a small sample of data around for future use, sorry 💩", thread.TypeInformational)
 		return thread.ErrNotFound
 	}
 
 	currentThread, err := ctx.Threads.GetThread(msg.ThreadID)
 	if err != nil {
-		ctx.Runner.Reply(msg, "I couldn't find the thread history. I only keep a small sample of data around for future use, sorry 💩", thread.TypeInformational)
-		return thread.ErrNotFound
+		return fmt.Errorf("get thread: %w", err)
+	}
+
+	// The language isn't a completion parameter, it is kept on the thread.
+	var params []string
+	for _, setter := range strings.Split(msg.Text, ";") {
+		key, val, _ := strings.Cut(setter, "=")
+		if strings.TrimSpace(key) == settings.KeyLanguage {
+			currentThread.Language = strings.TrimSpace(val)
+			currentThread.SetSource(thread.SourceThread, settings.KeyLanguage)
+			continue
+		}
+
+		params = append(params, setter)
+	}
+
+	text := strings.Join(params, ";")
+	if currentThread.Settings, err = ApplyTweaks(currentThread.Settings, text); err != nil {
+		return NewError(KindUser, "Incorrect usage of command, the correct syntax is "+TweakParamHelp, err)
 	}
 
-	var settings thread.CompletionParameters = currentThread.Settings
-	setters := strings.Split(strings.TrimSuffix(msg.Text, ";"), ";")
+	currentThread.SetSource(thread.SourceThread, TweakKeys(text)...)
+	if err := ctx.Threads.Set(currentThread); err != nil {
+		return fmt.Errorf("save thread settings: %w", err)
+	}
+
+	return nil
+}
+
+// ApplyTweaks sets the parameters of text, <parameter>=<value> pairs
+// separated by semicolons, on settings.
+func ApplyTweaks(params thread.CompletionParameters, text string) (thread.CompletionParameters, error) {
+	setters := strings.Split(strings.TrimSuffix(text, ";"), ";")
 	for _, setter := range setters {
+		if strings.TrimSpace(setter) == "" {
+			continue
+		}
+
 		parts := strings.Split(strings.TrimSpace(setter), "=")
 		if len(parts) != 2 {
-			ctx.Runner.Reply(msg, fmt.Sprintf("Incorrect usage of command, the correct syntax is %s", TweakParamHelp), thread.TypeInformational)
-			return ErrInvalidParameter
+			return params, ErrInvalidParameter
 		}
 
 		name := strings.TrimSpace(parts[0])
 		val := strings.TrimSpace(parts[1])
 
+		var err error
 		switch name {
 		case "Model":
-			settings, err = DoSet(settings, val, nil, setModel)
+			params, err = DoSet(params, val, stringConverter, setModel)
 		case "MaxTokens":
-			settings, err = DoSet(settings, val, strconv.Atoi, setMaxTokens)
+			params, err = DoSet(params, val, strconv.Atoi, setMaxTokens)
 		case "Temperature":
-			settings, err = DoSet(settings, val, float32Converter, setTemperature)
+			params, err = DoSet(params, val, float32Converter, setTemperature)
 		case "FrequencyPenalty":
-			settings, err = DoSet(settings, val, float32Converter, setFrequencyPenalty)
+			params, err = DoSet(params, val, float32Converter, setFrequencyPenalty)
 		case "TopP":
-			settings, err = DoSet(settings, val, float32Converter, setTopP)
+			params, err = DoSet(params, val, float32Converter, setTopP)
 		case "PressencePenalty":
-			settings, err = DoSet(settings, val, float32Converter, setPressencePenalty)
+			params, err = DoSet(params, val, float32Converter, setPressencePenalty)
 		default:
 			err = ErrInvalidParameter
 		}
 
 		if err != nil {
-			ctx.Runner.Reply(msg, fmt.Sprintf("Incorrect usage of command, the correct syntax is %s", TweakParamHelp), thread.TypeInformational)
-			return ErrInvalidParameter
+			return params, ErrInvalidParameter
 		}
+	}
 
+	return params, nil
+}
+
+// CheckParameters checks that params are ones /tweak could have set, for
+// parameters that come from elsewhere, like an imported thread.
+func CheckParameters(params thread.CompletionParameters) error {
+	checks := []struct {
+		name string
+		set  func() (thread.CompletionParameters, error)
+	}{
+		{"Model", func() (thread.CompletionParameters, error) { return setModel(params, params.Model) }},
+		{"MaxTokens", func() (thread.CompletionParameters, error) { return setMaxTokens(params, params.MaxTokens) }},
+		{"Temperature", func() (thread.CompletionParameters, error) { return setTemperature(params, params.Temperature) }},
+		{"FrequencyPenalty", func() (thread.CompletionParameters, error) {
+			return setFrequencyPenalty(params, params.FrequencyPenalty)
+		}},
+		{"PressencePenalty", func() (thread.CompletionParameters, error) {
+			return setPressencePenalty(params, params.PressencePenalty)
+		}},
+		{"TopP", func() (thread.CompletionParameters, error) { return setTopP(params, params.TopP) }},
+	}
+
+	for _, c := range checks {
+		if _, err := c.set(); err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
 	}
 
-	currentThread.Settings = settings
-	ctx.Threads.Set(currentThread)
 	return nil
 }
 
+// TweakKeys returns the names of the parameters text sets.
+func TweakKeys(text string) []string {
+	var keys []string
+	for _, setter := range strings.Split(text, ";") {
+		if key, _, ok := strings.Cut(setter, "="); ok {
+			keys = append(keys, strings.TrimSpace(key))
+		}
+	}
+
+	return keys
+}
+
 type Params interface {
 	float32 | int | string
 }
 
+func stringConverter(s string) (string, error) {
+	return s, nil
+}
+
 func float32Converter(s string) (float32, error) {
 	f, err := strconv.ParseFloat(s, 32)
 	return float32(f), err
@@ -102,7 +176,15 @@ func DoSet[T Params](params thread.CompletionParameters, valStr string, conv con
 	return setter(params, val)
 }
 
-var ModelRegex = regexp.MustCompile("^(text-davinci-003|text-curie-001|text-babbage-001|text-ada-001)$")
+var (
+	OpenAIModelRegex = regexp.MustCompile("^(text-davinci-003|text-curie-001|text-babbage-001|text-ada-001|gpt-3.5-turbo|gpt-4)$")
+	// CompatibleModelRegex matches the names self-hosted servers give their
+	// models, like llama3:8b or mistral-7b-instruct.
+	CompatibleModelRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/@-]{0,127}$`)
+	// ModelRegex matches the models of the configured provider, the ones
+	// /tweak, /settings and personas accept.
+	ModelRegex = OpenAIModelRegex
+)
 
 func setModel(params thread.CompletionParameters, val string) (thread.CompletionParameters, error) {
 	if !ModelRegex.Match([]byte(val)) {
@@ -158,6 +240,13 @@ func setMaxTokens(params thread.CompletionParameters, val int) (thread.Completio
 	return params, nil
 }
 
-func (Tweak) IsReplyOnly() bool {
-	return true
+func (Tweak) Spec() Spec {
+	return Spec{
+		Name:      "tweak",
+		Summary:   "Change the completion parameters of a thread",
+		Usage:     TweakParameters,
+		Args:      []Arg{{Name: "settings", Description: "<parameter>=<value> pairs separated by semicolons"}},
+		ReplyOnly: true,
+		Role:      acl.RoleAdmin,
+	}
 }
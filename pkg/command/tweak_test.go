@@ -0,0 +1,38 @@
+package command
+
+import (
+	"errors"
+	"regexp"
+	"telegram-bot/pkg/thread"
+	"testing"
+)
+
+func TestApplyTweaks_Model(t *testing.T) {
+	cases := []struct {
+		desc        string
+		models      *regexp.Regexp
+		model       string
+		expectedErr error
+	}{
+		{desc: "accepts openai models", models: OpenAIModelRegex, model: "gpt-4"},
+		{desc: "rejects other models for openai", models: OpenAIModelRegex, model: "llama3:8b", expectedErr: ErrInvalidParameter},
+		{desc: "accepts tagged models of compatible servers", models: CompatibleModelRegex, model: "llama3:8b"},
+		{desc: "accepts named models of compatible servers", models: CompatibleModelRegex, model: "mistral-7b-instruct"},
+		{desc: "rejects names with spaces", models: CompatibleModelRegex, model: "llama 3", expectedErr: ErrInvalidParameter},
+	}
+
+	defer func() { ModelRegex = OpenAIModelRegex }()
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ModelRegex = tc.models
+			params, err := ApplyTweaks(thread.DefaultOpenAISettings, "Model="+tc.model)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if err == nil && params.Model != tc.model {
+				t.Errorf("expected model '%s', got '%s'", tc.model, params.Model)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"telegram-bot/pkg/thread"
+)
+
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+type Undo struct{}
+
+func (Undo) Exec(ctx Context, msg *thread.Message) error {
+	var response *thread.Message
+	for m := msg.Parent(); m != nil; m = m.Parent() {
+		if m.Type == thread.TypeResponse {
+			response = m
+			break
+		}
+	}
+
+	if response == nil {
+		return NewError(KindUser, "There is no answer to undo in this thread.", ErrNothingToUndo)
+	}
+
+	prompt := response.ResponseStart().Parent()
+	if prompt == nil || prompt.Parent() == nil {
+		return NewError(KindUser, "The first exchange started this thread and can't be undone, start a new one with /prompt instead.", ErrNothingToUndo)
+	}
+
+	previous := prompt.Parent()
+	if err := ctx.Threads.Detach(prompt.ID); err != nil {
+		return fmt.Errorf("detach exchange: %w", err)
+	}
+
+	ctx.Runner.Reply(previous, "Undid the last exchange, reply to this message to continue from here.", thread.TypeInformational)
+	return nil
+}
+
+func (Undo) Spec() Spec {
+	return Spec{
+		Name:      "undo",
+		Summary:   "Remove the last exchange from the thread",
+		Usage:     "Reply with /undo to one of my answers to remove it, along with the prompt it answers and everything that followed, from the history of the thread. The messages stay in the chat.",
+		ReplyOnly: true,
+	}
+}
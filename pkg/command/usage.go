@@ -0,0 +1,232 @@
+package command
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/thread"
+	"telegram-bot/pkg/usage"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// usageDays and usageWeeks are how many days and ISO weeks /usage
+	// breaks down.
+	usageDays  = 7
+	usageWeeks = 4
+)
+
+// LedgerFromEnv creates the ledger recording the usage of completions, costed
+// with the default prices and those USAGE_PRICES adds or overrides. With
+// threads kept in memory the ledger only covers the current run.
+func LedgerFromEnv(st Storage) (*usage.Ledger, error) {
+	prices, err := usage.ParsePrices(os.Getenv("USAGE_PRICES"), usage.DefaultPrices)
+	if err != nil {
+		return nil, fmt.Errorf("parse USAGE_PRICES: %w", err)
+	}
+
+	store, err := openStore[usage.Store](st, ".usage", usage.NewMemoryStore(),
+		func(path string) (usage.Store, error) {
+			s, err := usage.OpenFileStore(path)
+			return s, err
+		},
+		func(db *sql.DB) (usage.Store, error) {
+			s, err := usage.NewSQLStore(db)
+			return s, err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return usage.NewLedger(store, prices), nil
+}
+
+type Usage struct{}
+
+func (Usage) Exec(ctx Context, msg *thread.Message) error {
+	ledger := ctx.Runner.ledger
+	if ledger == nil {
+		ctx.Runner.Reply(msg, "Usage isn't recorded.", thread.TypeInformational)
+		return nil
+	}
+
+	args := strings.Fields(msg.Text)
+	chatID := msg.ID.ChannelID
+	if len(args) > 0 && args[0] == "all" {
+		if err := requireAdmin(ctx, msg, "Only admins can see the usage of all chats."); err != nil {
+			return err
+		}
+
+		chatID = 0
+		args = args[1:]
+	}
+
+	if len(args) > 0 && args[0] == "export" {
+		return exportUsage(ctx, msg, chatID, args[1:])
+	}
+
+	if len(args) > 0 {
+		return NewError(KindUser, "Incorrect usage of command, the correct syntax is "+Usage{}.Spec().Synopsis(), ErrInvalidParameter)
+	}
+
+	now := ledger.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	// ISO weeks start on monday.
+	weekStart := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	since := weekStart.AddDate(0, 0, -7*(usageWeeks-1))
+	records, err := ledger.Records(usage.Filter{ChatID: chatID, Since: since, Until: today.AddDate(0, 0, 1)})
+	if err != nil {
+		return fmt.Errorf("query usage: %w", err)
+	}
+
+	ctx.Runner.Reply(msg, BuildUsageReport(records, chatID == 0, today.AddDate(0, 0, 1-usageDays)), thread.TypeInformational)
+	return nil
+}
+
+// requireAdmin checks that the sender of msg is an admin of the bot, denied
+// tells everyone else what only admins can do. There are no admins while
+// access control is off, so nobody can.
+func requireAdmin(ctx Context, msg *thread.Message, denied string) error {
+	access, err := accessControl(ctx)
+	if err != nil {
+		return NewError(KindUser, denied+" Access control is off, set ACL_ADMINS to turn it on.", err)
+	}
+
+	if access.Role(msg.ID.ChannelID, msg.ID.FromID) != acl.RoleAdmin {
+		return NewError(KindUser, denied, fmt.Errorf("user %d: %w", msg.ID.FromID, ErrAccessDenied))
+	}
+
+	return nil
+}
+
+type usageSection struct {
+	title string
+	rows  []usage.Row
+}
+
+// BuildUsageReport sums up records by day from daysSince on and by ISO week,
+// the report of every chat also sums them up by chat.
+func BuildUsageReport(records []usage.Record, allChats bool, daysSince time.Time) string {
+	var days []usage.Record
+	for _, rec := range records {
+		if !rec.Time.Before(daysSince) {
+			days = append(days, rec)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("```\n")
+	if allChats {
+		b.WriteString("Usage of all chats\n")
+	} else {
+		b.WriteString("Usage of this chat\n")
+	}
+
+	sections := []usageSection{
+		{fmt.Sprintf("Last %d days:", usageDays), usage.Summarize(days, usage.ByDay)},
+		{fmt.Sprintf("Last %d weeks:", usageWeeks), usage.Summarize(records, usage.ByWeek)},
+	}
+
+	if allChats {
+		byChat := usage.Summarize(records, func(r usage.Record) string { return strconv.FormatInt(r.ChatID, 10) })
+		sections = append(sections, usageSection{fmt.Sprintf("By chat, last %d weeks:", usageWeeks), byChat})
+	}
+
+	for _, s := range sections {
+		b.WriteString("\n" + s.title + "\n")
+		if len(s.rows) == 0 {
+			b.WriteString("  nothing used\n")
+		}
+
+		for _, row := range s.rows {
+			b.WriteString(fmt.Sprintf("  %-14s %4d requests %8d tokens  $%.4f", row.Key, row.Requests, row.Tokens(), row.Cost))
+			if row.Unpriced > 0 {
+				b.WriteString(fmt.Sprintf(" (%d unpriced)", row.Unpriced))
+			}
+
+			b.WriteString("\n")
+		}
+	}
+
+	b.WriteString("```\n")
+	return b.String()
+}
+
+// exportUsage sends the usage of a month as a CSV document, of every chat when
+// chatID is 0.
+func exportUsage(ctx Context, msg *thread.Message, chatID int64, args []string) error {
+	now := ctx.Runner.ledger.Now()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if len(args) > 0 {
+		var err error
+		if month, err = time.Parse("2006-01", args[0]); err != nil {
+			return NewError(KindUser, "The month to export is written like 2023-04.", fmt.Errorf("%s: %w", err, ErrInvalidParameter))
+		}
+	}
+
+	records, err := ctx.Runner.ledger.Records(usage.Filter{ChatID: chatID, Since: month, Until: month.AddDate(0, 1, 0)})
+	if err != nil {
+		return fmt.Errorf("query usage: %w", err)
+	}
+
+	data, err := UsageCSV(records)
+	if err != nil {
+		return fmt.Errorf("export usage: %w", err)
+	}
+
+	doc := telegram.NewDocument(msg.ID.ChannelID, telegram.FileBytes{
+		Name:  fmt.Sprintf("usage-%s.csv", month.Format("2006-01")),
+		Bytes: data,
+	})
+	doc.ReplyToMessageID = msg.ID.MessageID
+	if _, err := ctx.Telegram.Send(doc); err != nil {
+		return fmt.Errorf("send usage export: %w", err)
+	}
+
+	return nil
+}
+
+// UsageCSV sums up records by day, chat, user and model into a CSV file, to
+// bill the usage back to whoever made it.
+func UsageCSV(records []usage.Record) ([]byte, error) {
+	rows := usage.Summarize(records, func(r usage.Record) string {
+		return strings.Join([]string{usage.ByDay(r), strconv.FormatInt(r.ChatID, 10), strconv.FormatInt(r.UserID, 10), r.Model}, "\x00")
+	})
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"date", "chat_id", "user_id", "model", "requests", "prompt_tokens", "completion_tokens", "cost_usd", "unpriced_requests"})
+	for _, row := range rows {
+		record := append(strings.Split(row.Key, "\x00"),
+			strconv.Itoa(row.Requests),
+			strconv.Itoa(row.PromptTokens),
+			strconv.Itoa(row.CompletionTokens),
+			strconv.FormatFloat(row.Cost, 'f', 6, 64),
+			strconv.Itoa(row.Unpriced),
+		)
+		w.Write(record)
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func (Usage) Spec() Spec {
+	return Spec{
+		Name:    "usage",
+		Summary: "Show the tokens used and what they cost",
+		Usage:   "Shows the requests, tokens and cost of the completions of this chat by day and by week. Admins can add all to see every chat. export sends the usage of the month, or of the one given like 2023-04, as a CSV file by day, chat, user and model.",
+		Args: []Arg{
+			{Name: "all", Description: "Show the usage of every chat, admins only", Optional: true},
+			{Name: "export", Description: "Send the usage as a CSV file", Optional: true},
+			{Name: "month", Description: "The month to export, the current one by default", Optional: true},
+		},
+	}
+}
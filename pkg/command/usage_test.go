@@ -0,0 +1,108 @@
+package command
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"telegram-bot/pkg/acl"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/persona"
+	"telegram-bot/pkg/thread"
+	"telegram-bot/pkg/usage"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestUsage(t *testing.T) {
+	provider := &completion.Fake{Steps: []completion.Step{
+		{Response: completion.Response{Text: "Hi there", Usage: completion.Usage{PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500}}},
+	}}
+	ctx, srv := newTestContext(t, provider)
+	runner := ctx.Runner
+	runner.ledger = usage.NewLedger(usage.NewMemoryStore(), usage.Prices{thread.DefaultOpenAISettings.Model: {Prompt: 0.02, Completion: 0.02}})
+	runner.completions = usage.NewMeter(provider, runner.ledger)
+	var err error
+	if runner.acl, err = acl.New(nil, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	runner.acl.Grant(-3, acl.RoleUser)
+	runTestRunner(t, runner)
+	admin := telegram.User{ID: 1, FirstName: "Admin"}
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+
+	srv.Post(-3, user, "/prompt Hello", nil)
+	waitForSent(t, srv, 1)
+
+	srv.Post(-3, user, "/usage", nil)
+	report := waitForSent(t, srv, 2)
+	today := time.Now().UTC().Format("2006-01-02")
+	for _, expected := range []string{"Usage of this chat", today, "1 requests", "1500 tokens", "$0.0300"} {
+		if !strings.Contains(report.Text, expected) {
+			t.Errorf("expected the report to contain '%s', got '%s'", expected, report.Text)
+		}
+	}
+
+	srv.Post(-3, user, "/usage all", nil)
+	denied := waitForSent(t, srv, 3)
+	if expected := "Only admins can see the usage of all chats."; denied.Text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, denied.Text)
+	}
+
+	srv.Post(-3, admin, "/usage all", nil)
+	report = waitForSent(t, srv, 4)
+	for _, expected := range []string{"Usage of all chats", "By chat, last 4 weeks:", "-3 "} {
+		if !strings.Contains(report.Text, expected) {
+			t.Errorf("expected the report to contain '%s', got '%s'", expected, report.Text)
+		}
+	}
+
+	srv.Post(-3, admin, "/usage all export", nil)
+	calls, err := srv.WaitFor("sendDocument", 1, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the export to be sent: %v", err)
+	}
+
+	file := calls[0].Files["document"]
+	if expected := fmt.Sprintf("usage-%s.csv", time.Now().UTC().Format("2006-01")); file.Name != expected {
+		t.Errorf("expected '%s', got '%s'", expected, file.Name)
+	}
+
+	expected := "date,chat_id,user_id,model,requests,prompt_tokens,completion_tokens,cost_usd,unpriced_requests\n" +
+		fmt.Sprintf("%s,-3,2,%s,1,1000,500,0.030000,0\n", today, thread.DefaultOpenAISettings.Model)
+	if string(file.Data) != expected {
+		t.Errorf("expected '%s', got '%s'", expected, file.Data)
+	}
+}
+
+func TestAdminOnly_WithoutAccessControl(t *testing.T) {
+	ctx, srv := newTestContext(t, completion.NewFake())
+	runner := ctx.Runner
+	runner.ledger = usage.NewLedger(usage.NewMemoryStore(), usage.DefaultPrices)
+	var err error
+	if runner.personas, err = persona.NewLibrary(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	runTestRunner(t, runner)
+	user := telegram.User{ID: 2, FirstName: "Foo"}
+	srv.Post(3, user, "/usage all", nil)
+	srv.Post(3, user, "/usage all export", nil)
+	srv.Post(3, user, "/persona save pirate\nTalk like a pirate.", nil)
+	waitForSent(t, srv, 3)
+
+	expected := []string{
+		"Only admins can see the usage of all chats. Access control is off, set ACL_ADMINS to turn it on.",
+		"Only admins can see the usage of all chats. Access control is off, set ACL_ADMINS to turn it on.",
+		"Only admins can save personas. Access control is off, set ACL_ADMINS to turn it on.",
+	}
+	if sent := srv.Sent(); !reflect.DeepEqual(sent, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, sent)
+	}
+
+	if saved := runner.personas.List(); len(saved) != 0 {
+		t.Errorf("expected no persona to be saved, got '%v'", saved)
+	}
+}
@@ -0,0 +1,188 @@
+package command
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// SecretTokenHeader carries the secret registered with the webhook on every
+// update Telegram delivers.
+const SecretTokenHeader string = "X-Telegram-Bot-Api-Secret-Token"
+
+const (
+	DefaultWebhookListenAddr string        = ":8080"
+	webhookShutdownTimeout   time.Duration = 10 * time.Second
+)
+
+var ErrUnknownUpdateMode = errors.New("unknown update mode")
+
+// WebhookConfig describes where Telegram delivers updates in webhook mode.
+type WebhookConfig struct {
+	// URL is the public address Telegram posts updates to, its path is
+	// served on ListenAddr.
+	URL        string
+	ListenAddr string
+	// Secret is registered with the webhook and required on every update,
+	// updates are accepted without a check when it is empty.
+	Secret string
+}
+
+// WebhookConfigFromEnv reads the webhook settings. It returns nil when updates
+// should be received by long polling, which UPDATE_MODE defaults to unless
+// WEBHOOK_URL is set.
+func WebhookConfigFromEnv() (*WebhookConfig, error) {
+	cfg := &WebhookConfig{
+		URL:        os.Getenv("WEBHOOK_URL"),
+		ListenAddr: os.Getenv("WEBHOOK_LISTEN_ADDR"),
+		Secret:     os.Getenv("WEBHOOK_SECRET"),
+	}
+
+	mode := os.Getenv("UPDATE_MODE")
+	if mode == "" {
+		mode = "polling"
+		if cfg.URL != "" {
+			mode = "webhook"
+		}
+	}
+
+	switch mode {
+	case "polling":
+		return nil, nil
+	case "webhook":
+	default:
+		return nil, fmt.Errorf("'%s': %w", mode, ErrUnknownUpdateMode)
+	}
+
+	if cfg.URL == "" {
+		return nil, errors.New("update mode 'webhook' requires WEBHOOK_URL")
+	}
+
+	if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+		return nil, fmt.Errorf("parse WEBHOOK_URL: %w", err)
+	}
+
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = DefaultWebhookListenAddr
+	}
+
+	return cfg, nil
+}
+
+// webhookHandler decodes the updates Telegram posts and passes them on to
+// updates, rejecting requests that don't carry secret.
+func webhookHandler(secret string, updates chan<- telegram.Update) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := req.Header.Get(SecretTokenHeader)
+		if secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "invalid secret token", http.StatusUnauthorized)
+			return
+		}
+
+		var update telegram.Update
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			http.Error(w, "invalid update", http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case updates <- update:
+			w.WriteHeader(http.StatusOK)
+		case <-req.Context().Done():
+		}
+	})
+}
+
+// serveWebhook registers the webhook with Telegram and serves it until ctx is
+// done or the server fails. The webhook is removed again before returning so
+// the bot can be switched back to long polling.
+func (r *CommandRunner) serveWebhook(ctx context.Context, cfg WebhookConfig) error {
+	target, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("parse webhook url: %w", err)
+	}
+
+	pattern := target.Path
+	if pattern == "" {
+		pattern = "/"
+	}
+
+	updates := make(chan telegram.Update, r.bot.Buffer)
+	mux := http.NewServeMux()
+	mux.Handle(pattern, webhookHandler(cfg.Secret, updates))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	// Listen before registering so the first update Telegram delivers
+	// doesn't fail.
+	listener, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("listen for webhook: %w", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	params := telegram.Params{"url": cfg.URL}
+	params.AddNonEmpty("secret_token", cfg.Secret)
+	if _, err := r.bot.MakeRequest("setWebhook", params); err != nil {
+		server.Close()
+		return fmt.Errorf("set webhook: %w", err)
+	}
+
+	log.Printf("Receiving updates on webhook %s", target.Redacted())
+	defer func() {
+		if _, err := r.bot.Request(telegram.DeleteWebhookConfig{}); err != nil {
+			log.Printf("failed to delete webhook: %s", err)
+		}
+	}()
+
+	// Every update Telegram was told was received is handled, the channel is
+	// only closed once the server shut down.
+	done := make(chan struct{})
+	go func() {
+		r.handleUpdates(context.Background(), updates)
+		close(done)
+	}()
+
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+	}
+
+	// Wait for the requests in flight so none of them is left writing to
+	// the closed channel.
+	shutdown, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+	defer cancel()
+	if shutdownErr := server.Shutdown(shutdown); shutdownErr != nil {
+		server.Close()
+		if err == nil {
+			err = shutdownErr
+		}
+	}
+
+	close(updates)
+	<-done
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,136 @@
+package command
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	cases := []struct {
+		desc           string
+		method         string
+		token          string
+		body           string
+		expectedStatus int
+		expectedUpdate bool
+	}{
+		{
+			desc:           "accepts updates with the secret",
+			method:         http.MethodPost,
+			token:          "secret",
+			body:           `{"update_id": 7, "message": {"message_id": 1, "text": "/prompt hi"}}`,
+			expectedStatus: http.StatusOK,
+			expectedUpdate: true,
+		},
+		{
+			desc:           "rejects a wrong secret",
+			method:         http.MethodPost,
+			token:          "guess",
+			body:           `{"update_id": 7}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "rejects a missing secret",
+			method:         http.MethodPost,
+			body:           `{"update_id": 7}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			desc:           "rejects malformed updates",
+			method:         http.MethodPost,
+			token:          "secret",
+			body:           `{"update_id":`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "only accepts posts",
+			method:         http.MethodGet,
+			token:          "secret",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			updates := make(chan telegram.Update, 1)
+			req := httptest.NewRequest(tc.method, "/webhook", strings.NewReader(tc.body))
+			if tc.token != "" {
+				req.Header.Set(SecretTokenHeader, tc.token)
+			}
+
+			rec := httptest.NewRecorder()
+			webhookHandler("secret", updates).ServeHTTP(rec, req)
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rec.Code)
+			}
+
+			if received := len(updates) == 1; received != tc.expectedUpdate {
+				t.Fatalf("expected update received '%v', got '%v'", tc.expectedUpdate, received)
+			}
+
+			if tc.expectedUpdate {
+				update := <-updates
+				if update.UpdateID != 7 || update.Message.Text != "/prompt hi" {
+					t.Errorf("unexpected update '%v'", update)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookConfigFromEnv(t *testing.T) {
+	cases := []struct {
+		desc        string
+		env         map[string]string
+		expected    *WebhookConfig
+		expectedErr error
+	}{
+		{
+			desc:     "polls by default",
+			env:      map[string]string{},
+			expected: nil,
+		},
+		{
+			desc: "uses the webhook when a url is set",
+			env:  map[string]string{"WEBHOOK_URL": "https://bot.example.com/updates", "WEBHOOK_SECRET": "secret"},
+			expected: &WebhookConfig{
+				URL:        "https://bot.example.com/updates",
+				ListenAddr: DefaultWebhookListenAddr,
+				Secret:     "secret",
+			},
+		},
+		{
+			desc:     "polls when asked to despite a url",
+			env:      map[string]string{"UPDATE_MODE": "polling", "WEBHOOK_URL": "https://bot.example.com/updates"},
+			expected: nil,
+		},
+		{
+			desc:        "rejects unknown modes",
+			env:         map[string]string{"UPDATE_MODE": "carrier-pigeon"},
+			expectedErr: ErrUnknownUpdateMode,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			for _, name := range []string{"UPDATE_MODE", "WEBHOOK_URL", "WEBHOOK_LISTEN_ADDR", "WEBHOOK_SECRET"} {
+				t.Setenv(name, tc.env[name])
+			}
+
+			result, err := WebhookConfigFromEnv()
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if !reflect.DeepEqual(tc.expected, result) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, result)
+			}
+		})
+	}
+}
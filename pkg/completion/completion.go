@@ -0,0 +1,66 @@
+package completion
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrNoChoices = errors.New("completion returned no choices")
+	ErrAPI       = errors.New("completion api error")
+	// ErrRateLimited is returned instead of ErrAPI when the API rejected a
+	// request for exceeding its rate limits.
+	ErrRateLimited = errors.New("completion api rate limited")
+)
+
+// Provider generates text from a prompt using a language model.
+type Provider interface {
+	Complete(ctx context.Context, req Request) (Response, error)
+}
+
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+type Message struct {
+	Role    Role
+	Name    string
+	Content string
+}
+
+// Streamer is implemented by providers that can deliver a completion while it
+// is being generated. onText is called with every new piece of text, the
+// returned Response holds the full completion.
+type Streamer interface {
+	Stream(ctx context.Context, req Request, onText func(string)) (Response, error)
+}
+
+// Request holds the conversation both as a flattened Prompt for completion
+// models and as role tagged Messages for chat models, each provider uses the
+// form its API expects.
+type Request struct {
+	Model            string
+	Prompt           string
+	Messages         []Message
+	MaxTokens        int
+	Temperature      float32
+	FrequencyPenalty float32
+	PresencePenalty  float32
+	TopP             float32
+	Stop             []string
+}
+
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+type Response struct {
+	Text  string
+	Usage Usage
+}
@@ -0,0 +1,61 @@
+package completion
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+var ErrScriptExhausted = errors.New("fake provider has no scripted responses left")
+
+// Step is a single scripted reply of a Fake provider.
+type Step struct {
+	Response Response
+	Err      error
+}
+
+// Fake is a Provider that replays scripted steps in order and records every
+// request it receives, for use in tests.
+type Fake struct {
+	Steps    []Step
+	Requests []Request
+
+	mu sync.Mutex
+}
+
+func NewFake(texts ...string) *Fake {
+	f := &Fake{}
+	for _, text := range texts {
+		f.Steps = append(f.Steps, Step{Response: Response{Text: text}})
+	}
+
+	return f
+}
+
+func (f *Fake) Complete(ctx context.Context, req Request) (Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Requests = append(f.Requests, req)
+	if len(f.Steps) == 0 {
+		return Response{}, ErrScriptExhausted
+	}
+
+	step := f.Steps[0]
+	f.Steps = f.Steps[1:]
+	return step.Response, step.Err
+}
+
+// Stream replays the next scripted step word by word.
+func (f *Fake) Stream(ctx context.Context, req Request, onText func(string)) (Response, error) {
+	resp, err := f.Complete(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	for _, word := range strings.SplitAfter(resp.Text, " ") {
+		onText(word)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,265 @@
+package completion
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const OpenAIBaseURL string = "https://api.openai.com/v1"
+
+type API int
+
+const (
+	// CompletionsAPI is the `/completions` endpoint taking a single prompt.
+	CompletionsAPI API = iota
+	// ChatAPI is the `/chat/completions` endpoint taking a list of messages.
+	ChatAPI
+)
+
+// HTTP talks to any server implementing the OpenAI completions or chat
+// completions API, including OpenAI itself and self-hosted model servers.
+type HTTP struct {
+	baseURL string
+	token   string
+	api     API
+	client  *http.Client
+}
+
+func NewHTTP(baseURL string, token string, api API) *HTTP {
+	return &HTTP{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		api:     api,
+		client:  http.DefaultClient,
+	}
+}
+
+// NewOpenAIChat uses the OpenAI chat completions API.
+func NewOpenAIChat(token string) *HTTP {
+	return NewHTTP(OpenAIBaseURL, token, ChatAPI)
+}
+
+type httpMessage struct {
+	Role    Role   `json:"role"`
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content"`
+}
+
+// invalidNameChars matches everything the chat API doesn't accept in a
+// message name.
+var invalidNameChars = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+
+func chatName(name string) string {
+	name = strings.Trim(invalidNameChars.ReplaceAllString(name, "_"), "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
+
+func chatMessages(req Request) []httpMessage {
+	if len(req.Messages) == 0 {
+		return []httpMessage{{Role: RoleUser, Content: req.Prompt}}
+	}
+
+	messages := make([]httpMessage, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		messages = append(messages, httpMessage{
+			Role:    m.Role,
+			Name:    chatName(m.Name),
+			Content: m.Content,
+		})
+	}
+
+	return messages
+}
+
+type httpRequest struct {
+	Model            string        `json:"model"`
+	Prompt           string        `json:"prompt,omitempty"`
+	Messages         []httpMessage `json:"messages,omitempty"`
+	MaxTokens        int           `json:"max_tokens,omitempty"`
+	Temperature      float32       `json:"temperature"`
+	FrequencyPenalty float32       `json:"frequency_penalty"`
+	PresencePenalty  float32       `json:"presence_penalty"`
+	TopP             float32       `json:"top_p"`
+	Stop             []string      `json:"stop,omitempty"`
+	Stream           bool          `json:"stream,omitempty"`
+}
+
+type httpChoice struct {
+	Text    string      `json:"text"`
+	Message httpMessage `json:"message"`
+	Delta   httpMessage `json:"delta"`
+}
+
+type httpResponse struct {
+	Choices []httpChoice `json:"choices"`
+	Usage   struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (h *HTTP) request(req Request, stream bool) (string, httpRequest) {
+	body := httpRequest{
+		Model:            req.Model,
+		MaxTokens:        req.MaxTokens,
+		Temperature:      req.Temperature,
+		FrequencyPenalty: req.FrequencyPenalty,
+		PresencePenalty:  req.PresencePenalty,
+		TopP:             req.TopP,
+		Stop:             req.Stop,
+		Stream:           stream,
+	}
+
+	if h.api == ChatAPI {
+		body.Messages = chatMessages(req)
+		return "/chat/completions", body
+	}
+
+	body.Prompt = req.Prompt
+	return "/completions", body
+}
+
+func (h *HTTP) Complete(ctx context.Context, req Request) (Response, error) {
+	path, body := h.request(req, false)
+	resp, err := h.post(ctx, path, body)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	var out httpResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return Response{}, fmt.Errorf("decode response: %w", err)
+	}
+
+	if len(out.Choices) == 0 {
+		return Response{}, ErrNoChoices
+	}
+
+	text := out.Choices[0].Text
+	if h.api == ChatAPI {
+		text = out.Choices[0].Message.Content
+	}
+
+	return Response{
+		Text: text,
+		Usage: Usage{
+			PromptTokens:     out.Usage.PromptTokens,
+			CompletionTokens: out.Usage.CompletionTokens,
+			TotalTokens:      out.Usage.TotalTokens,
+		},
+	}, nil
+}
+
+var (
+	dataPrefix = []byte("data: ")
+	doneEvent  = []byte("[DONE]")
+)
+
+// Stream reads the server sent events of a streamed completion.
+func (h *HTTP) Stream(ctx context.Context, req Request, onText func(string)) (Response, error) {
+	path, body := h.request(req, true)
+	resp, err := h.post(ctx, path, body)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	var b strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if !bytes.HasPrefix(line, dataPrefix) {
+			continue
+		}
+
+		line = bytes.TrimPrefix(line, dataPrefix)
+		if bytes.Equal(line, doneEvent) {
+			break
+		}
+
+		var chunk httpResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return Response{}, fmt.Errorf("decode stream event: %w", err)
+		}
+
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		text := chunk.Choices[0].Text
+		if h.api == ChatAPI {
+			text = chunk.Choices[0].Delta.Content
+		}
+
+		if text != "" {
+			b.WriteString(text)
+			onText(text)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Response{}, fmt.Errorf("read stream: %w", err)
+	}
+
+	if b.Len() == 0 {
+		return Response{}, ErrNoChoices
+	}
+
+	return Response{Text: b.String()}, nil
+}
+
+// post sends the request and checks its status, the caller has to close the
+// body of the returned response.
+func (h *HTTP) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	apiErr := ErrAPI
+	if resp.StatusCode == http.StatusTooManyRequests {
+		apiErr = ErrRateLimited
+	}
+
+	var out httpResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err == nil && out.Error != nil {
+		return nil, fmt.Errorf("status %d: %s: %w", resp.StatusCode, out.Error.Message, apiErr)
+	}
+
+	return nil, fmt.Errorf("status %d: %w", resp.StatusCode, apiErr)
+}
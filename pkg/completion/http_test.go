@@ -0,0 +1,217 @@
+package completion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHTTP_Complete(t *testing.T) {
+	type output struct {
+		value Response
+		err   error
+	}
+	cases := []struct {
+		desc         string
+		api          API
+		status       int
+		body         string
+		expectedPath string
+		expected     output
+	}{
+		{
+			desc:         "reads completions api text",
+			api:          CompletionsAPI,
+			status:       http.StatusOK,
+			body:         `{"choices":[{"text":"Hello"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`,
+			expectedPath: "/v1/completions",
+			expected: output{
+				value: Response{Text: "Hello", Usage: Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4}},
+			},
+		},
+		{
+			desc:         "reads chat api message",
+			api:          ChatAPI,
+			status:       http.StatusOK,
+			body:         `{"choices":[{"message":{"role":"assistant","content":"Hello"}}]}`,
+			expectedPath: "/v1/chat/completions",
+			expected: output{
+				value: Response{Text: "Hello"},
+			},
+		},
+		{
+			desc:         "fails without choices",
+			api:          ChatAPI,
+			status:       http.StatusOK,
+			body:         `{"choices":[]}`,
+			expectedPath: "/v1/chat/completions",
+			expected: output{
+				err: ErrNoChoices,
+			},
+		},
+		{
+			desc:         "reports api errors",
+			api:          CompletionsAPI,
+			status:       http.StatusBadRequest,
+			body:         `{"error":{"message":"maximum context length exceeded"}}`,
+			expectedPath: "/v1/completions",
+			expected: output{
+				err: ErrAPI,
+			},
+		},
+		{
+			desc:         "reports rate limits",
+			api:          ChatAPI,
+			status:       http.StatusTooManyRequests,
+			body:         `{"error":{"message":"rate limit reached"}}`,
+			expectedPath: "/v1/chat/completions",
+			expected: output{
+				err: ErrRateLimited,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var received httpRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tc.expectedPath {
+					t.Errorf("expected path '%s', got '%s'", tc.expectedPath, r.URL.Path)
+				}
+
+				if r.Header.Get("Authorization") != "Bearer token" {
+					t.Errorf("expected bearer token, got '%s'", r.Header.Get("Authorization"))
+				}
+
+				json.NewDecoder(r.Body).Decode(&received)
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			sut := NewHTTP(server.URL+"/v1/", "token", tc.api)
+			result, err := sut.Complete(context.Background(), Request{Model: "some-model", Prompt: "Hi"})
+			if err == nil && !reflect.DeepEqual(result, tc.expected.value) {
+				t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+			}
+
+			if !errors.Is(err, tc.expected.err) {
+				t.Errorf("unexpected error expected '%v', got '%v'", tc.expected.err, err)
+			}
+
+			if received.Model != "some-model" {
+				t.Errorf("expected model '%s', got '%s'", "some-model", received.Model)
+			}
+		})
+	}
+}
+
+func TestChatMessages(t *testing.T) {
+	cases := []struct {
+		desc     string
+		input    Request
+		expected []httpMessage
+	}{
+		{
+			desc:  "wraps a bare prompt",
+			input: Request{Prompt: "Hi"},
+			expected: []httpMessage{
+				{Role: RoleUser, Content: "Hi"},
+			},
+		},
+		{
+			desc: "sanitizes speaker names",
+			input: Request{
+				Prompt: "Sam TheClam: Hi\n\nBot:",
+				Messages: []Message{
+					{Role: RoleUser, Name: "Sam TheClam", Content: "Hi"},
+					{Role: RoleAssistant, Content: "Hello"},
+					{Role: RoleUser, Name: "Zoë 🦀", Content: "Hey"},
+				},
+			},
+			expected: []httpMessage{
+				{Role: RoleUser, Name: "Sam_TheClam", Content: "Hi"},
+				{Role: RoleAssistant, Content: "Hello"},
+				{Role: RoleUser, Name: "Zo", Content: "Hey"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result := chatMessages(tc.input)
+			if !reflect.DeepEqual(tc.expected, result) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestHTTP_Stream(t *testing.T) {
+	cases := []struct {
+		desc          string
+		api           API
+		events        string
+		expected      Response
+		expectedParts []string
+		expectedErr   error
+	}{
+		{
+			desc:          "streams completions api text",
+			api:           CompletionsAPI,
+			events:        "data: {\"choices\":[{\"text\":\"Hel\"}]}\n\ndata: {\"choices\":[{\"text\":\"lo\"}]}\n\ndata: [DONE]\n\n",
+			expected:      Response{Text: "Hello"},
+			expectedParts: []string{"Hel", "lo"},
+		},
+		{
+			desc:          "streams chat api deltas",
+			api:           ChatAPI,
+			events:        "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\ndata: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n",
+			expected:      Response{Text: "Hi"},
+			expectedParts: []string{"Hi"},
+		},
+		{
+			desc:        "fails on empty streams",
+			api:         ChatAPI,
+			events:      "data: [DONE]\n\n",
+			expectedErr: ErrNoChoices,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var received httpRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&received)
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Write([]byte(tc.events))
+			}))
+			defer server.Close()
+
+			parts := []string{}
+			sut := NewHTTP(server.URL, "", tc.api)
+			result, err := sut.Stream(context.Background(), Request{Model: "some-model", Prompt: "Hi"}, func(text string) {
+				parts = append(parts, text)
+			})
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("unexpected error expected '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if err == nil && !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, result)
+			}
+
+			if err == nil && !reflect.DeepEqual(parts, tc.expectedParts) {
+				t.Errorf("expected parts '%v', got '%v'", tc.expectedParts, parts)
+			}
+
+			if !received.Stream {
+				t.Errorf("expected a streaming request")
+			}
+		})
+	}
+}
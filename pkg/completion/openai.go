@@ -0,0 +1,88 @@
+package completion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/PullRequestInc/go-gpt3"
+)
+
+// OpenAI uses the legacy OpenAI completions API through go-gpt3.
+type OpenAI struct {
+	client gpt3.Client
+}
+
+func NewOpenAI(client gpt3.Client) *OpenAI {
+	return &OpenAI{client: client}
+}
+
+func gpt3Request(req Request) gpt3.CompletionRequest {
+	return gpt3.CompletionRequest{
+		Prompt:           []string{req.Prompt},
+		MaxTokens:        &req.MaxTokens,
+		Temperature:      &req.Temperature,
+		FrequencyPenalty: req.FrequencyPenalty,
+		PresencePenalty:  req.PresencePenalty,
+		TopP:             &req.TopP,
+		Stop:             req.Stop,
+	}
+}
+
+func (o *OpenAI) Complete(ctx context.Context, req Request) (Response, error) {
+	resp, err := o.client.CompletionWithEngine(ctx, req.Model, gpt3Request(req))
+	if err != nil {
+		return Response{}, gpt3Error("call gpt3 api", err)
+	}
+
+	if len(resp.Choices) == 0 {
+		return Response{}, ErrNoChoices
+	}
+
+	return Response{
+		Text: resp.Choices[0].Text,
+		Usage: Usage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+			TotalTokens:      resp.Usage.TotalTokens,
+		},
+	}, nil
+}
+
+func (o *OpenAI) Stream(ctx context.Context, req Request, onText func(string)) (Response, error) {
+	var b strings.Builder
+	err := o.client.CompletionStreamWithEngine(ctx, req.Model, gpt3Request(req), func(resp *gpt3.CompletionResponse) {
+		if len(resp.Choices) == 0 || resp.Choices[0].Text == "" {
+			return
+		}
+
+		b.WriteString(resp.Choices[0].Text)
+		onText(resp.Choices[0].Text)
+	})
+	if err != nil {
+		return Response{}, gpt3Error("stream gpt3 api", err)
+	}
+
+	if b.Len() == 0 {
+		return Response{}, ErrNoChoices
+	}
+
+	return Response{Text: b.String()}, nil
+}
+
+// gpt3Error wraps the errors returned by the API in ErrAPI or ErrRateLimited,
+// other errors such as a cancelled context are wrapped as they are.
+func gpt3Error(op string, err error) error {
+	var apiErr gpt3.APIError
+	if !errors.As(err, &apiErr) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if apiErr.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("%s: %s: %w", op, err, ErrRateLimited)
+	}
+
+	return fmt.Errorf("%s: %s: %w", op, err, ErrAPI)
+}
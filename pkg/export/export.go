@@ -0,0 +1,393 @@
+// Package export turns threads into documents people can keep: Markdown and
+// HTML to read, and a versioned JSON schema that can be restored into a
+// repository.
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"telegram-bot/pkg/thread"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+// Version is the version of the JSON schema documents are written with.
+const Version int = 1
+
+var (
+	ErrUnknownFormat      = errors.New("unknown export format")
+	ErrUnsupportedVersion = errors.New("unsupported document version")
+	ErrInvalidDocument    = errors.New("invalid document")
+	ErrExists             = errors.New("thread is already in the repository")
+	ErrForeignChat        = errors.New("message is from another chat")
+)
+
+// Format is a kind of document a thread is exported to, named after the
+// extension of its file.
+type Format string
+
+const (
+	FormatMarkdown Format = "md"
+	FormatJSON     Format = "json"
+	FormatHTML     Format = "html"
+)
+
+// Formats lists every format, the first one is the default.
+var Formats = []Format{FormatMarkdown, FormatJSON, FormatHTML}
+
+// Document is an exported thread. Its JSON encoding is the schema of JSON
+// exports, Version changes whenever the schema does.
+type Document struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	Thread   Thread    `json:"thread"`
+}
+
+type Thread struct {
+	ID       uuid.UUID       `json:"id"`
+	Settings Settings        `json:"settings"`
+	Persona  *thread.Persona `json:"persona,omitempty"`
+	Summary  *Summary        `json:"summary,omitempty"`
+	Fork     *Fork           `json:"fork,omitempty"`
+	// Root is the first message of the thread, every other message is one
+	// of its replies or a reply to them.
+	Root *Message `json:"root,omitempty"`
+}
+
+// Settings are the completion parameters and language the thread used, along
+// with the layer each comes from by the name of the setting.
+type Settings struct {
+	Model            string                   `json:"model"`
+	MaxTokens        int                      `json:"max_tokens"`
+	Temperature      float32                  `json:"temperature"`
+	FrequencyPenalty float32                  `json:"frequency_penalty"`
+	PresencePenalty  float32                  `json:"presence_penalty"`
+	TopP             float32                  `json:"top_p"`
+	Language         string                   `json:"language,omitempty"`
+	Sources          map[string]thread.Source `json:"sources,omitempty"`
+}
+
+type Summary struct {
+	Text    string     `json:"text"`
+	Through MessageRef `json:"through"`
+}
+
+// Fork is where a forked thread came from and the conversation before its
+// root.
+type Fork struct {
+	ThreadID  uuid.UUID  `json:"thread_id"`
+	MessageID MessageRef `json:"message_id"`
+	History   []Turn     `json:"history"`
+}
+
+type Turn struct {
+	ID      MessageRef  `json:"id"`
+	Role    thread.Role `json:"role"`
+	Name    string      `json:"name,omitempty"`
+	Content string      `json:"content"`
+}
+
+// MessageRef identifies a Telegram message.
+type MessageRef struct {
+	ChatID    int64 `json:"chat_id"`
+	FromID    int64 `json:"from_id"`
+	MessageID int   `json:"message_id"`
+}
+
+type Message struct {
+	ID      MessageRef `json:"id"`
+	Type    string     `json:"type"`
+	Speaker Speaker    `json:"speaker"`
+	Time    time.Time  `json:"time"`
+	Text    string     `json:"text"`
+	Replies []*Message `json:"replies,omitempty"`
+}
+
+type Speaker struct {
+	ID        int64  `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name,omitempty"`
+	UserName  string `json:"username,omitempty"`
+	IsBot     bool   `json:"is_bot,omitempty"`
+}
+
+// Name is how the speaker is shown.
+func (s Speaker) Name() string {
+	u := thread.User{FirstName: s.FirstName, LastName: s.LastName}
+	return u.DisplayName()
+}
+
+// typeNames names the message types in documents.
+var typeNames = map[thread.MessageType]string{
+	thread.TypePrompt:        "prompt",
+	thread.TypeResponse:      "response",
+	thread.TypeInformational: "informational",
+	thread.TypeCommand:       "command",
+}
+
+// Build exports t, with every branch of its tree.
+func Build(t thread.Thread, exported time.Time) Document {
+	doc := Document{
+		Version:  Version,
+		Exported: exported,
+		Thread: Thread{
+			ID:       t.ID,
+			Settings: SettingsOf(t),
+			Persona:  t.Persona,
+		},
+	}
+
+	if t.Summary.Text != "" {
+		doc.Thread.Summary = &Summary{Text: t.Summary.Text, Through: ref(t.Summary.Through)}
+	}
+
+	if f := t.Fork; f != nil {
+		fork := &Fork{ThreadID: f.ThreadID, MessageID: ref(f.MessageID), History: []Turn{}}
+		for _, turn := range f.History {
+			fork.History = append(fork.History, Turn{ID: ref(turn.ID), Role: turn.Role, Name: turn.Name, Content: turn.Content})
+		}
+
+		doc.Thread.Fork = fork
+	}
+
+	if t.Root != nil {
+		doc.Thread.Root = message(t.Root)
+	}
+
+	return doc
+}
+
+// SettingsOf returns the settings of t.
+func SettingsOf(t thread.Thread) Settings {
+	return Settings{
+		Model:            t.Settings.Model,
+		MaxTokens:        t.Settings.MaxTokens,
+		Temperature:      t.Settings.Temperature,
+		FrequencyPenalty: t.Settings.FrequencyPenalty,
+		PresencePenalty:  t.Settings.PressencePenalty,
+		TopP:             t.Settings.TopP,
+		Language:         t.Language,
+		Sources:          t.Sources,
+	}
+}
+
+func ref(id thread.MessageID) MessageRef {
+	return MessageRef{ChatID: id.ChannelID, FromID: id.FromID, MessageID: id.MessageID}
+}
+
+func (r MessageRef) id() thread.MessageID {
+	return thread.MessageID{ChannelID: r.ChatID, FromID: r.FromID, MessageID: r.MessageID}
+}
+
+func message(m *thread.Message) *Message {
+	msg := &Message{
+		ID:   ref(m.ID),
+		Type: typeNames[m.Type],
+		Speaker: Speaker{
+			ID:        m.Sender.ID,
+			FirstName: m.Sender.FirstName,
+			LastName:  m.Sender.LastName,
+			UserName:  m.Sender.UserName,
+			IsBot:     m.Sender.IsBot,
+		},
+		Time: m.Time,
+		Text: m.Text,
+	}
+
+	for _, c := range m.Children() {
+		msg.Replies = append(msg.Replies, message(c))
+	}
+
+	return msg
+}
+
+// Render writes the document in format.
+func (d Document) Render(format Format) ([]byte, error) {
+	switch format {
+	case FormatMarkdown:
+		return d.Markdown(), nil
+	case FormatJSON:
+		return json.MarshalIndent(d, "", "  ")
+	case FormatHTML:
+		return d.HTML()
+	default:
+		return nil, fmt.Errorf("'%s': %w", format, ErrUnknownFormat)
+	}
+}
+
+// Parse reads a JSON document, written by this or an earlier version.
+func Parse(data []byte) (Document, error) {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return doc, fmt.Errorf("decode document: %w", err)
+	}
+
+	if doc.Version < 1 || doc.Version > Version {
+		return doc, fmt.Errorf("version %d: %w", doc.Version, ErrUnsupportedVersion)
+	}
+
+	if doc.Thread.Root == nil {
+		return doc, fmt.Errorf("no root message: %w", ErrInvalidDocument)
+	}
+
+	var check func(m *Message) error
+	check = func(m *Message) error {
+		if _, ok := messageType(m.Type); !ok {
+			return fmt.Errorf("message type '%s': %w", m.Type, ErrInvalidDocument)
+		}
+
+		for _, r := range m.Replies {
+			if err := check(r); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return doc, check(doc.Thread.Root)
+}
+
+func messageType(name string) (thread.MessageType, bool) {
+	for t, n := range typeNames {
+		if n == name {
+			return t, true
+		}
+	}
+
+	return 0, false
+}
+
+// Parameters returns the completion parameters of s.
+func (s Settings) Parameters() thread.CompletionParameters {
+	return thread.CompletionParameters{
+		Model:            s.Model,
+		MaxTokens:        s.MaxTokens,
+		Temperature:      s.Temperature,
+		FrequencyPenalty: s.FrequencyPenalty,
+		PressencePenalty: s.PresencePenalty,
+		TopP:             s.TopP,
+	}
+}
+
+// apply sets the completion parameters, language and sources of t to s.
+func (s Settings) apply(t *thread.Thread) {
+	t.Settings = s.Parameters()
+	t.Language = s.Language
+	t.Sources = s.Sources
+}
+
+// Restore adds the messages of the document to repo as a new thread of the
+// chat chatID, with the settings of the exported one. The thread gets a new
+// ID, the messages keep theirs: every one of them must be from chatID, or
+// ErrForeignChat is returned, and none may be in repo already, or ErrExists
+// is. Nothing is added unless every message can be.
+func (d Document) Restore(repo thread.Repository, chatID int64) (thread.Thread, error) {
+	if d.Thread.Root == nil {
+		return thread.Thread{}, fmt.Errorf("no root message: %w", ErrInvalidDocument)
+	}
+
+	seen := map[thread.MessageID]bool{}
+	var check func(m *Message) error
+	check = func(m *Message) error {
+		id := m.ID.id()
+		if id.ChannelID != chatID {
+			return fmt.Errorf("message %d of chat %d: %w", id.MessageID, id.ChannelID, ErrForeignChat)
+		}
+
+		if seen[id] {
+			return fmt.Errorf("message %d twice: %w", id.MessageID, ErrInvalidDocument)
+		}
+
+		seen[id] = true
+		if _, err := repo.GetMessage(id); err == nil {
+			return fmt.Errorf("message %d: %w", id.MessageID, ErrExists)
+		}
+
+		for _, r := range m.Replies {
+			if err := check(r); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := check(d.Thread.Root); err != nil {
+		return thread.Thread{}, err
+	}
+
+	var root *thread.Message
+	var restore func(m *Message, parent *telegram.Message) error
+	restore = func(m *Message, parent *telegram.Message) error {
+		msgType, ok := messageType(m.Type)
+		if !ok {
+			return fmt.Errorf("message type '%s': %w", m.Type, ErrInvalidDocument)
+		}
+
+		source := &telegram.Message{
+			MessageID: m.ID.MessageID,
+			From: &telegram.User{
+				ID:        m.ID.FromID,
+				FirstName: m.Speaker.FirstName,
+				LastName:  m.Speaker.LastName,
+				UserName:  m.Speaker.UserName,
+				IsBot:     m.Speaker.IsBot,
+			},
+			Chat:           &telegram.Chat{ID: m.ID.ChatID},
+			Date:           int(m.Time.Unix()),
+			Text:           m.Text,
+			ReplyToMessage: parent,
+		}
+
+		added, err := repo.AddMessage(source, msgType)
+		if err != nil {
+			return fmt.Errorf("restore message %d: %w", m.ID.MessageID, err)
+		}
+
+		if root == nil {
+			root = added
+		}
+
+		for _, r := range m.Replies {
+			if err := restore(r, source); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := restore(d.Thread.Root, nil); err != nil {
+		return thread.Thread{}, err
+	}
+
+	t, err := repo.GetThread(root.ThreadID)
+	if err != nil {
+		return t, fmt.Errorf("get restored thread: %w", err)
+	}
+
+	d.Thread.Settings.apply(&t)
+	t.Persona = d.Thread.Persona
+	if sum := d.Thread.Summary; sum != nil {
+		t.Summary = thread.Summary{Text: sum.Text, Through: sum.Through.id()}
+	}
+
+	if f := d.Thread.Fork; f != nil {
+		fork := &thread.Fork{ThreadID: f.ThreadID, MessageID: f.MessageID.id(), History: []thread.Turn{}}
+		for _, turn := range f.History {
+			fork.History = append(fork.History, thread.Turn{ID: turn.ID.id(), Role: turn.Role, Name: turn.Name, Content: turn.Content})
+		}
+
+		t.Fork = fork
+	}
+
+	if err := repo.Set(t); err != nil {
+		return t, fmt.Errorf("save restored thread: %w", err)
+	}
+
+	return t, nil
+}
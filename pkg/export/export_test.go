@@ -0,0 +1,208 @@
+package export
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"telegram-bot/pkg/thread"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var exportEpoch = time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+// testThread adds a prompt with two alternative responses, one of them
+// followed up on, and returns their thread.
+func testThread(t *testing.T, repo thread.Repository) thread.Thread {
+	chat := &telegram.Chat{ID: -3}
+	user := &telegram.User{ID: 2, FirstName: "Foo", LastName: "Bar"}
+	bot := &telegram.User{ID: 1, FirstName: "Bot", IsBot: true}
+	post := func(id int, from *telegram.User, text string, replyTo *telegram.Message, messageType thread.MessageType) *telegram.Message {
+		msg := &telegram.Message{
+			MessageID:      id,
+			From:           from,
+			Chat:           chat,
+			Date:           int(exportEpoch.Add(time.Duration(id) * time.Minute).Unix()),
+			Text:           text,
+			ReplyToMessage: replyTo,
+		}
+
+		if _, err := repo.AddMessage(msg, messageType); err != nil {
+			t.Fatalf("unexpected error adding message: %v", err)
+		}
+
+		return msg
+	}
+
+	prompt := post(1, user, "Hello <b>there</b>", nil, thread.TypePrompt)
+	first := post(2, bot, "Hi", prompt, thread.TypeResponse)
+	post(3, bot, "Hello\nagain", prompt, thread.TypeResponse)
+	post(4, user, "How are you?", first, thread.TypePrompt)
+
+	root, _ := repo.GetMessage(thread.GetMessageID(prompt))
+	th, _ := repo.GetThread(root.ThreadID)
+	th.Settings.Model = "gpt-4"
+	th.Language = "French"
+	th.SetSource(thread.SourceChat, "Model", "Language")
+	th.Persona = &thread.Persona{Name: "pirate", SystemPrompt: "Talk like a pirate."}
+	repo.Set(th)
+	th, _ = repo.GetThread(root.ThreadID)
+	return th
+}
+
+func TestRender(t *testing.T) {
+	doc := Build(testThread(t, thread.NewMemoryRepository()), exportEpoch)
+	cases := []struct {
+		desc        string
+		format      Format
+		expected    []string
+		expectedErr error
+	}{
+		{
+			desc:   "nests replies in markdown",
+			format: FormatMarkdown,
+			expected: []string{
+				"| Model | gpt-4 | chat |",
+				"| TopP | 1.000000 | global |",
+				"- **Foo Bar** (prompt, 2023-04-01 12:01:00 UTC)\n\n  Hello <b>there</b>\n",
+				"  - **Bot** (response, 2023-04-01 12:03:00 UTC)\n\n    Hello\n    again\n",
+				"    - **Foo Bar** (prompt, 2023-04-01 12:04:00 UTC)",
+			},
+		},
+		{
+			desc:   "escapes html",
+			format: FormatHTML,
+			expected: []string{
+				"<tr><td>Language</td><td>French</td><td>chat</td></tr>",
+				"Hello &lt;b&gt;there&lt;/b&gt;",
+				"<strong>Bot</strong> (response, 2023-04-01 12:02:00 UTC)",
+			},
+		},
+		{
+			desc:     "writes the versioned schema",
+			format:   FormatJSON,
+			expected: []string{`"version": 1`, `"type": "response"`, `"first_name": "Foo"`},
+		},
+		{
+			desc:        "rejects unknown formats",
+			format:      "pdf",
+			expectedErr: ErrUnknownFormat,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			data, err := doc.Render(tc.format)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			for _, expected := range tc.expected {
+				if !strings.Contains(string(data), expected) {
+					t.Errorf("expected '%s' in '%s'", expected, data)
+				}
+			}
+		})
+	}
+}
+
+func TestMarkdown_Escapes(t *testing.T) {
+	doc := Build(testThread(t, thread.NewMemoryRepository()), exportEpoch)
+	doc.Thread.Settings.Language = "French | English"
+	doc.Thread.Persona.Name = "*pirate*"
+	doc.Thread.Root.Speaker.FirstName = "Foo_**"
+	data := string(doc.Markdown())
+	for _, expected := range []string{
+		"| Language | French \\| English | chat |",
+		"@\\*pirate\\*\n",
+		"- **Foo\\_\\*\\* Bar** (prompt, ",
+	} {
+		if !strings.Contains(data, expected) {
+			t.Errorf("expected '%s' in '%s'", expected, data)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		desc        string
+		data        string
+		expectedErr error
+	}{
+		{
+			desc: "reads documents of the current version",
+			data: `{"version": 1, "thread": {"root": {"type": "prompt", "replies": [{"type": "response"}]}}}`,
+		},
+		{
+			desc:        "rejects newer versions",
+			data:        `{"version": 2, "thread": {"root": {"type": "prompt"}}}`,
+			expectedErr: ErrUnsupportedVersion,
+		},
+		{
+			desc:        "rejects unknown message types",
+			data:        `{"version": 1, "thread": {"root": {"type": "prompt", "replies": [{"type": "poll"}]}}}`,
+			expectedErr: ErrInvalidDocument,
+		},
+		{
+			desc:        "rejects documents without messages",
+			data:        `{"version": 1, "thread": {}}`,
+			expectedErr: ErrInvalidDocument,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := Parse([]byte(tc.data)); !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	repo := thread.NewMemoryRepository()
+	original := Build(testThread(t, repo), exportEpoch)
+	data, err := original.Render(FormatJSON)
+	if err != nil {
+		t.Fatalf("unexpected error rendering: %v", err)
+	}
+
+	doc, err := Parse(data)
+	if err != nil {
+		t.Fatalf("unexpected error parsing: %v", err)
+	}
+
+	if _, err := doc.Restore(repo, -3); !errors.Is(err, ErrExists) {
+		t.Errorf("expected error '%v' restoring into the same repository, got '%v'", ErrExists, err)
+	}
+
+	if _, err := doc.Restore(thread.NewMemoryRepository(), -4); !errors.Is(err, ErrForeignChat) {
+		t.Errorf("expected error '%v' restoring into another chat, got '%v'", ErrForeignChat, err)
+	}
+
+	// Only the last reply collides, nothing of the thread may be added.
+	partial := thread.NewMemoryRepository()
+	last := doc.Thread.Root.Replies[0].Replies[0]
+	partial.AddMessage(&telegram.Message{MessageID: last.ID.MessageID, From: &telegram.User{ID: last.ID.FromID}, Chat: &telegram.Chat{ID: -3}}, thread.TypePrompt)
+	if _, err := doc.Restore(partial, -3); !errors.Is(err, ErrExists) {
+		t.Errorf("expected error '%v' restoring over a reply, got '%v'", ErrExists, err)
+	}
+
+	if _, err := partial.GetMessage(doc.Thread.Root.ID.id()); !errors.Is(err, thread.ErrNotFound) {
+		t.Errorf("expected nothing to be restored, got '%v'", err)
+	}
+
+	restored, err := doc.Restore(thread.NewMemoryRepository(), -3)
+	if err != nil {
+		t.Fatalf("unexpected error restoring: %v", err)
+	}
+
+	again := Build(restored, exportEpoch)
+	again.Thread.ID = original.Thread.ID
+	result, _ := again.Render(FormatJSON)
+	if !bytes.Equal(result, data) {
+		t.Errorf("expected '%s', got '%s'", data, result)
+	}
+}
@@ -0,0 +1,198 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"telegram-bot/pkg/settings"
+	"telegram-bot/pkg/thread"
+	"time"
+)
+
+// TimeLayout is how timestamps are shown in Markdown and HTML documents.
+const TimeLayout string = "2006-01-02 15:04:05 MST"
+
+// Setting is a row of the settings table of a document.
+type Setting struct {
+	Key    string
+	Value  string
+	Source thread.Source
+}
+
+// SettingRows lists every setting of the thread along with the layer it
+// comes from, formatted and ordered the way /settings and /dump show them.
+func (d Document) SettingRows() []Setting {
+	t := thread.Thread{Persona: d.Thread.Persona}
+	d.Thread.Settings.apply(&t)
+	rows := []Setting{}
+	for _, key := range settings.Keys {
+		rows = append(rows, Setting{Key: key, Value: settings.Value(t, key), Source: t.Source(key)})
+	}
+
+	return rows
+}
+
+// Markdown writes the document as Markdown, the replies to a message are
+// nested in a list below it.
+func (d Document) Markdown() []byte {
+	var b strings.Builder
+	t := d.Thread
+	b.WriteString(fmt.Sprintf("# Thread %s\n\n", t.ID))
+	b.WriteString(fmt.Sprintf("Exported %s\n\n", d.Exported.UTC().Format(TimeLayout)))
+	b.WriteString("## Settings\n\n")
+	b.WriteString("| Setting | Value | Source |\n")
+	b.WriteString("| --- | --- | --- |\n")
+	for _, row := range d.SettingRows() {
+		b.WriteString(fmt.Sprintf("| %s | %s | %s |\n", escapeMarkdown(row.Key), escapeMarkdown(row.Value), escapeMarkdown(string(row.Source))))
+	}
+
+	if p := t.Persona; p != nil {
+		b.WriteString("\n## Persona\n\n")
+		b.WriteString(fmt.Sprintf("@%s\n\n", escapeMarkdown(p.Name)))
+		b.WriteString(quoteMarkdown(p.SystemPrompt))
+	}
+
+	if s := t.Summary; s != nil {
+		b.WriteString("\n## Summary\n\n")
+		b.WriteString(quoteMarkdown(s.Text))
+	}
+
+	if f := t.Fork; f != nil {
+		b.WriteString("\n## Forked from\n\n")
+		b.WriteString(fmt.Sprintf("Thread %s, at message %d.\n\n", f.ThreadID, f.MessageID.MessageID))
+		for _, turn := range f.History {
+			name := turn.Name
+			if turn.Role == thread.RoleAssistant {
+				name = "Bot"
+			}
+
+			b.WriteString(fmt.Sprintf("- **%s** (%s)\n\n", escapeMarkdown(name), turn.Role))
+			b.WriteString(indent(turn.Content, "  ") + "\n")
+		}
+	}
+
+	b.WriteString("\n## Conversation\n\n")
+	if t.Root != nil {
+		writeMarkdown(&b, t.Root, "")
+	}
+
+	return []byte(b.String())
+}
+
+func writeMarkdown(b *strings.Builder, m *Message, prefix string) {
+	b.WriteString(fmt.Sprintf("%s- **%s** (%s, %s)\n\n", prefix, escapeMarkdown(m.Speaker.Name()), m.Type, m.Time.UTC().Format(TimeLayout)))
+	if m.Text != "" {
+		b.WriteString(indent(m.Text, prefix+"  ") + "\n")
+	}
+
+	for _, r := range m.Replies {
+		writeMarkdown(b, r, prefix+"  ")
+	}
+}
+
+// indent prefixes every line of text, ending with a blank line.
+func indent(text string, prefix string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// markdownEscaper escapes the characters that would start emphasis, links,
+// headings, HTML or table cells, and joins lines so a value stays on one.
+var markdownEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"`", "\\`",
+	"*", "\\*",
+	"_", "\\_",
+	"~", "\\~",
+	"[", "\\[",
+	"]", "\\]",
+	"<", "\\<",
+	">", "\\>",
+	"#", "\\#",
+	"|", "\\|",
+	"\n", " ",
+)
+
+// escapeMarkdown makes text show as is in a table cell or a bold span.
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+func quoteMarkdown(text string) string {
+	return indent(text, "> ")
+}
+
+var htmlTemplate = template.Must(template.New("thread").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format(TimeLayout) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Thread {{.Thread.ID}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: auto; }
+ul { list-style: none; padding-left: 1.5em; border-left: 1px solid #ccc; }
+.meta { color: #666; font-size: 0.9em; }
+.text { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Thread {{.Thread.ID}}</h1>
+<p class="meta">Exported {{time .Exported}}</p>
+<h2>Settings</h2>
+<table>
+<tr><th>Setting</th><th>Value</th><th>Source</th></tr>
+{{- range .SettingRows}}
+<tr><td>{{.Key}}</td><td>{{.Value}}</td><td>{{.Source}}</td></tr>
+{{- end}}
+</table>
+{{- with .Thread.Persona}}
+<h2>Persona</h2>
+<p>@{{.Name}}</p>
+<blockquote class="text">{{.SystemPrompt}}</blockquote>
+{{- end}}
+{{- with .Thread.Summary}}
+<h2>Summary</h2>
+<blockquote class="text">{{.Text}}</blockquote>
+{{- end}}
+{{- with .Thread.Fork}}
+<h2>Forked from</h2>
+<p>Thread {{.ThreadID}}, at message {{.MessageID.MessageID}}.</p>
+<ul>
+{{- range .History}}
+<li><p class="meta"><strong>{{if eq .Role "assistant"}}Bot{{else}}{{.Name}}{{end}}</strong> ({{.Role}})</p><p class="text">{{.Content}}</p></li>
+{{- end}}
+</ul>
+{{- end}}
+<h2>Conversation</h2>
+{{- with .Thread.Root}}
+<ul>{{template "message" .}}</ul>
+{{- end}}
+</body>
+</html>
+{{define "message"}}
+<li><p class="meta"><strong>{{.Speaker.Name}}</strong> ({{.Type}}, {{time .Time}})</p>
+{{- if .Text}}<p class="text">{{.Text}}</p>{{end}}
+{{- if .Replies}}
+<ul>{{range .Replies}}{{template "message" .}}{{end}}</ul>
+{{- end}}
+</li>
+{{- end}}`))
+
+// HTML writes the document as a standalone HTML page, the replies to a
+// message are nested in a list below it.
+func (d Document) HTML() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := htmlTemplate.Execute(&buf, d); err != nil {
+		return nil, fmt.Errorf("render html: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
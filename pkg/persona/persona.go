@@ -0,0 +1,168 @@
+package persona
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"telegram-bot/pkg/storage"
+)
+
+var (
+	ErrNotFound    = errors.New("persona not found")
+	ErrInvalidName = errors.New("invalid persona name")
+)
+
+// Persona is a character the bot plays in a thread.
+type Persona struct {
+	// Name is how the persona is mentioned, as in "/prompt @pirate".
+	Name string `json:"name"`
+	// DisplayName is the name the bot goes by in the conversation, the
+	// bot's own name when empty.
+	DisplayName  string `json:"display_name,omitempty"`
+	SystemPrompt string `json:"system_prompt"`
+	// Model is the preferred model, the thread keeps its model when empty.
+	Model string `json:"model,omitempty"`
+	// Params are completion parameters in /tweak syntax, applied to the
+	// threads taking on the persona.
+	Params string `json:"params,omitempty"`
+}
+
+var nameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// ValidateName checks that name can be mentioned: up to 32 lower case
+// letters, digits, dashes and underscores.
+func ValidateName(name string) error {
+	if !nameRegex.MatchString(name) {
+		return fmt.Errorf("'%s': %w", name, ErrInvalidName)
+	}
+
+	return nil
+}
+
+// Mention splits a leading "@name" off text, ok is false when text doesn't
+// start with a mention.
+func Mention(text string) (name string, rest string, ok bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "@") {
+		return "", text, false
+	}
+
+	name, rest, _ = strings.Cut(text[1:], " ")
+	if name == "" {
+		return "", text, false
+	}
+
+	return strings.ToLower(name), strings.TrimSpace(rest), true
+}
+
+// Store persists the personas of a library.
+type Store interface {
+	Load() (map[string]Persona, error)
+	Save(map[string]Persona) error
+	Close() error
+}
+
+// Library holds the saved personas by name.
+type Library struct {
+	personas map[string]Persona
+	store    Store
+
+	mu sync.Mutex
+}
+
+// NewLibrary restores the personas kept in store, a nil store keeps them in
+// memory only.
+func NewLibrary(store Store) (*Library, error) {
+	l := &Library{personas: map[string]Persona{}, store: store}
+	if store == nil {
+		return l, nil
+	}
+
+	personas, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load personas: %w", err)
+	}
+
+	for name, p := range personas {
+		l.personas[name] = p
+	}
+
+	return l, nil
+}
+
+// Get returns the persona called name.
+func (l *Library) Get(name string) (Persona, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.personas[strings.ToLower(name)]
+	if !ok {
+		return p, fmt.Errorf("'%s': %w", name, ErrNotFound)
+	}
+
+	return p, nil
+}
+
+// List returns every persona sorted by name.
+func (l *Library) List() []Persona {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	personas := make([]Persona, 0, len(l.personas))
+	for _, p := range l.personas {
+		personas = append(personas, p)
+	}
+
+	sort.Slice(personas, func(i, j int) bool { return personas[i].Name < personas[j].Name })
+	return personas
+}
+
+// Save adds p to the library, replacing the persona of the same name.
+func (l *Library) Save(p Persona) error {
+	if err := ValidateName(p.Name); err != nil {
+		return err
+	}
+
+	return l.update(func(personas map[string]Persona) error {
+		personas[p.Name] = p
+		return nil
+	})
+}
+
+// Delete removes the persona called name.
+func (l *Library) Delete(name string) error {
+	return l.update(func(personas map[string]Persona) error {
+		if _, ok := personas[name]; !ok {
+			return fmt.Errorf("'%s': %w", name, ErrNotFound)
+		}
+
+		delete(personas, name)
+		return nil
+	})
+}
+
+// update changes the library under the lock, change refuses a change by
+// returning an error.
+func (l *Library) update(change func(map[string]Persona) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return storage.Update[map[string]Persona](&l.personas, l.store, "personas", clonePersonas, change)
+}
+
+func clonePersonas(personas map[string]Persona) map[string]Persona {
+	c := make(map[string]Persona, len(personas))
+	for name, p := range personas {
+		c[name] = p
+	}
+
+	return c
+}
+
+func (l *Library) Close() error {
+	if l.store == nil {
+		return nil
+	}
+
+	return l.store.Close()
+}
@@ -0,0 +1,154 @@
+package persona
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"telegram-bot/pkg/storage"
+	"testing"
+)
+
+// stores lists every Store implementation, each is reopened from the same
+// path to check that the personas survive a restart.
+var stores = []struct {
+	name string
+	open func(t *testing.T, path string) (Store, error)
+}{
+	{
+		name: "file",
+		open: func(_ *testing.T, path string) (Store, error) {
+			return NewFileStore(path), nil
+		},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T, path string) (Store, error) {
+			db, err := storage.OpenSQLite(path)
+			if err != nil {
+				return nil, err
+			}
+
+			t.Cleanup(func() { db.Close() })
+			return NewSQLStore(db)
+		},
+	},
+}
+
+func TestMention(t *testing.T) {
+	cases := []struct {
+		desc         string
+		text         string
+		expectedName string
+		expectedRest string
+		expectedOK   bool
+	}{
+		{
+			desc:         "splits off the mention",
+			text:         "@Pirate Where is the treasure?",
+			expectedName: "pirate",
+			expectedRest: "Where is the treasure?",
+			expectedOK:   true,
+		},
+		{
+			desc:         "accepts a mention alone",
+			text:         "@pirate",
+			expectedName: "pirate",
+			expectedOK:   true,
+		},
+		{
+			desc:         "ignores text without a mention",
+			text:         "Where is the treasure?",
+			expectedRest: "Where is the treasure?",
+		},
+		{
+			desc:         "ignores a lone at sign",
+			text:         "@ sea",
+			expectedRest: "@ sea",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			name, rest, ok := Mention(tc.text)
+			if name != tc.expectedName || rest != tc.expectedRest || ok != tc.expectedOK {
+				t.Errorf("expected '%s' '%s' '%v', got '%s' '%s' '%v'", tc.expectedName, tc.expectedRest, tc.expectedOK, name, rest, ok)
+			}
+		})
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	l, err := NewLibrary(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := l.Save(Persona{Name: "Pirate"}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected error '%v', got '%v'", ErrInvalidName, err)
+	}
+
+	pirate := Persona{Name: "pirate", DisplayName: "Captain", SystemPrompt: "Talk like a pirate."}
+	l.Save(pirate)
+	if p, err := l.Get("Pirate"); err != nil || p != pirate {
+		t.Errorf("expected '%v', got '%v' '%v'", pirate, p, err)
+	}
+
+	if err := l.Delete("pirate"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := l.Get("pirate"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected error '%v', got '%v'", ErrNotFound, err)
+	}
+
+	if err := l.Delete("pirate"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected error '%v', got '%v'", ErrNotFound, err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	personas := []Persona{
+		{Name: "chef", SystemPrompt: "You are a chef.", Model: "gpt-4"},
+		{Name: "pirate", DisplayName: "Captain", SystemPrompt: "Talk like a pirate.", Params: "Temperature=0.9"},
+	}
+
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "personas")
+			store, err := s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error opening store: %v", err)
+			}
+
+			l, err := NewLibrary(store)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, p := range personas {
+				if err := l.Save(p); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			l.Save(Persona{Name: "gone"})
+			l.Delete("gone")
+			l.Close()
+
+			store, err = s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error reopening store: %v", err)
+			}
+
+			l, err = NewLibrary(store)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			defer l.Close()
+			if list := l.List(); !reflect.DeepEqual(list, personas) {
+				t.Errorf("expected '%v', got '%v'", personas, list)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package persona
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"telegram-bot/pkg/storage"
+)
+
+// FileStore keeps the personas in a JSON file, which is replaced atomically
+// on every change.
+type FileStore = storage.FileStore[map[string]Persona]
+
+func NewFileStore(path string) *FileStore {
+	return storage.NewFileStore[map[string]Persona](path, "persona")
+}
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS personas (
+	name TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+`
+
+// SQLStore keeps the personas in a table of a SQL database, such as the one
+// threads are stored in.
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, fmt.Errorf("migrate persona schema: %w", err)
+	}
+
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Load() (map[string]Persona, error) {
+	rows, err := s.db.Query(`SELECT name, data FROM personas`)
+	if err != nil {
+		return nil, fmt.Errorf("query personas: %w", err)
+	}
+
+	defer rows.Close()
+	personas := map[string]Persona{}
+	for rows.Next() {
+		var name, data string
+		if err := rows.Scan(&name, &data); err != nil {
+			return nil, fmt.Errorf("scan persona: %w", err)
+		}
+
+		var p Persona
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			return nil, fmt.Errorf("decode persona %s: %w", name, err)
+		}
+
+		personas[name] = p
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query personas: %w", err)
+	}
+
+	return personas, nil
+}
+
+func (s *SQLStore) Save(personas map[string]Persona) error {
+	return storage.ReplaceAll(s.db, "personas", []string{"personas"}, func(tx *sql.Tx) error {
+		for name, p := range personas {
+			data, err := json.Marshal(p)
+			if err != nil {
+				return fmt.Errorf("encode persona %s: %w", name, err)
+			}
+
+			if _, err := tx.Exec(`INSERT INTO personas (name, data) VALUES (?, ?)`, name, string(data)); err != nil {
+				return fmt.Errorf("save persona %s: %w", name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close keeps the database open for the threads and the other stores
+// sharing it.
+func (s *SQLStore) Close() error {
+	return nil
+}
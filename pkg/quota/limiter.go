@@ -0,0 +1,120 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidRate = errors.New("invalid rate")
+
+// maxBuckets is how many buckets a limiter keeps before dropping the full
+// ones, which behave the same as a new bucket.
+const maxBuckets = 4096
+
+// Rate allows Burst requests at once, refilled evenly over Per.
+type Rate struct {
+	Burst int
+	Per   time.Duration
+}
+
+// ParseRate parses a rate such as "10/1m", "0" turns limiting off.
+func ParseRate(s string) (Rate, error) {
+	if strings.TrimSpace(s) == "0" {
+		return Rate{}, nil
+	}
+
+	burst, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("'%s': %w", s, ErrInvalidRate)
+	}
+
+	var r Rate
+	var err error
+	if r.Burst, err = strconv.Atoi(strings.TrimSpace(burst)); err != nil || r.Burst < 0 {
+		return Rate{}, fmt.Errorf("'%s': %w", s, ErrInvalidRate)
+	}
+
+	if r.Per, err = time.ParseDuration(strings.TrimSpace(per)); err != nil || r.Per <= 0 {
+		return Rate{}, fmt.Errorf("'%s': %w", s, ErrInvalidRate)
+	}
+
+	return r, nil
+}
+
+// Unlimited reports whether the rate lets every request through.
+func (r Rate) Unlimited() bool {
+	return r.Burst == 0
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket rate limiter keeping a bucket for every key.
+type Limiter struct {
+	rate    Rate
+	buckets map[string]*bucket
+	now     func() time.Time
+
+	mu sync.Mutex
+}
+
+func NewLimiter(rate Rate) *Limiter {
+	return &Limiter{rate: rate, buckets: map[string]*bucket{}, now: time.Now}
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	perToken := l.rate.Per / time.Duration(l.rate.Burst)
+	b.tokens += float64(now.Sub(b.last)) / float64(perToken)
+	if b.tokens > float64(l.rate.Burst) {
+		b.tokens = float64(l.rate.Burst)
+	}
+
+	b.last = now
+}
+
+// Allow takes a token from the bucket of key. When the bucket is empty it
+// returns false along with how long until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.rate.Unlimited() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		l.prune(now)
+		b = &bucket{tokens: float64(l.rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	perToken := l.rate.Per / time.Duration(l.rate.Burst)
+	return false, time.Duration((1 - b.tokens) * float64(perToken))
+}
+
+func (l *Limiter) prune(now time.Time) {
+	if len(l.buckets) < maxBuckets {
+		return
+	}
+
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.rate.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("token quota exceeded")
+
+// Subject is what a quota is counted against.
+type Subject string
+
+const (
+	SubjectUser Subject = "user"
+	SubjectChat Subject = "chat"
+)
+
+// Period is the time span a quota covers, periods start at midnight UTC.
+type Period string
+
+const (
+	Daily   Period = "daily"
+	Monthly Period = "monthly"
+)
+
+// key identifies the period containing t, e.g. "2023-04-01" for a day.
+func (p Period) key(t time.Time) string {
+	if p == Monthly {
+		return t.UTC().Format("2006-01")
+	}
+
+	return t.UTC().Format("2006-01-02")
+}
+
+// end returns when the period containing t ends.
+func (p Period) end(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	if p == Monthly {
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// Limits are the tokens that can be used per period, 0 means unlimited.
+type Limits struct {
+	Daily   int
+	Monthly int
+}
+
+func (l Limits) of(p Period) int {
+	if p == Monthly {
+		return l.Monthly
+	}
+
+	return l.Daily
+}
+
+// Status is the use of a single quota.
+type Status struct {
+	Subject Subject
+	Period  Period
+	Used    int
+	Limit   int
+	Resets  time.Time
+}
+
+// Remaining returns the tokens left, -1 if the quota is unlimited.
+func (s Status) Remaining() int {
+	if s.Limit == 0 {
+		return -1
+	}
+
+	if s.Used >= s.Limit {
+		return 0
+	}
+
+	return s.Limit - s.Used
+}
+
+// ExceededError tells which quota has been used up and when it resets.
+type ExceededError struct {
+	Status
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s %s quota of %d tokens used until %s", e.Subject, e.Period, e.Limit, e.Resets.Format(time.RFC3339))
+}
+
+func (e *ExceededError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// Store keeps the tokens used by a subject in a period.
+type Store interface {
+	Used(subject Subject, id int64, period string) (int, error)
+	Add(subject Subject, id int64, period string, tokens int) error
+	Close() error
+}
+
+// Quotas limits the tokens users and chats use per day and month. In private
+// chats only the user's quota applies.
+type Quotas struct {
+	User  Limits
+	Chat  Limits
+	store Store
+	now   func() time.Time
+}
+
+func New(store Store, user, chat Limits) *Quotas {
+	return &Quotas{User: user, Chat: chat, store: store, now: time.Now}
+}
+
+type subjectID struct {
+	subject Subject
+	id      int64
+	limits  Limits
+}
+
+func (q *Quotas) subjects(chatID, userID int64) []subjectID {
+	subjects := []subjectID{{SubjectUser, userID, q.User}}
+	if chatID != userID {
+		subjects = append(subjects, subjectID{SubjectChat, chatID, q.Chat})
+	}
+
+	return subjects
+}
+
+// Report returns the use of every quota userID is subject to in chatID.
+func (q *Quotas) Report(chatID, userID int64) ([]Status, error) {
+	now := q.now()
+	var report []Status
+	for _, s := range q.subjects(chatID, userID) {
+		for _, p := range []Period{Daily, Monthly} {
+			used, err := q.store.Used(s.subject, s.id, p.key(now))
+			if err != nil {
+				return nil, fmt.Errorf("read %s %s quota: %w", s.subject, p, err)
+			}
+
+			report = append(report, Status{
+				Subject: s.subject,
+				Period:  p,
+				Used:    used,
+				Limit:   s.limits.of(p),
+				Resets:  p.end(now),
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// Check returns an *ExceededError if userID or chatID used up a quota.
+func (q *Quotas) Check(chatID, userID int64) error {
+	report, err := q.Report(chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range report {
+		if s.Remaining() == 0 {
+			return &ExceededError{s}
+		}
+	}
+
+	return nil
+}
+
+// Add counts tokens against the quotas of userID and chatID.
+func (q *Quotas) Add(chatID, userID int64, tokens int) error {
+	now := q.now()
+	for _, s := range q.subjects(chatID, userID) {
+		for _, p := range []Period{Daily, Monthly} {
+			if err := q.store.Add(s.subject, s.id, p.key(now), tokens); err != nil {
+				return fmt.Errorf("add to %s %s quota: %w", s.subject, p, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (q *Quotas) Close() error {
+	return q.store.Close()
+}
@@ -0,0 +1,170 @@
+package quota
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"telegram-bot/pkg/storage"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := []struct {
+		desc        string
+		rate        string
+		expected    Rate
+		expectedErr error
+	}{
+		{
+			desc:     "parses requests per duration",
+			rate:     "10/1m",
+			expected: Rate{Burst: 10, Per: time.Minute},
+		},
+		{
+			desc:     "turns limiting off",
+			rate:     "0",
+			expected: Rate{},
+		},
+		{
+			desc:        "rejects rates without a duration",
+			rate:        "10",
+			expectedErr: ErrInvalidRate,
+		},
+		{
+			desc:        "rejects negative rates",
+			rate:        "-1/1m",
+			expectedErr: ErrInvalidRate,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rate, err := ParseRate(tc.rate)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if rate != tc.expected {
+				t.Errorf("expected '%v', got '%v'", tc.expected, rate)
+			}
+		})
+	}
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(Rate{Burst: 2, Per: time.Minute})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("expected request %d within the burst to be allowed", i)
+		}
+	}
+
+	ok, wait := l.Allow("a")
+	if ok || wait != 30*time.Second {
+		t.Errorf("expected to wait 30s, got '%v' '%v'", ok, wait)
+	}
+
+	if ok, _ := l.Allow("b"); !ok {
+		t.Errorf("expected other keys to have their own bucket")
+	}
+
+	now = now.Add(30 * time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("expected the bucket to refill")
+	}
+}
+
+// stores lists every Store implementation, each is reopened from the same
+// path to check that the usage survives a restart.
+var stores = []struct {
+	name string
+	open func(t *testing.T, path string) (Store, error)
+}{
+	{
+		name: "file",
+		open: func(_ *testing.T, path string) (Store, error) {
+			return OpenFileStore(path)
+		},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T, path string) (Store, error) {
+			db, err := storage.OpenSQLite(path)
+			if err != nil {
+				return nil, err
+			}
+
+			t.Cleanup(func() { db.Close() })
+			return NewSQLStore(db)
+		},
+	},
+}
+
+func TestQuotas(t *testing.T) {
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "quota")
+			store, err := s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error opening store: %v", err)
+			}
+
+			now := time.Date(2023, 4, 30, 12, 0, 0, 0, time.UTC)
+			q := New(store, Limits{Daily: 100, Monthly: 150}, Limits{Daily: 1000})
+			q.now = func() time.Time { return now }
+			if err := q.Add(-3, 2, 100); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var exceeded *ExceededError
+			if err := q.Check(-3, 2); !errors.As(err, &exceeded) || exceeded.Period != Daily || !exceeded.Resets.Equal(time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("expected the daily quota to be exceeded, got '%v'", err)
+			}
+
+			q.Close()
+			store, err = s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error reopening store: %v", err)
+			}
+
+			q = New(store, Limits{Daily: 100, Monthly: 150}, Limits{Daily: 1000})
+			defer q.Close()
+			now = now.Add(24 * time.Hour)
+			q.now = func() time.Time { return now }
+			if err := q.Check(-3, 2); err != nil {
+				t.Errorf("expected the quotas to reset, got '%v'", err)
+			}
+
+			q.Add(-3, 2, 10)
+			report, err := q.Report(-3, 2)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			may := time.Date(2023, 5, 2, 0, 0, 0, 0, time.UTC)
+			june := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+			expected := []Status{
+				{Subject: SubjectUser, Period: Daily, Used: 10, Limit: 100, Resets: may},
+				{Subject: SubjectUser, Period: Monthly, Used: 10, Limit: 150, Resets: june},
+				{Subject: SubjectChat, Period: Daily, Used: 10, Limit: 1000, Resets: may},
+				{Subject: SubjectChat, Period: Monthly, Used: 10, Limit: 0, Resets: june},
+			}
+
+			if !reflect.DeepEqual(report, expected) {
+				t.Errorf("expected '%v', got '%v'", expected, report)
+			}
+		})
+	}
+}
+
+func TestQuotas_PrivateChats(t *testing.T) {
+	q := New(NewMemoryStore(), Limits{}, Limits{Daily: 10})
+	q.Add(2, 2, 100)
+	if err := q.Check(2, 2); err != nil {
+		t.Errorf("expected only the user's quota to apply in private chats, got '%v'", err)
+	}
+}
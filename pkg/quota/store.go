@@ -0,0 +1,153 @@
+package quota
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"telegram-bot/pkg/storage"
+)
+
+// MemoryStore keeps the tokens used in memory. When opened with a path it is
+// also written to a JSON file on every change, so it survives a restart.
+type MemoryStore struct {
+	file *storage.FileStore[map[string]map[string]int]
+	// used maps "subject:id" to the tokens used per period.
+	used map[string]map[string]int
+
+	mu sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{used: map[string]map[string]int{}}
+}
+
+// OpenFileStore returns a memory store backed by the file at path, restoring
+// the usage already recorded in it.
+func OpenFileStore(path string) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	s.file = storage.NewFileStore[map[string]map[string]int](path, "quota")
+	used, err := s.file.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if used != nil {
+		s.used = used
+	}
+
+	return s, nil
+}
+
+func storeKey(subject Subject, id int64) string {
+	return fmt.Sprintf("%s:%d", subject, id)
+}
+
+func (s *MemoryStore) Used(subject Subject, id int64, period string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used[storeKey(subject, id)][period], nil
+}
+
+func (s *MemoryStore) Add(subject Subject, id int64, period string, tokens int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := storeKey(subject, id)
+	periods, ok := s.used[key]
+	if !ok {
+		periods = map[string]int{}
+		s.used[key] = periods
+	}
+
+	// Periods of the same kind have keys of the same length, the ones
+	// before period are over and no longer needed.
+	for p := range periods {
+		if len(p) == len(period) && p != period {
+			delete(periods, p)
+		}
+	}
+
+	periods[period] += tokens
+	return s.save()
+}
+
+// save replaces the file with the current usage.
+func (s *MemoryStore) save() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Save(s.used)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS quota_usage (
+	subject TEXT NOT NULL,
+	id      INTEGER NOT NULL,
+	period  TEXT NOT NULL,
+	tokens  INTEGER NOT NULL,
+	PRIMARY KEY (subject, id, period)
+);
+`
+
+// SQLStore keeps the tokens used in a SQL database, such as the one threads
+// are stored in.
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, fmt.Errorf("migrate quota schema: %w", err)
+	}
+
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Used(subject Subject, id int64, period string) (int, error) {
+	var tokens int
+	err := s.db.QueryRow(
+		`SELECT tokens FROM quota_usage WHERE subject = ? AND id = ? AND period = ?`,
+		string(subject), id, period,
+	).Scan(&tokens)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("query quota usage: %w", err)
+	}
+
+	return tokens, nil
+}
+
+func (s *SQLStore) Add(subject Subject, id int64, period string, tokens int) error {
+	_, err := s.db.Exec(
+		`DELETE FROM quota_usage WHERE subject = ? AND id = ? AND length(period) = length(?) AND period <> ?`,
+		string(subject), id, period, period,
+	)
+	if err != nil {
+		return fmt.Errorf("delete past quota usage: %w", err)
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO quota_usage (subject, id, period, tokens) VALUES (?, ?, ?, ?)
+		ON CONFLICT (subject, id, period) DO UPDATE SET tokens = tokens + excluded.tokens`,
+		string(subject), id, period, tokens,
+	)
+	if err != nil {
+		return fmt.Errorf("save quota usage: %w", err)
+	}
+
+	return nil
+}
+
+// Close leaves the database to be closed by its owner, the tokens used are
+// written as they are added.
+func (s *SQLStore) Close() error {
+	return nil
+}
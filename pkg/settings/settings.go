@@ -0,0 +1,206 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"telegram-bot/pkg/storage"
+	"telegram-bot/pkg/thread"
+)
+
+// The keys of the settings a chat can default.
+const (
+	KeyModel            = "Model"
+	KeyMaxTokens        = "MaxTokens"
+	KeyTemperature      = "Temperature"
+	KeyFrequencyPenalty = "FrequencyPenalty"
+	KeyPressencePenalty = "PressencePenalty"
+	KeyTopP             = "TopP"
+	KeyPersona          = "Persona"
+	KeyLanguage         = "Language"
+)
+
+// Keys lists every key in the order settings are shown.
+var Keys = []string{
+	KeyModel,
+	KeyMaxTokens,
+	KeyTemperature,
+	KeyFrequencyPenalty,
+	KeyPressencePenalty,
+	KeyTopP,
+	KeyPersona,
+	KeyLanguage,
+}
+
+var ErrUnknownKey = errors.New("unknown setting")
+
+// IsKey reports whether key is one of Keys.
+func IsKey(key string) bool {
+	for _, k := range Keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Value formats the value of the setting key of t, the way /settings, /dump
+// and exports show it.
+func Value(t thread.Thread, key string) string {
+	switch key {
+	case KeyModel:
+		return t.Settings.Model
+	case KeyMaxTokens:
+		return fmt.Sprintf("%d", t.Settings.MaxTokens)
+	case KeyTemperature:
+		return fmt.Sprintf("%f", t.Settings.Temperature)
+	case KeyFrequencyPenalty:
+		return fmt.Sprintf("%f", t.Settings.FrequencyPenalty)
+	case KeyPressencePenalty:
+		return fmt.Sprintf("%f", t.Settings.PressencePenalty)
+	case KeyTopP:
+		return fmt.Sprintf("%f", t.Settings.TopP)
+	case KeyPersona:
+		if t.Persona == nil {
+			return "none"
+		}
+
+		return "@" + t.Persona.Name
+	case KeyLanguage:
+		if t.Language == "" {
+			return "any"
+		}
+
+		return t.Language
+	}
+
+	return ""
+}
+
+// Defaults holds the values a chat set, by key. Keys without a value fall
+// back to the global configuration.
+type Defaults map[string]string
+
+func (d Defaults) copy() Defaults {
+	c := Defaults{}
+	for key, val := range d {
+		c[key] = val
+	}
+
+	return c
+}
+
+// Store persists the defaults of every chat.
+type Store interface {
+	Load() (map[int64]Defaults, error)
+	Save(map[int64]Defaults) error
+	Close() error
+}
+
+// Chats holds the defaults of every chat.
+type Chats struct {
+	defaults map[int64]Defaults
+	store    Store
+
+	mu sync.Mutex
+}
+
+// New restores the defaults kept in store, a nil store keeps them in memory
+// only.
+func New(store Store) (*Chats, error) {
+	c := &Chats{defaults: map[int64]Defaults{}, store: store}
+	if store == nil {
+		return c, nil
+	}
+
+	defaults, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load chat settings: %w", err)
+	}
+
+	for chatID, d := range defaults {
+		c.defaults[chatID] = d.copy()
+	}
+
+	return c, nil
+}
+
+// Get returns a copy of the defaults of chatID.
+func (c *Chats) Get(chatID int64) Defaults {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.defaults[chatID].copy()
+}
+
+// Set sets the values of d as defaults of chatID, keeping the others.
+func (c *Chats) Set(chatID int64, d Defaults) error {
+	for key := range d {
+		if !IsKey(key) {
+			return fmt.Errorf("'%s': %w", key, ErrUnknownKey)
+		}
+	}
+
+	return c.update(chatID, func(current Defaults) {
+		for key, val := range d {
+			current[key] = val
+		}
+	})
+}
+
+// Reset removes the defaults of chatID for keys, or every one of them when
+// no keys are given.
+func (c *Chats) Reset(chatID int64, keys ...string) error {
+	for _, key := range keys {
+		if !IsKey(key) {
+			return fmt.Errorf("'%s': %w", key, ErrUnknownKey)
+		}
+	}
+
+	return c.update(chatID, func(current Defaults) {
+		if len(keys) == 0 {
+			for key := range current {
+				delete(current, key)
+			}
+		}
+
+		for _, key := range keys {
+			delete(current, key)
+		}
+	})
+}
+
+// update changes the defaults of chatID under the lock, a chat left without
+// defaults is dropped.
+func (c *Chats) update(chatID int64, change func(Defaults)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return storage.Update[map[int64]Defaults](&c.defaults, c.store, "chat settings", cloneChats, func(next map[int64]Defaults) error {
+		d := next[chatID].copy()
+		change(d)
+		if len(d) == 0 {
+			delete(next, chatID)
+		} else {
+			next[chatID] = d
+		}
+
+		return nil
+	})
+}
+
+func cloneChats(defaults map[int64]Defaults) map[int64]Defaults {
+	c := make(map[int64]Defaults, len(defaults))
+	for id, d := range defaults {
+		c[id] = d
+	}
+
+	return c
+}
+
+func (c *Chats) Close() error {
+	if c.store == nil {
+		return nil
+	}
+
+	return c.store.Close()
+}
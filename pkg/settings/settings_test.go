@@ -0,0 +1,107 @@
+package settings
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"telegram-bot/pkg/storage"
+	"testing"
+)
+
+// stores lists every Store implementation, each is reopened from the same
+// path to check that the defaults survive a restart.
+var stores = []struct {
+	name string
+	open func(t *testing.T, path string) (Store, error)
+}{
+	{
+		name: "file",
+		open: func(_ *testing.T, path string) (Store, error) {
+			return NewFileStore(path), nil
+		},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T, path string) (Store, error) {
+			db, err := storage.OpenSQLite(path)
+			if err != nil {
+				return nil, err
+			}
+
+			t.Cleanup(func() { db.Close() })
+			return NewSQLStore(db)
+		},
+	},
+}
+
+func TestChats(t *testing.T) {
+	c, err := New(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := c.Set(-3, Defaults{"Colour": "blue"}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected error '%v', got '%v'", ErrUnknownKey, err)
+	}
+
+	c.Set(-3, Defaults{KeyModel: "gpt-4", KeyLanguage: "French"})
+	c.Set(-3, Defaults{KeyLanguage: "German"})
+	expected := Defaults{KeyModel: "gpt-4", KeyLanguage: "German"}
+	if d := c.Get(-3); !reflect.DeepEqual(d, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, d)
+	}
+
+	c.Get(-3)[KeyModel] = "changed"
+	c.Reset(-3, KeyLanguage)
+	expected = Defaults{KeyModel: "gpt-4"}
+	if d := c.Get(-3); !reflect.DeepEqual(d, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, d)
+	}
+
+	c.Reset(-3)
+	if d := c.Get(-3); len(d) != 0 {
+		t.Errorf("expected no defaults, got '%v'", d)
+	}
+}
+
+func TestStores(t *testing.T) {
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "settings")
+			store, err := s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error opening store: %v", err)
+			}
+
+			c, err := New(store)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			c.Set(-3, Defaults{KeyModel: "gpt-4", KeyTemperature: "0.9"})
+			c.Set(2, Defaults{KeyPersona: "pirate"})
+			c.Reset(2)
+			c.Close()
+
+			store, err = s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error reopening store: %v", err)
+			}
+
+			c, err = New(store)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			defer c.Close()
+			expected := Defaults{KeyModel: "gpt-4", KeyTemperature: "0.9"}
+			if d := c.Get(-3); !reflect.DeepEqual(d, expected) {
+				t.Errorf("expected '%v', got '%v'", expected, d)
+			}
+
+			if d := c.Get(2); len(d) != 0 {
+				t.Errorf("expected the reset defaults to be gone, got '%v'", d)
+			}
+		})
+	}
+}
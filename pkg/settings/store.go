@@ -0,0 +1,87 @@
+package settings
+
+import (
+	"database/sql"
+	"fmt"
+	"telegram-bot/pkg/storage"
+)
+
+// FileStore keeps the chat defaults in a JSON file, which is replaced
+// atomically on every change.
+type FileStore = storage.FileStore[map[int64]Defaults]
+
+func NewFileStore(path string) *FileStore {
+	return storage.NewFileStore[map[int64]Defaults](path, "settings")
+}
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS chat_settings (
+	chat_id INTEGER NOT NULL,
+	key     TEXT NOT NULL,
+	value   TEXT NOT NULL,
+	PRIMARY KEY (chat_id, key)
+);
+`
+
+// SQLStore keeps the chat defaults in a table of a SQL database, such as the
+// one threads are stored in.
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, fmt.Errorf("migrate settings schema: %w", err)
+	}
+
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Load() (map[int64]Defaults, error) {
+	rows, err := s.db.Query(`SELECT chat_id, key, value FROM chat_settings`)
+	if err != nil {
+		return nil, fmt.Errorf("query chat settings: %w", err)
+	}
+
+	defer rows.Close()
+	defaults := map[int64]Defaults{}
+	for rows.Next() {
+		var chatID int64
+		var key, value string
+		if err := rows.Scan(&chatID, &key, &value); err != nil {
+			return nil, fmt.Errorf("scan chat setting: %w", err)
+		}
+
+		if defaults[chatID] == nil {
+			defaults[chatID] = Defaults{}
+		}
+
+		defaults[chatID][key] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query chat settings: %w", err)
+	}
+
+	return defaults, nil
+}
+
+func (s *SQLStore) Save(defaults map[int64]Defaults) error {
+	return storage.ReplaceAll(s.db, "chat settings", []string{"chat_settings"}, func(tx *sql.Tx) error {
+		for chatID, d := range defaults {
+			for key, value := range d {
+				if _, err := tx.Exec(`INSERT INTO chat_settings (chat_id, key, value) VALUES (?, ?, ?)`, chatID, key, value); err != nil {
+					return fmt.Errorf("save setting %s of chat %d: %w", key, chatID, err)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close keeps the database open, the chat defaults share it with the
+// threads.
+func (s *SQLStore) Close() error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// FileStore keeps a value in a JSON file, which is replaced atomically on
+// every save.
+type FileStore[T any] struct {
+	path string
+	// what names the value in errors.
+	what string
+}
+
+func NewFileStore[T any](path string, what string) *FileStore[T] {
+	return &FileStore[T]{path: path, what: what}
+}
+
+// Load returns the value saved last, or the zero value of T when nothing was
+// saved yet.
+func (f *FileStore[T]) Load() (T, error) {
+	var v T
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+
+	if err != nil {
+		return v, fmt.Errorf("read %s file: %w", f.what, err)
+	}
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("decode %s file: %w", f.what, err)
+	}
+
+	return v, nil
+}
+
+// Save writes v to a temporary file which then replaces the file, so a crash
+// leaves either the old or the new value behind.
+func (f *FileStore[T]) Save(v T) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", f.what, err)
+	}
+
+	if err := os.WriteFile(f.path+".tmp", data, 0o600); err != nil {
+		return fmt.Errorf("write %s file: %w", f.what, err)
+	}
+
+	if err := os.Rename(f.path+".tmp", f.path); err != nil {
+		return fmt.Errorf("replace %s file: %w", f.what, err)
+	}
+
+	return nil
+}
+
+func (f *FileStore[T]) Close() error {
+	return nil
+}
@@ -0,0 +1,56 @@
+// Package storage opens the databases the bot keeps its state in.
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// BusyTimeout is how long a write waits for another connection to release
+// the database before giving up.
+const BusyTimeout time.Duration = 5 * time.Second
+
+// OpenSQLite opens the SQLite database at path for handlers writing to it at
+// the same time. Writers queue for the lock for up to BusyTimeout instead of
+// failing with SQLITE_BUSY, transactions take the lock as they begin so two of
+// them can't deadlock upgrading from a read, and the write-ahead log lets
+// readers carry on during a write.
+func OpenSQLite(path string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_txlock=immediate", path, BusyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+
+	return db, nil
+}
+
+// ReplaceAll deletes every row of tables and adds those insert writes, in one
+// transaction so readers see either the old or the new rows. Errors are
+// prefixed by what.
+func ReplaceAll(db *sql.DB, what string, tables []string, insert func(*sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin %s transaction: %w", what, err)
+	}
+
+	defer tx.Rollback()
+	for _, table := range tables {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return fmt.Errorf("clear %s: %w", table, err)
+		}
+	}
+
+	if err := insert(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit %s: %w", what, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package storage
+
+import "fmt"
+
+// Saver stores a value as a whole, replacing what it stored before.
+type Saver[T any] interface {
+	Save(T) error
+}
+
+// Update hands change a copy of *current made by clone and saves the copy to
+// store, *current is only replaced once the save succeeded so memory never
+// gets ahead of the store. A nil store keeps the value in memory alone. The
+// errors of change are returned as they are, those of store are prefixed by
+// what. Callers hold the lock guarding current.
+func Update[T any](current *T, store Saver[T], what string, clone func(T) T, change func(T) error) error {
+	next := clone(*current)
+	if err := change(next); err != nil {
+		return err
+	}
+
+	if store != nil {
+		if err := store.Save(next); err != nil {
+			return fmt.Errorf("save %s: %w", what, err)
+		}
+	}
+
+	*current = next
+	return nil
+}
@@ -0,0 +1,175 @@
+package summary
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/thread"
+	"telegram-bot/pkg/tokens"
+	"telegram-bot/pkg/usage"
+)
+
+const (
+	DefaultThreshold int = 20
+	DefaultKeep      int = 6
+	MaxSummaryTokens int = 300
+)
+
+const instructions string = "You keep a running summary of a group conversation with an AI assistant. " +
+	"Combine the existing summary with the new messages into one concise summary. " +
+	"Keep the names of the participants, facts they shared and any rules or instructions they set up."
+
+// Summarizer compresses the older turns of long threads into a summary that
+// is sent in their place.
+type Summarizer struct {
+	Provider completion.Provider
+	// Threshold is the number of turns following the summary that triggers
+	// a new summary, zero disables summarization.
+	Threshold int
+	// Keep is the number of most recent turns left out of the summary.
+	Keep int
+}
+
+// pending returns the index of the first turn the summary doesn't cover.
+func pending(s thread.Summary, turns []thread.Turn) int {
+	if s.Text == "" {
+		return 0
+	}
+
+	for i, t := range turns {
+		if t.ID == s.Through {
+			return i + 1
+		}
+	}
+
+	// The summary was made for another branch of the thread.
+	return 0
+}
+
+// Summarize updates the summary of t once more than Threshold turns of the
+// conversation are not covered by it. It reports whether the summary changed
+// and how many tokens the completions writing it used. Turns that don't fit
+// into one request along with the summary so far are condensed in several,
+// each extending the summary of the one before.
+func (s *Summarizer) Summarize(ctx context.Context, t *thread.Thread, turns []thread.Turn) (bool, int, error) {
+	if s == nil || s.Threshold <= 0 {
+		return false, 0, nil
+	}
+
+	start := pending(t.Summary, turns)
+	end := len(turns) - s.Keep
+	if len(turns)-start < s.Threshold || end <= start {
+		return false, 0, nil
+	}
+
+	previous := ""
+	if start > 0 {
+		previous = t.Summary.Text
+	}
+
+	budget := tokens.Budget(t.Settings.Model, MaxSummaryTokens)
+	updated, used := false, 0
+	for start < end {
+		batch := fitBatch(previous, turns[start:end], budget)
+		req := buildRequest(t.Settings.Model, buildPrompt(previous, batch))
+		resp, err := s.Provider.Complete(ctx, req)
+		if err != nil {
+			return updated, used, fmt.Errorf("summarize thread: %w", err)
+		}
+
+		used += usage.Of(req, resp).TotalTokens
+		start += len(batch)
+		previous = strings.TrimSpace(resp.Text)
+		t.Summary = thread.Summary{Text: previous, Through: turns[start-1].ID}
+		updated = true
+	}
+
+	return updated, used, nil
+}
+
+func buildRequest(model string, prompt string) completion.Request {
+	return completion.Request{
+		Model:  model,
+		Prompt: instructions + "\n\n" + prompt + "\n\nSummary:",
+		Messages: []completion.Message{
+			{Role: completion.RoleSystem, Content: instructions},
+			{Role: completion.RoleUser, Content: prompt},
+		},
+		MaxTokens:   MaxSummaryTokens,
+		Temperature: 0,
+		TopP:        1,
+	}
+}
+
+// promptTokens estimates the tokens of a request summarizing turns.
+func promptTokens(previous string, turns []thread.Turn) int {
+	return tokens.Count([]thread.Turn{
+		{Role: thread.RoleSystem, Content: instructions},
+		{Role: thread.RoleUser, Content: buildPrompt(previous, turns)},
+	})
+}
+
+// fitBatch returns the oldest turns that fit into a request of budget tokens
+// along with the summary so far. At least one turn is returned, the start of
+// its content is cut off when it doesn't fit on its own.
+func fitBatch(previous string, turns []thread.Turn, budget int) []thread.Turn {
+	used := promptTokens(previous, nil)
+	for i, t := range turns {
+		used += tokens.Estimate(line(t))
+		if used <= budget {
+			continue
+		}
+
+		if i > 0 {
+			return turns[:i]
+		}
+
+		first, _ := tokens.Fit(turns[:1], budget-promptTokens(previous, nil))
+		return first
+	}
+
+	return turns
+}
+
+func line(t thread.Turn) string {
+	name := t.Name
+	if t.Role == thread.RoleAssistant {
+		name = "Assistant"
+	}
+
+	return fmt.Sprintf("%s: %s\n", name, t.Content)
+}
+
+func buildPrompt(previous string, turns []thread.Turn) string {
+	var b strings.Builder
+	if previous != "" {
+		b.WriteString("Existing summary:\n")
+		b.WriteString(previous)
+		b.WriteString("\n\n")
+	}
+
+	b.WriteString("New messages:\n")
+	for _, t := range turns {
+		b.WriteString(line(t))
+	}
+
+	return b.String()
+}
+
+// Split separates the turns covered by the summary from the rest of the
+// conversation. The covered turns are replaced by a single system turn holding
+// the summary, head is empty when the summary doesn't apply to turns.
+func Split(s thread.Summary, turns []thread.Turn) (head []thread.Turn, rest []thread.Turn) {
+	start := pending(s, turns)
+	if start == 0 {
+		return []thread.Turn{}, turns
+	}
+
+	head = []thread.Turn{{
+		Role:    thread.RoleSystem,
+		Content: "Summary of the conversation so far: " + s.Text,
+	}}
+
+	return head, turns[start:]
+}
@@ -0,0 +1,176 @@
+package summary
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/thread"
+	"telegram-bot/pkg/tokens"
+	"testing"
+)
+
+func testTurns(n int) []thread.Turn {
+	turns := []thread.Turn{}
+	for i := 1; i <= n; i++ {
+		turns = append(turns, thread.Turn{
+			ID:      thread.MessageID{MessageID: i},
+			Role:    thread.RoleUser,
+			Name:    "Foo",
+			Content: "Some message",
+		})
+	}
+
+	return turns
+}
+
+func TestSummarizer_Summarize(t *testing.T) {
+	cases := []struct {
+		desc            string
+		turns           []thread.Turn
+		existing        thread.Summary
+		expected        thread.Summary
+		expectedUpdated bool
+	}{
+		{
+			desc:            "leaves short threads alone",
+			turns:           testTurns(3),
+			expected:        thread.Summary{},
+			expectedUpdated: false,
+		},
+		{
+			desc:            "summarizes all but the most recent turns",
+			turns:           testTurns(4),
+			expected:        thread.Summary{Text: "A summary", Through: thread.MessageID{MessageID: 3}},
+			expectedUpdated: true,
+		},
+		{
+			desc:            "waits for enough turns after the summary",
+			turns:           testTurns(5),
+			existing:        thread.Summary{Text: "Old summary", Through: thread.MessageID{MessageID: 3}},
+			expected:        thread.Summary{Text: "Old summary", Through: thread.MessageID{MessageID: 3}},
+			expectedUpdated: false,
+		},
+		{
+			desc:            "extends an existing summary",
+			turns:           testTurns(7),
+			existing:        thread.Summary{Text: "Old summary", Through: thread.MessageID{MessageID: 3}},
+			expected:        thread.Summary{Text: "A summary", Through: thread.MessageID{MessageID: 6}},
+			expectedUpdated: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sut := &Summarizer{
+				Provider:  completion.NewFake(" A summary "),
+				Threshold: 4,
+				Keep:      1,
+			}
+			currentThread := thread.Thread{Summary: tc.existing}
+			updated, used, err := sut.Summarize(context.Background(), &currentThread, tc.turns)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if updated != tc.expectedUpdated {
+				t.Errorf("expected updated '%v', got '%v'", tc.expectedUpdated, updated)
+			}
+
+			if (used > 0) != tc.expectedUpdated {
+				t.Errorf("expected tokens to be used only by updates, got %d", used)
+			}
+
+			if currentThread.Summary != tc.expected {
+				t.Errorf("expected '%v', got '%v'", tc.expected, currentThread.Summary)
+			}
+		})
+	}
+}
+
+func TestSummarizer_OversizedHistory(t *testing.T) {
+	turns := testTurns(12)
+	for i := range turns {
+		turns[i].Content = strings.Repeat("Tell me everything about the history of Rome. ", 40)
+	}
+
+	// A single turn too long for any request.
+	turns[5].Content = strings.Repeat("And then? ", 2000)
+	summaries := []string{"First", "Second", "Third", "Fourth", "Fifth", "Sixth", "Seventh", "Eighth", "Ninth", "Tenth", "Eleventh"}
+	provider := completion.NewFake(summaries...)
+	sut := &Summarizer{Provider: provider, Threshold: 4, Keep: 1}
+	currentThread := thread.Thread{Settings: thread.CompletionParameters{Model: "text-curie-001"}}
+	updated, _, err := sut.Summarize(context.Background(), &currentThread, turns)
+	if err != nil || !updated {
+		t.Fatalf("expected the summary to be updated, got '%v' '%v'", updated, err)
+	}
+
+	if len(provider.Requests) < 3 {
+		t.Fatalf("expected the history to be summarized in several requests, got %d", len(provider.Requests))
+	}
+
+	budget := tokens.Budget("text-curie-001", MaxSummaryTokens)
+	for i, req := range provider.Requests {
+		msgs := []thread.Turn{}
+		for _, m := range req.Messages {
+			msgs = append(msgs, thread.Turn{Role: thread.Role(m.Role), Content: m.Content})
+		}
+
+		if used := tokens.Count(msgs); used > budget {
+			t.Errorf("expected request %d to fit in %d tokens, got %d", i, budget, used)
+		}
+	}
+
+	if second := provider.Requests[1].Messages[1].Content; !strings.HasPrefix(second, "Existing summary:\nFirst\n") {
+		t.Errorf("expected each request to extend the summary of the one before, got '%s'", second)
+	}
+
+	expected := thread.Summary{Text: summaries[len(provider.Requests)-1], Through: turns[10].ID}
+	if currentThread.Summary != expected {
+		t.Errorf("expected '%v', got '%v'", expected, currentThread.Summary)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	turns := testTurns(3)
+	cases := []struct {
+		desc         string
+		summary      thread.Summary
+		expectedHead []thread.Turn
+		expectedRest []thread.Turn
+	}{
+		{
+			desc:         "keeps everything without a summary",
+			summary:      thread.Summary{},
+			expectedHead: []thread.Turn{},
+			expectedRest: turns,
+		},
+		{
+			desc:    "replaces summarized turns",
+			summary: thread.Summary{Text: "A summary", Through: thread.MessageID{MessageID: 2}},
+			expectedHead: []thread.Turn{
+				{Role: thread.RoleSystem, Content: "Summary of the conversation so far: A summary"},
+			},
+			expectedRest: turns[2:],
+		},
+		{
+			desc:         "ignores summaries of other branches",
+			summary:      thread.Summary{Text: "A summary", Through: thread.MessageID{MessageID: 42}},
+			expectedHead: []thread.Turn{},
+			expectedRest: turns,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			head, rest := Split(tc.summary, turns)
+			if !reflect.DeepEqual(tc.expectedHead, head) {
+				t.Errorf("expected '%v', got '%v'", tc.expectedHead, head)
+			}
+
+			if !reflect.DeepEqual(tc.expectedRest, rest) {
+				t.Errorf("expected '%v', got '%v'", tc.expectedRest, rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,477 @@
+// Package telegramtest provides an in-process fake of the Telegram Bot API for
+// tests. It records every call made to it, answers them the way Telegram would
+// and hands injected updates to clients polling getUpdates.
+package telegramtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// PollInterval is the longest a getUpdates call is held open waiting for
+// updates, kept short so polling clients notice they were stopped quickly.
+const PollInterval time.Duration = 50 * time.Millisecond
+
+var ErrTimeout = errors.New("timed out waiting for calls")
+
+// Bot is the user the fake answers getMe with.
+var Bot = telegram.User{ID: 1, IsBot: true, FirstName: "Bot", UserName: "test_bot"}
+
+// Call is a request made to the fake.
+type Call struct {
+	Method string
+	Params url.Values
+	// Message is the message the call was answered with, if any.
+	Message *telegram.Message
+	// Files are the files uploaded with the call, by the name of their
+	// parameter.
+	Files map[string]File
+}
+
+// File is a file uploaded to the server.
+type File struct {
+	Name string
+	Data []byte
+}
+
+type messageKey struct {
+	chatID    int64
+	messageID int
+}
+
+// Server is a fake Bot API server. Create it with NewServer and point a bot at
+// it with telegram.NewBotAPIWithAPIEndpoint and Endpoint.
+type Server struct {
+	URL string
+
+	server   *httptest.Server
+	calls    []Call
+	updates  []telegram.Update
+	messages map[messageKey]telegram.Message
+	// files holds the documents sent to or by the fake, by file ID.
+	files         map[string]File
+	nextUpdateID  int
+	nextMessageID int
+	nextFileID    int
+	// polling is set while a getUpdates call is held open, Telegram
+	// answers a second one with a conflict.
+	polling bool
+	// admins holds the IDs of the administrators of each chat.
+	admins map[int64]map[int64]bool
+	// changed is closed and replaced whenever a call is recorded or an
+	// update injected.
+	changed chan struct{}
+
+	mu sync.Mutex
+}
+
+func NewServer() *Server {
+	s := &Server{
+		messages:      map[messageKey]telegram.Message{},
+		files:         map[string]File{},
+		admins:        map[int64]map[int64]bool{},
+		nextUpdateID:  1,
+		nextMessageID: 1000,
+		changed:       make(chan struct{}),
+	}
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Endpoint is the API endpoint format of the fake, as expected by
+// telegram.NewBotAPIWithAPIEndpoint.
+func (s *Server) Endpoint() string {
+	return s.URL + "/bot%s/%s"
+}
+
+// FileEndpoint is the file download endpoint format of the fake, in the
+// format of telegram.FileEndpoint.
+func (s *Server) FileEndpoint() string {
+	return s.URL + "/file/bot%s/%s"
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// notifyLocked wakes everyone waiting for a change.
+func (s *Server) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) newMessageLocked(chatID int64, from telegram.User, text string, replyTo int) telegram.Message {
+	s.nextMessageID++
+	msg := telegram.Message{
+		MessageID: s.nextMessageID,
+		From:      &from,
+		Chat:      &telegram.Chat{ID: chatID, Type: "group"},
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+
+	if parent, ok := s.messages[messageKey{chatID, replyTo}]; ok {
+		// Telegram doesn't nest replies any further.
+		parent.ReplyToMessage = nil
+		msg.ReplyToMessage = &parent
+	}
+
+	if strings.HasPrefix(text, "/") {
+		length := strings.IndexAny(text, " \n")
+		if length < 0 {
+			length = len(text)
+		}
+
+		msg.Entities = []telegram.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+
+	s.messages[messageKey{chatID, msg.MessageID}] = msg
+	return msg
+}
+
+// SetChatAdmins makes the users administrators of the chat, everyone else is
+// a plain member.
+func (s *Server) SetChatAdmins(chatID int64, userIDs ...int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.admins[chatID] = map[int64]bool{}
+	for _, id := range userIDs {
+		s.admins[chatID][id] = true
+	}
+}
+
+// Inject queues update for the next getUpdates call and returns it with its
+// update ID set.
+func (s *Server) Inject(update telegram.Update) telegram.Update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update.UpdateID = s.nextUpdateID
+	s.nextUpdateID++
+	s.updates = append(s.updates, update)
+	s.notifyLocked()
+	return update
+}
+
+// Post injects a message from a user to chatID, replying to replyTo when it
+// isn't nil. Text starting with a slash is marked as a command.
+func (s *Server) Post(chatID int64, from telegram.User, text string, replyTo *telegram.Message) telegram.Message {
+	replyToID := 0
+	if replyTo != nil {
+		replyToID = replyTo.MessageID
+	}
+
+	s.mu.Lock()
+	msg := s.newMessageLocked(chatID, from, text, replyToID)
+	s.mu.Unlock()
+
+	s.Inject(telegram.Update{Message: &msg})
+	return msg
+}
+
+// PostDocument injects a message from a user to chatID carrying file as a
+// document, replying to replyTo when it isn't nil.
+func (s *Server) PostDocument(chatID int64, from telegram.User, file File, replyTo *telegram.Message) telegram.Message {
+	replyToID := 0
+	if replyTo != nil {
+		replyToID = replyTo.MessageID
+	}
+
+	s.mu.Lock()
+	msg := s.newMessageLocked(chatID, from, "", replyToID)
+	msg.Document = s.storeFileLocked(file)
+	s.messages[messageKey{chatID, msg.MessageID}] = msg
+	s.mu.Unlock()
+
+	s.Inject(telegram.Update{Message: &msg})
+	return msg
+}
+
+// storeFileLocked keeps file so it can be downloaded, and returns the document
+// Telegram would describe it with.
+func (s *Server) storeFileLocked(file File) *telegram.Document {
+	s.nextFileID++
+	id := fmt.Sprintf("file-%d", s.nextFileID)
+	s.files[id] = file
+	return &telegram.Document{FileID: id, FileUniqueID: id, FileName: file.Name, FileSize: len(file.Data)}
+}
+
+// Press injects a press by a user of the inline button carrying data, on the
+// message with messageID.
+func (s *Server) Press(chatID int64, from telegram.User, messageID int, data string) telegram.Update {
+	s.mu.Lock()
+	msg, ok := s.messages[messageKey{chatID, messageID}]
+	if !ok {
+		msg = telegram.Message{MessageID: messageID, From: &Bot, Chat: &telegram.Chat{ID: chatID, Type: "group"}}
+	}
+
+	query := &telegram.CallbackQuery{ID: strconv.Itoa(s.nextUpdateID), From: &from, Message: &msg, Data: data}
+	s.mu.Unlock()
+
+	return s.Inject(telegram.Update{CallbackQuery: query})
+}
+
+// Pending returns the updates that weren't confirmed yet.
+func (s *Server) Pending() []telegram.Update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]telegram.Update{}, s.updates...)
+}
+
+// Calls returns the calls made to method, or all calls when method is empty.
+func (s *Server) Calls(method string) []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := []Call{}
+	for _, c := range s.calls {
+		if method == "" || c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+
+	return calls
+}
+
+func (s *Server) texts(method string) []string {
+	texts := []string{}
+	for _, c := range s.Calls(method) {
+		texts = append(texts, c.Params.Get("text"))
+	}
+
+	return texts
+}
+
+// Sent returns the text of every message sent, oldest first.
+func (s *Server) Sent() []string {
+	return s.texts("sendMessage")
+}
+
+// Edits returns the text of every message edit, oldest first.
+func (s *Server) Edits() []string {
+	return s.texts("editMessageText")
+}
+
+// Message returns a message sent to or by the fake.
+func (s *Server) Message(chatID int64, messageID int) (telegram.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.messages[messageKey{chatID, messageID}]
+	return msg, ok
+}
+
+// WaitFor blocks until at least n calls were made to method and returns them.
+func (s *Server) WaitFor(method string, n int, timeout time.Duration) ([]Call, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+
+		calls := s.Calls(method)
+		if len(calls) >= n {
+			return calls, nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return calls, fmt.Errorf("%d of %d '%s' calls: %w", len(calls), n, method, ErrTimeout)
+		}
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(1 << 20)
+	if strings.HasPrefix(r.URL.Path, "/file/") {
+		s.serveFile(w, r)
+		return
+	}
+
+	method := path.Base(r.URL.Path)
+	if method == "getUpdates" {
+		s.mu.Lock()
+		conflict := s.polling
+		s.polling = true
+		s.mu.Unlock()
+		if conflict {
+			s.writeError(w, http.StatusConflict, "Conflict: terminated by other getUpdates request; make sure that only one bot instance is running")
+			return
+		}
+
+		updates := s.getUpdates(r.Form)
+		s.mu.Lock()
+		s.polling = false
+		s.mu.Unlock()
+		s.writeResult(w, updates)
+		return
+	}
+
+	files := map[string]File{}
+	if r.MultipartForm != nil {
+		for name, headers := range r.MultipartForm.File {
+			f, err := headers[0].Open()
+			if err != nil {
+				continue
+			}
+
+			data, _ := io.ReadAll(f)
+			f.Close()
+			files[name] = File{Name: headers[0].Filename, Data: data}
+		}
+	}
+
+	s.mu.Lock()
+	call := Call{Method: method, Params: r.Form, Files: files}
+	result := s.answerLocked(method, r.Form, files)
+	if msg, ok := result.(telegram.Message); ok {
+		call.Message = &msg
+	}
+
+	s.calls = append(s.calls, call)
+	s.notifyLocked()
+	s.mu.Unlock()
+
+	s.writeResult(w, result)
+}
+
+// answerLocked returns the result Telegram would answer a call with.
+func (s *Server) answerLocked(method string, params url.Values, files map[string]File) any {
+	chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+	messageID, _ := strconv.Atoi(params.Get("message_id"))
+	switch method {
+	case "getMe":
+		return Bot
+	case "sendMessage":
+		replyTo, _ := strconv.Atoi(params.Get("reply_to_message_id"))
+		return s.newMessageLocked(chatID, Bot, params.Get("text"), replyTo)
+	case "sendDocument":
+		replyTo, _ := strconv.Atoi(params.Get("reply_to_message_id"))
+		msg := s.newMessageLocked(chatID, Bot, "", replyTo)
+		msg.Caption = params.Get("caption")
+		if file, ok := files["document"]; ok {
+			msg.Document = s.storeFileLocked(file)
+		} else {
+			msg.Document = &telegram.Document{FileID: params.Get("document")}
+		}
+
+		s.messages[messageKey{chatID, msg.MessageID}] = msg
+		return msg
+	case "getFile":
+		id := params.Get("file_id")
+		file, ok := s.files[id]
+		if !ok {
+			return nil
+		}
+
+		return telegram.File{FileID: id, FileUniqueID: id, FileSize: len(file.Data), FilePath: "documents/" + id}
+	case "getChatMember":
+		userID, _ := strconv.ParseInt(params.Get("user_id"), 10, 64)
+		member := telegram.ChatMember{User: &telegram.User{ID: userID}, Status: "member"}
+		if s.admins[chatID][userID] {
+			member.Status = "administrator"
+		}
+
+		return member
+	case "editMessageText", "editMessageReplyMarkup":
+		msg, ok := s.messages[messageKey{chatID, messageID}]
+		if !ok {
+			msg = telegram.Message{MessageID: messageID, From: &Bot, Chat: &telegram.Chat{ID: chatID}}
+		}
+
+		if method == "editMessageText" {
+			msg.Text = params.Get("text")
+		}
+
+		if markup := params.Get("reply_markup"); markup != "" {
+			msg.ReplyMarkup = &telegram.InlineKeyboardMarkup{}
+			json.Unmarshal([]byte(markup), msg.ReplyMarkup)
+		}
+
+		msg.EditDate = int(time.Now().Unix())
+		s.messages[messageKey{chatID, messageID}] = msg
+		return msg
+	}
+
+	return true
+}
+
+// getUpdates confirms the updates before offset and answers with the ones
+// from offset on, waiting up to PollInterval for one to be injected when there
+// are none.
+func (s *Server) getUpdates(params url.Values) []telegram.Update {
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	limit, _ := strconv.Atoi(params.Get("limit"))
+	wait := time.After(PollInterval)
+	for {
+		s.mu.Lock()
+		updates := []telegram.Update{}
+		for _, u := range s.updates {
+			if u.UpdateID >= offset {
+				updates = append(updates, u)
+			}
+		}
+
+		s.updates = updates
+		if limit > 0 && len(updates) > limit {
+			updates = updates[:limit]
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(updates) > 0 {
+			return updates
+		}
+
+		select {
+		case <-changed:
+		case <-wait:
+			return updates
+		}
+	}
+}
+
+// serveFile answers the download of a file, named by the last element of the
+// path.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	id := path.Base(r.URL.Path)
+	s.mu.Lock()
+	file, ok := s.files[id]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Write(file.Data)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(telegram.APIResponse{Ok: false, ErrorCode: code, Description: description})
+}
+
+func (s *Server) writeResult(w http.ResponseWriter, result any) {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(telegram.APIResponse{Ok: true, Result: raw})
+}
@@ -0,0 +1,131 @@
+package thread
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// journal is an append-only log of repository changes, one JSON record per
+// line. Replaying it from the start rebuilds the repository state.
+type journal struct {
+	path string
+	file *os.File
+	enc  *json.Encoder
+
+	mu sync.Mutex
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+
+	return &journal{
+		path: path,
+		file: f,
+		enc:  json.NewEncoder(f),
+	}, nil
+}
+
+func (j *journal) append(rec record) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.enc.Encode(rec); err != nil {
+		return fmt.Errorf("write journal record: %w", err)
+	}
+
+	return nil
+}
+
+func (j *journal) replay(apply func(record) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("rewind journal: %w", err)
+	}
+
+	dec := json.NewDecoder(j.file)
+	for {
+		var rec record
+		offset := dec.InputOffset()
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A crash can leave a partially written last record behind, drop
+			// it so new records are not appended onto the torn line.
+			if err := j.file.Truncate(offset); err != nil {
+				return fmt.Errorf("truncate torn journal record: %w", err)
+			}
+
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("read journal record: %w", err)
+		}
+
+		if err := apply(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// rewrite atomically replaces the journal with recs.
+func (j *journal) rewrite(recs []record) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	tmp, err := os.OpenFile(j.path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("create journal: %w", err)
+	}
+
+	enc := json.NewEncoder(tmp)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write journal record: %w", err)
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync journal: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close journal: %w", err)
+	}
+
+	if err := os.Rename(j.path+".tmp", j.path); err != nil {
+		return fmt.Errorf("replace journal: %w", err)
+	}
+
+	f, err := os.OpenFile(j.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("reopen journal: %w", err)
+	}
+
+	j.file.Close()
+	j.file = f
+	j.enc = json.NewEncoder(f)
+	return nil
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return fmt.Errorf("sync journal: %w", err)
+	}
+
+	return j.file.Close()
+}
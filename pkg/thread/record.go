@@ -0,0 +1,154 @@
+package thread
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type recordKind string
+
+const (
+	recordThread  recordKind = "thread"
+	recordMessage recordKind = "message"
+	recordEvict   recordKind = "evict"
+	recordDetach  recordKind = "detach"
+)
+
+type record struct {
+	Kind    recordKind     `json:"kind"`
+	Thread  *threadRecord  `json:"thread,omitempty"`
+	Message *messageRecord `json:"message,omitempty"`
+	Evict   *evictRecord   `json:"evict,omitempty"`
+	Detach  *MessageID     `json:"detach,omitempty"`
+}
+
+type evictRecord struct {
+	ThreadID *uuid.UUID  `json:"thread_id,omitempty"`
+	Messages []MessageID `json:"messages"`
+	// Detached are the tombstones of detached messages, kept when the journal
+	// is compacted.
+	Detached []MessageID `json:"detached,omitempty"`
+}
+
+type threadRecord struct {
+	ID       uuid.UUID            `json:"id"`
+	RootID   *MessageID           `json:"root_id,omitempty"`
+	Settings CompletionParameters `json:"settings"`
+	Summary  Summary              `json:"summary"`
+	Persona  *Persona             `json:"persona,omitempty"`
+	Language string               `json:"language,omitempty"`
+	Sources  map[string]Source    `json:"sources,omitempty"`
+	Selected map[int]MessageID    `json:"selected,omitempty"`
+	Fork     *Fork                `json:"fork,omitempty"`
+}
+
+type messageRecord struct {
+	ID       MessageID   `json:"id"`
+	ParentID *MessageID  `json:"parent_id,omitempty"`
+	Type     MessageType `json:"type"`
+	ThreadID uuid.UUID   `json:"thread_id"`
+	Sender   User        `json:"sender"`
+	Text     string      `json:"text"`
+	Time     time.Time   `json:"time"`
+}
+
+func newThreadRecord(t Thread) record {
+	r := threadRecord{
+		ID:       t.ID,
+		Settings: t.Settings,
+		Summary:  t.Summary,
+		Persona:  t.Persona,
+		Language: t.Language,
+		Sources:  t.Sources,
+		Selected: t.Selected,
+		Fork:     t.Fork,
+	}
+
+	if t.Root != nil {
+		id := t.Root.ID
+		r.RootID = &id
+	}
+
+	return record{Kind: recordThread, Thread: &r}
+}
+
+func newMessageRecord(m *Message) record {
+	r := messageRecord{
+		ID:       m.ID,
+		Type:     m.Type,
+		ThreadID: m.ThreadID,
+		Sender:   m.Sender,
+		Text:     m.Text,
+		Time:     m.Time,
+	}
+
+	if m.parent != nil {
+		id := m.parent.ID
+		r.ParentID = &id
+	}
+
+	return record{Kind: recordMessage, Message: &r}
+}
+
+func (r threadRecord) thread() Thread {
+	t := Thread{
+		ID:       r.ID,
+		Settings: r.Settings,
+		Summary:  r.Summary,
+		Persona:  r.Persona,
+		Language: r.Language,
+		Sources:  r.Sources,
+		Selected: r.Selected,
+		Fork:     r.Fork,
+	}
+
+	if r.RootID != nil {
+		// The root message is stored after its thread, only keep a placeholder
+		// until the message itself is loaded.
+		t.Root = &Message{ID: *r.RootID}
+	}
+
+	return t
+}
+
+func (r messageRecord) message() *Message {
+	return &Message{
+		ID:       r.ID,
+		Type:     r.Type,
+		ThreadID: r.ThreadID,
+		Sender:   r.Sender,
+		Text:     r.Text,
+		Time:     r.Time,
+		children: []*Message{},
+	}
+}
+
+// link attaches msg to its parent in messages, if the parent is known.
+func link(messages map[MessageID]*Message, msg *Message, parentID *MessageID) {
+	if parentID == nil {
+		return
+	}
+
+	if parent, ok := messages[*parentID]; ok {
+		msg.parent = parent
+		parent.children = append(parent.children, msg)
+	}
+}
+
+// unlink detaches msg from its parent.
+func unlink(msg *Message) {
+	if msg.parent == nil {
+		return
+	}
+
+	siblings := make([]*Message, 0, len(msg.parent.children))
+	for _, c := range msg.parent.children {
+		if c != msg {
+			siblings = append(siblings, c)
+		}
+	}
+
+	msg.parent.children = siblings
+	msg.parent = nil
+}
@@ -10,76 +10,291 @@ import (
 
 const IDCollisionRetryCount int = 5
 
-type Repository struct {
+type Repository interface {
+	AddMessage(source *telegram.Message, messageType MessageType) (*Message, error)
+	GetMessage(id MessageID) (*Message, error)
+	GetThread(id uuid.UUID) (Thread, error)
+	NewThread(root *Message) (Thread, error)
+	Set(thread Thread) error
+	// Detach removes the message and every reply to it from its thread, along
+	// with the alternatives selected among them. Replies to the removed
+	// messages fail with ErrDetached.
+	Detach(id MessageID) error
+	Close() error
+}
+
+// MemoryRepository keeps every thread in memory. When opened with a journal
+// all changes are also appended to disk so they survive a restart.
+type MemoryRepository struct {
 	threads  map[uuid.UUID]Thread
 	messages map[MessageID]*Message
+	journal  *journal
+	usage    *usageTracker
 
 	mu sync.Mutex
 }
 
-func NewRepository() *Repository {
-	return &Repository{
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
 		threads:  make(map[uuid.UUID]Thread),
 		messages: map[MessageID]*Message{},
+		usage:    newUsageTracker(),
 	}
 }
 
-func (r *Repository) AddMessage(source *telegram.Message, messageType MessageType) (*Message, error) {
-	var parent *Message
-	id := GetMessageID(source)
-	msg := Message{
-		ID:       id,
-		Type:     messageType,
-		parent:   nil,
-		children: []*Message{},
-		Text:     source.Text,
+// OpenJournalRepository returns a memory repository backed by the journal at
+// path. Any threads already recorded in the journal are restored before it
+// returns.
+func OpenJournalRepository(path string) (*MemoryRepository, error) {
+	j, err := openJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewMemoryRepository()
+	stale := 0
+	err = j.replay(func(rec record) error {
+		if rec.Kind == recordEvict || rec.Kind == recordDetach {
+			stale++
+		}
+
+		return r.apply(rec)
+	})
+	if err != nil {
+		j.close()
+		return nil, fmt.Errorf("restore repository: %w", err)
 	}
 
-	if source.From != nil {
-		msg.Sender = User(*source.From)
+	for id, t := range r.threads {
+		if t.Root == nil {
+			continue
+		}
+
+		if root, ok := r.messages[t.Root.ID]; ok {
+			t.Root = root
+			r.threads[id] = t
+		}
 	}
 
-	if source.IsCommand() {
-		msg.Text = source.CommandArguments()
+	if stale > 0 {
+		// Evicted threads and detached messages are still in the journal,
+		// rewrite it with only the live state so it doesn't grow without
+		// bound.
+		if err := j.rewrite(r.snapshot()); err != nil {
+			j.close()
+			return nil, fmt.Errorf("compact journal: %w", err)
+		}
 	}
 
+	r.journal = j
+	return r, nil
+}
+
+func (r *MemoryRepository) Close() error {
+	if r.journal == nil {
+		return nil
+	}
+
+	return r.journal.close()
+}
+
+func (r *MemoryRepository) apply(rec record) error {
+	switch rec.Kind {
+	case recordThread:
+		if rec.Thread == nil {
+			return fmt.Errorf("thread record: %w", ErrCorruptJournal)
+		}
+
+		t := rec.Thread.thread()
+		r.threads[t.ID] = t
+		r.usage.track(t.ID)
+	case recordMessage:
+		if rec.Message == nil {
+			return fmt.Errorf("message record: %w", ErrCorruptJournal)
+		}
+
+		msg := rec.Message.message()
+		link(r.messages, msg, rec.Message.ParentID)
+		r.messages[msg.ID] = msg
+		r.usage.add(msg)
+	case recordEvict:
+		if rec.Evict == nil {
+			return fmt.Errorf("evict record: %w", ErrCorruptJournal)
+		}
+
+		r.applyEvict(*rec.Evict)
+	case recordDetach:
+		if rec.Detach == nil {
+			return fmt.Errorf("detach record: %w", ErrCorruptJournal)
+		}
+
+		r.detachLocked(*rec.Detach)
+	default:
+		return fmt.Errorf("unknown record kind '%s': %w", rec.Kind, ErrCorruptJournal)
+	}
+
+	return nil
+}
+
+// persist appends rec to the journal, if there is one. It is called with the
+// lock held so the journal replays in the order the repository changed.
+func (r *MemoryRepository) persist(rec record) error {
+	if r.journal == nil {
+		return nil
+	}
+
+	return r.journal.append(rec)
+}
+
+func (r *MemoryRepository) persistAll(recs []record) error {
+	for _, rec := range recs {
+		if err := r.persist(rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) AddMessage(source *telegram.Message, messageType MessageType) (*Message, error) {
+	msg := newMessage(source, messageType)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if source.ReplyToMessage != nil {
-		id := GetMessageID(source.ReplyToMessage)
-		parent = r.GetMessage(id)
+		parent, err := r.replyParentLocked(GetMessageID(source.ReplyToMessage), messageType)
+		if err != nil {
+			return nil, err
+		}
+
 		msg.parent = parent
 	}
 
-	var threadID uuid.UUID
-	if parent == nil {
-		thread, err := r.NewThread(&msg)
+	if msg.parent == nil {
+		thread, err := r.newThreadLocked(&msg)
 		if err != nil {
 			return nil, fmt.Errorf("allocate thread: %w", err)
 		}
 
-		threadID = thread.ID
+		msg.ThreadID = thread.ID
 	} else {
-		parent.children = append(parent.children, &msg)
-		threadID = parent.ThreadID
+		msg.parent.children = append(msg.parent.children, &msg)
+		msg.ThreadID = msg.parent.ThreadID
+	}
+
+	r.messages[msg.ID] = &msg
+	r.usage.add(&msg)
+	evicted := r.enforceLocked(msg.ThreadID)
+	if err := r.persist(newMessageRecord(&msg)); err != nil {
+		return nil, fmt.Errorf("persist message: %w", err)
+	}
+
+	if err := r.persistAll(evicted); err != nil {
+		return nil, fmt.Errorf("persist eviction: %w", err)
 	}
 
-	msg.ThreadID = threadID
-	r.mu.Lock()
-	r.messages[id] = &msg
-	r.mu.Unlock()
 	return &msg, nil
 }
 
-func (r *Repository) Set(thread Thread) {
+// replyParentLocked returns the message a reply of messageType is replying
+// to, or nil if it is unknown. Replies to a thread that is past its retention
+// limits evict the thread.
+func (r *MemoryRepository) replyParentLocked(id MessageID, messageType MessageType) (*Message, error) {
+	parent, ok := r.messages[id]
+	if !ok {
+		if reason, buried := r.usage.tombstones[id]; buried {
+			return nil, reason
+		}
+
+		return nil, nil
+	}
+
+	if !r.usage.expired(parent.ThreadID, messageType) {
+		return parent, nil
+	}
+
+	if err := r.persist(r.evictLocked(parent.ThreadID)); err != nil {
+		return nil, fmt.Errorf("persist eviction: %w", err)
+	}
+
+	return nil, ErrThreadExpired
+}
+
+func (r *MemoryRepository) Set(thread Thread) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.threads[thread.ID] = thread
+	r.usage.track(thread.ID)
+	if err := r.persist(newThreadRecord(thread)); err != nil {
+		return fmt.Errorf("persist thread: %w", err)
+	}
+
+	return nil
 }
 
-var generateID func() (uuid.UUID, error) = uuid.NewUUID
+// Detach removes the message and every reply to it from its thread. Their IDs
+// are tombstoned like those of evicted threads, so replies to them fail with
+// ErrDetached for as long as the tombstones are kept.
+func (r *MemoryRepository) Detach(id MessageID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msg, ok := r.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
 
-func (r *Repository) NewThread(root *Message) (t Thread, err error) {
+	if msg.parent == nil {
+		return ErrDetachRoot
+	}
+
+	r.detachLocked(id)
+	if err := r.persist(record{Kind: recordDetach, Detach: &id}); err != nil {
+		return fmt.Errorf("persist detach: %w", err)
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) detachLocked(id MessageID) {
+	msg, ok := r.messages[id]
+	if !ok {
+		return
+	}
+
+	unlink(msg)
+	detached := []MessageID{}
+	walk(msg, func(m *Message) {
+		delete(r.messages, m.ID)
+		r.usage.remove(m)
+		r.usage.bury(m.ID, ErrDetached)
+		detached = append(detached, m.ID)
+	})
+
+	if t, ok := r.threads[msg.ThreadID]; ok {
+		t.Deselect(detached)
+		r.threads[t.ID] = t
+	}
+}
+
+func (r *MemoryRepository) NewThread(root *Message) (Thread, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	return r.newThreadLocked(root)
+}
+
+func (r *MemoryRepository) newThreadLocked(root *Message) (t Thread, err error) {
+	t, err = r.allocateThreadLocked(root)
+	if err != nil {
+		return t, err
+	}
+
+	if err := r.persist(newThreadRecord(t)); err != nil {
+		return t, fmt.Errorf("persist thread: %w", err)
+	}
+
+	return t, nil
+}
+
+func (r *MemoryRepository) allocateThreadLocked(root *Message) (t Thread, err error) {
 	var id uuid.UUID
 	for i := 0; i < IDCollisionRetryCount; i++ {
 		id, err = generateID()
@@ -96,6 +311,7 @@ func (r *Repository) NewThread(root *Message) (t Thread, err error) {
 			}
 
 			r.threads[id] = t
+			r.usage.track(id)
 			return t, nil
 		}
 	}
@@ -103,13 +319,18 @@ func (r *Repository) NewThread(root *Message) (t Thread, err error) {
 	return t, ErrAllocateThread
 }
 
-func (r *Repository) GetMessage(id MessageID) *Message {
+func (r *MemoryRepository) GetMessage(id MessageID) (*Message, error) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
-	return r.messages[id]
+	msg, ok := r.messages[id]
+	r.mu.Unlock()
+	if ok {
+		return msg, nil
+	}
+
+	return nil, ErrNotFound
 }
 
-func (r *Repository) GetThread(id uuid.UUID) (t Thread, err error) {
+func (r *MemoryRepository) GetThread(id uuid.UUID) (t Thread, err error) {
 	r.mu.Lock()
 	var ok bool
 	t, ok = r.threads[id]
@@ -3,9 +3,12 @@ package thread
 import (
 	"errors"
 	"reflect"
+	"sync"
+	"telegram-bot/pkg/storage"
 	"testing"
 
 	"encoding/binary"
+	"path/filepath"
 
 	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/google/uuid"
@@ -35,6 +38,59 @@ func resetGenerator() {
 	offset = 0
 }
 
+// backends lists every Repository implementation, each test case below is run
+// against all of them. Durable backends are reopened from the same path to
+// check that their state survives a restart.
+var backends = []struct {
+	name    string
+	durable bool
+	open    func(t *testing.T, path string) (Repository, error)
+}{
+	{
+		name: "memory",
+		open: func(*testing.T, string) (Repository, error) {
+			return NewMemoryRepository(), nil
+		},
+	},
+	{
+		name:    "journal",
+		durable: true,
+		open: func(_ *testing.T, path string) (Repository, error) {
+			return OpenJournalRepository(path)
+		},
+	},
+	{
+		name:    "sqlite",
+		durable: true,
+		open: func(t *testing.T, path string) (Repository, error) {
+			db, err := storage.OpenSQLite(path)
+			if err != nil {
+				return nil, err
+			}
+
+			t.Cleanup(func() { db.Close() })
+			return NewSQLRepository(db)
+		},
+	},
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, open func() Repository)) {
+	for _, backend := range backends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, func() Repository {
+				repo, err := backend.open(t, filepath.Join(t.TempDir(), "threads"))
+				if err != nil {
+					t.Fatalf("unexpected error opening repository: %v", err)
+				}
+
+				t.Cleanup(func() { repo.Close() })
+				return repo
+			})
+		})
+	}
+}
+
 func TestRepository_NewThread(t *testing.T) {
 	type output struct {
 		value Thread
@@ -44,13 +100,13 @@ func TestRepository_NewThread(t *testing.T) {
 		desc     string
 		input    *Message
 		expected output
-		setup    func(*Repository)
+		setup    func(Repository)
 	}{
 		{
 			desc: "fails on collisions",
-			setup: func(repo *Repository) {
+			setup: func(repo Repository) {
 				generateID = generateTestingID
-				repo.threads[testingID] = Thread{}
+				repo.NewThread(nil)
 			},
 			input: nil,
 			expected: output{
@@ -60,10 +116,10 @@ func TestRepository_NewThread(t *testing.T) {
 		},
 		{
 			desc: "retries on collision",
-			setup: func(repo *Repository) {
+			setup: func(repo Repository) {
 				resetGenerator()
 				generateID = generateIncrementingTestID
-				repo.threads[testingID] = Thread{}
+				repo.NewThread(nil)
 			},
 			input: nil,
 			expected: output{
@@ -77,20 +133,22 @@ func TestRepository_NewThread(t *testing.T) {
 		},
 	}
 
-	for _, tc := range cases {
-		t.Run(tc.desc, func(t *testing.T) {
-			sut := NewRepository()
-			tc.setup(sut)
-			result, err := sut.NewThread(tc.input)
-			if err == nil && !reflect.DeepEqual(result, tc.expected.value) {
-				t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
-			}
+	forEachBackend(t, func(t *testing.T, open func() Repository) {
+		for _, tc := range cases {
+			t.Run(tc.desc, func(t *testing.T) {
+				sut := open()
+				tc.setup(sut)
+				result, err := sut.NewThread(tc.input)
+				if err == nil && !reflect.DeepEqual(result, tc.expected.value) {
+					t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+				}
 
-			if !errors.Is(err, tc.expected.err) {
-				t.Errorf("unexpected error expected '%v', got '%v'", tc.expected.err, err)
-			}
-		})
-	}
+				if !errors.Is(err, tc.expected.err) {
+					t.Errorf("unexpected error expected '%v', got '%v'", tc.expected.err, err)
+				}
+			})
+		}
+	})
 }
 
 func TestRepository_AddMessage(t *testing.T) {
@@ -111,11 +169,11 @@ func TestRepository_AddMessage(t *testing.T) {
 		desc     string
 		input    input
 		expected output
-		setup    func(*Repository)
+		setup    func(Repository)
 	}{
 		{
 			desc: "creates new thread when one doesn't exist",
-			setup: func(*Repository) {
+			setup: func(Repository) {
 				resetGenerator()
 				generateID = generateTestingID
 			},
@@ -146,34 +204,270 @@ func TestRepository_AddMessage(t *testing.T) {
 		},
 	}
 
-	for _, tc := range cases {
-		t.Run(tc.desc, func(t *testing.T) {
-			sut := NewRepository()
-			tc.setup(sut)
-			result, err := sut.AddMessage(&tc.input.message, tc.input.messageType)
-			if err == nil && result.ID != tc.expected.value.ID {
-				t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+	forEachBackend(t, func(t *testing.T, open func() Repository) {
+		for _, tc := range cases {
+			t.Run(tc.desc, func(t *testing.T) {
+				sut := open()
+				tc.setup(sut)
+				result, err := sut.AddMessage(&tc.input.message, tc.input.messageType)
+				if err == nil && result.ID != tc.expected.value.ID {
+					t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+				}
+
+				if err == nil && result.Text != tc.expected.value.Text {
+					t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+				}
+
+				if err == nil && result.Sender != tc.expected.value.Sender {
+					t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+				}
+
+				if err == nil && result.Type != tc.expected.value.Type {
+					t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+				}
+
+				if err == nil && result.ThreadID != tc.expected.value.ThreadID {
+					t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+				}
+
+				if !errors.Is(err, tc.expected.err) {
+					t.Errorf("unexpected error expected '%v', got '%v'", tc.expected.err, err)
+				}
+			})
+		}
+	})
+}
+
+func TestRepository_RestoresThreads(t *testing.T) {
+	testUser := telegram.User{
+		ID:        456,
+		FirstName: "Foo",
+	}
+	chat := &telegram.Chat{ID: 789}
+	root := telegram.Message{
+		MessageID: 1,
+		From:      &testUser,
+		Chat:      chat,
+		Text:      "A prompt",
+	}
+	reply := telegram.Message{
+		MessageID:      2,
+		From:           &testUser,
+		Chat:           chat,
+		Text:           "A reply",
+		ReplyToMessage: &root,
+	}
+
+	for _, backend := range backends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			resetGenerator()
+			generateID = generateIncrementingTestID
+			path := filepath.Join(t.TempDir(), "threads")
+			repo, err := backend.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error opening repository: %v", err)
+			}
+
+			if _, err := repo.AddMessage(&root, TypePrompt); err != nil {
+				t.Fatalf("unexpected error adding root: %v", err)
+			}
+
+			added, err := repo.AddMessage(&reply, TypePrompt)
+			if err != nil {
+				t.Fatalf("unexpected error adding reply: %v", err)
+			}
+
+			tweaked, _ := repo.GetThread(added.ThreadID)
+			tweaked.Settings.MaxTokens = 42
+			tweaked.Persona = &Persona{Name: "pirate", SystemPrompt: "Talk like a pirate."}
+			tweaked.SetSource(SourceThread, "MaxTokens")
+			tweaked.Select(GetMessageID(&root), GetMessageID(&reply))
+			tweaked.Fork = &Fork{ThreadID: testingID, History: []Turn{{Role: RoleUser, Name: "Foo", Content: "Earlier"}}}
+			if err := repo.Set(tweaked); err != nil {
+				t.Fatalf("unexpected error saving thread: %v", err)
+			}
+
+			if backend.durable {
+				if err := repo.Close(); err != nil {
+					t.Fatalf("unexpected error closing repository: %v", err)
+				}
+
+				repo, err = backend.open(t, path)
+				if err != nil {
+					t.Fatalf("unexpected error reopening repository: %v", err)
+				}
+			}
+			defer repo.Close()
+
+			msg, err := repo.GetMessage(GetMessageID(&reply))
+			if err != nil {
+				t.Fatalf("unexpected error getting reply: %v", err)
+			}
+
+			expectedHistory := []string{"Foo: A prompt", "Foo: A reply"}
+			if !reflect.DeepEqual(msg.History(), expectedHistory) {
+				t.Errorf("expected '%v', got '%v'", expectedHistory, msg.History())
+			}
+
+			result, err := repo.GetThread(added.ThreadID)
+			if err != nil {
+				t.Fatalf("unexpected error getting thread: %v", err)
+			}
+
+			if result.Settings.MaxTokens != 42 {
+				t.Errorf("expected '%d', got '%d'", 42, result.Settings.MaxTokens)
+			}
+
+			if source := result.Source("MaxTokens"); source != SourceThread {
+				t.Errorf("expected '%s', got '%s'", SourceThread, source)
+			}
+
+			if !reflect.DeepEqual(result.Selected, tweaked.Selected) {
+				t.Errorf("expected '%v', got '%v'", tweaked.Selected, result.Selected)
+			}
+
+			if !reflect.DeepEqual(result.Fork, tweaked.Fork) {
+				t.Errorf("expected '%v', got '%v'", tweaked.Fork, result.Fork)
+			}
+
+			if !reflect.DeepEqual(result.Persona, tweaked.Persona) {
+				t.Errorf("expected '%v', got '%v'", tweaked.Persona, result.Persona)
+			}
+
+			if result.Root == nil || len(result.Root.Children()) != 1 || result.Root.Children()[0].ID != msg.ID {
+				t.Errorf("expected thread root to be linked to the restored reply")
+			}
+		})
+	}
+}
+
+func TestRepository_Detach(t *testing.T) {
+	root := testMessage(1, nil)
+	prompt := testMessage(2, root)
+	response := testMessage(3, prompt)
+	sibling := testMessage(4, root)
+
+	for _, backend := range backends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			resetGenerator()
+			generateID = generateIncrementingTestID
+			path := filepath.Join(t.TempDir(), "threads")
+			repo, err := backend.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error opening repository: %v", err)
 			}
 
-			if err == nil && result.Text != tc.expected.value.Text {
-				t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+			for _, msg := range []*telegram.Message{root, prompt, response, sibling} {
+				if _, err := repo.AddMessage(msg, TypePrompt); err != nil {
+					t.Fatalf("unexpected error adding message: %v", err)
+				}
 			}
 
-			if err == nil && result.Sender != tc.expected.value.Sender {
-				t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+			added, _ := repo.GetMessage(GetMessageID(root))
+			th, _ := repo.GetThread(added.ThreadID)
+			th.Select(GetMessageID(sibling), GetMessageID(response))
+			th.Select(GetMessageID(root), GetMessageID(sibling))
+			if err := repo.Set(th); err != nil {
+				t.Fatalf("unexpected error saving thread: %v", err)
 			}
 
-			if err == nil && result.Type != tc.expected.value.Type {
-				t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+			if err := repo.Detach(GetMessageID(root)); !errors.Is(err, ErrDetachRoot) {
+				t.Errorf("expected error '%v', got '%v'", ErrDetachRoot, err)
 			}
 
-			if err == nil && result.ThreadID != tc.expected.value.ThreadID {
-				t.Errorf("expected '%v', got '%v'", tc.expected.value, result)
+			if err := repo.Detach(GetMessageID(prompt)); err != nil {
+				t.Fatalf("unexpected error detaching message: %v", err)
 			}
 
-			if !errors.Is(err, tc.expected.err) {
-				t.Errorf("unexpected error expected '%v', got '%v'", tc.expected.err, err)
+			if backend.durable {
+				if err := repo.Close(); err != nil {
+					t.Fatalf("unexpected error closing repository: %v", err)
+				}
+
+				repo, err = backend.open(t, path)
+				if err != nil {
+					t.Fatalf("unexpected error reopening repository: %v", err)
+				}
+			}
+			defer repo.Close()
+
+			for _, msg := range []*telegram.Message{prompt, response} {
+				if _, err := repo.GetMessage(GetMessageID(msg)); !errors.Is(err, ErrNotFound) {
+					t.Errorf("expected error '%v', got '%v'", ErrNotFound, err)
+				}
+			}
+
+			parent, err := repo.GetMessage(GetMessageID(root))
+			if err != nil {
+				t.Fatalf("unexpected error getting root: %v", err)
+			}
+
+			if len(parent.Children()) != 1 || parent.Children()[0].ID != GetMessageID(sibling) {
+				t.Errorf("expected only the sibling to be left, got '%v'", parent.Children())
+			}
+
+			th, _ = repo.GetThread(parent.ThreadID)
+			expected := map[int]MessageID{root.MessageID: GetMessageID(sibling)}
+			if !reflect.DeepEqual(th.Selected, expected) {
+				t.Errorf("expected selection '%v', got '%v'", expected, th.Selected)
+			}
+
+			if _, err := repo.AddMessage(testMessage(5, response), TypePrompt); !errors.Is(err, ErrDetached) {
+				t.Errorf("expected error '%v', got '%v'", ErrDetached, err)
 			}
 		})
 	}
 }
+
+func TestRepository_ConcurrentWrites(t *testing.T) {
+	const chats, messages = 8, 50
+	forEachBackend(t, func(t *testing.T, open func() Repository) {
+		generateID = uuid.NewUUID
+		repo := open()
+		errs := make(chan error, chats*messages)
+		var wg sync.WaitGroup
+		for chat := 1; chat <= chats; chat++ {
+			wg.Add(1)
+			go func(chat int) {
+				defer wg.Done()
+				var previous *telegram.Message
+				for id := 1; id <= messages; id++ {
+					msg := testMessage(id, previous)
+					msg.Chat = &telegram.Chat{ID: int64(chat)}
+					if _, err := repo.AddMessage(msg, TypePrompt); err != nil {
+						errs <- err
+					}
+
+					previous = msg
+				}
+			}(chat)
+		}
+		wg.Wait()
+		close(errs)
+
+		failed := 0
+		for err := range errs {
+			if failed == 0 {
+				t.Errorf("unexpected error adding message: %v", err)
+			}
+			failed++
+		}
+
+		if failed > 0 {
+			t.Errorf("expected every message to be added, %d of %d failed", failed, chats*messages)
+		}
+
+		for chat := 1; chat <= chats; chat++ {
+			last, err := repo.GetMessage(MessageID{ChannelID: int64(chat), FromID: 456, MessageID: messages})
+			if err != nil {
+				t.Fatalf("unexpected error getting message: %v", err)
+			}
+
+			if depth := len(last.History()); depth != messages {
+				t.Errorf("expected chat %d to have %d messages in its thread, got %d", chat, messages, depth)
+			}
+		}
+	})
+}
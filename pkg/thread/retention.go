@@ -0,0 +1,259 @@
+package thread
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RetentionPolicy bounds how much the repository keeps in memory. A zero
+// value for any of the limits disables it.
+type RetentionPolicy struct {
+	// MaxThreads is the number of threads kept before the least recently
+	// active ones are evicted.
+	MaxThreads int
+	// MaxMessagesPerThread is the number of messages a thread can hold,
+	// replying to a full thread expires it. The responses to the prompt that
+	// filled it are still added.
+	MaxMessagesPerThread int
+	// MaxIdle is how long a thread is kept after its last message.
+	MaxIdle time.Duration
+	// MaxBytes is an estimate of the memory all threads are allowed to use.
+	MaxBytes int
+}
+
+// MaxTombstones is the number of evicted message IDs remembered so replies to
+// them can be told apart from replies to messages the bot never saw.
+const MaxTombstones int = 100000
+
+// messageOverhead is a rough estimate of the memory a message uses on top of
+// its text, covering the struct, the map entries and the tree pointers.
+const messageOverhead int = 256
+
+func messageSize(m *Message) int {
+	return messageOverhead + len(m.Text) + len(m.Sender.FirstName) + len(m.Sender.LastName) + len(m.Sender.UserName)
+}
+
+type threadUsage struct {
+	id         uuid.UUID
+	lastActive time.Time
+	messages   int
+	bytes      int
+}
+
+// usageTracker orders threads by their last activity and keeps track of the
+// memory they use.
+type usageTracker struct {
+	policy  RetentionPolicy
+	lru     *list.List
+	threads map[uuid.UUID]*list.Element
+	bytes   int
+
+	// tombstones holds the error replies to a removed message fail with.
+	tombstones     map[MessageID]error
+	tombstoneOrder []MessageID
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		lru:        list.New(),
+		threads:    map[uuid.UUID]*list.Element{},
+		tombstones: map[MessageID]error{},
+	}
+}
+
+func (u *usageTracker) track(id uuid.UUID) *threadUsage {
+	if e, ok := u.threads[id]; ok {
+		return e.Value.(*threadUsage)
+	}
+
+	usage := &threadUsage{id: id, lastActive: now()}
+	u.threads[id] = u.lru.PushFront(usage)
+	return usage
+}
+
+func (u *usageTracker) add(msg *Message) {
+	usage := u.track(msg.ThreadID)
+	size := messageSize(msg)
+	usage.messages++
+	usage.bytes += size
+	u.bytes += size
+	if usage.messages == 1 || msg.Time.After(usage.lastActive) {
+		usage.lastActive = msg.Time
+	}
+
+	u.lru.MoveToFront(u.threads[msg.ThreadID])
+}
+
+// remove stops counting msg against the limits of its thread.
+func (u *usageTracker) remove(msg *Message) {
+	e, ok := u.threads[msg.ThreadID]
+	if !ok {
+		return
+	}
+
+	usage := e.Value.(*threadUsage)
+	size := messageSize(msg)
+	usage.messages--
+	usage.bytes -= size
+	u.bytes -= size
+}
+
+func (u *usageTracker) untrack(id uuid.UUID) {
+	e, ok := u.threads[id]
+	if !ok {
+		return
+	}
+
+	u.bytes -= e.Value.(*threadUsage).bytes
+	u.lru.Remove(e)
+	delete(u.threads, id)
+}
+
+func (u *usageTracker) bury(id MessageID, reason error) {
+	if _, ok := u.tombstones[id]; ok {
+		return
+	}
+
+	u.tombstones[id] = reason
+	u.tombstoneOrder = append(u.tombstoneOrder, id)
+	if len(u.tombstoneOrder) > MaxTombstones {
+		delete(u.tombstones, u.tombstoneOrder[0])
+		u.tombstoneOrder = u.tombstoneOrder[1:]
+	}
+}
+
+func (u *usageTracker) idle(usage *threadUsage) bool {
+	return u.policy.MaxIdle > 0 && now().Sub(usage.lastActive) > u.policy.MaxIdle
+}
+
+// expired reports whether the thread can no longer be replied to with a
+// message of messageType. Only new prompts are turned away by a full thread,
+// responses finish the exchange of a prompt it accepted and commands, such as
+// /export, and their replies don't continue the conversation.
+func (u *usageTracker) expired(id uuid.UUID, messageType MessageType) bool {
+	e, ok := u.threads[id]
+	if !ok {
+		return false
+	}
+
+	usage := e.Value.(*threadUsage)
+	full := u.policy.MaxMessagesPerThread > 0 && usage.messages >= u.policy.MaxMessagesPerThread
+	if full && messageType == TypePrompt {
+		return true
+	}
+
+	return u.idle(usage)
+}
+
+// oldest returns the least recently active thread if the repository is over
+// any of its limits.
+func (u *usageTracker) oldest() (*threadUsage, bool) {
+	e := u.lru.Back()
+	if e == nil {
+		return nil, false
+	}
+
+	usage := e.Value.(*threadUsage)
+	over := u.policy.MaxThreads > 0 && u.lru.Len() > u.policy.MaxThreads
+	over = over || u.policy.MaxBytes > 0 && u.bytes > u.policy.MaxBytes
+	return usage, over || u.idle(usage)
+}
+
+// SetRetention applies the policy to the repository, evicting anything that
+// is already over its limits.
+func (r *MemoryRepository) SetRetention(policy RetentionPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.usage.policy = policy
+	return r.persistAll(r.enforceLocked(uuid.Nil))
+}
+
+// enforceLocked evicts the least recently active threads until the repository
+// is within its limits again. The thread identified by keep is never evicted
+// so the message that was just added survives.
+func (r *MemoryRepository) enforceLocked(keep uuid.UUID) []record {
+	var evicted []record
+	for {
+		usage, over := r.usage.oldest()
+		if !over || usage.id == keep {
+			return evicted
+		}
+
+		evicted = append(evicted, r.evictLocked(usage.id))
+	}
+}
+
+// evictLocked removes the thread along with every message in it.
+func (r *MemoryRepository) evictLocked(id uuid.UUID) record {
+	ev := evictRecord{ThreadID: &id, Messages: []MessageID{}}
+	if t, ok := r.threads[id]; ok && t.Root != nil {
+		walk(t.Root, func(m *Message) {
+			ev.Messages = append(ev.Messages, m.ID)
+		})
+	}
+
+	r.applyEvict(ev)
+	return record{Kind: recordEvict, Evict: &ev}
+}
+
+func (r *MemoryRepository) applyEvict(ev evictRecord) {
+	for _, id := range ev.Messages {
+		delete(r.messages, id)
+		r.usage.bury(id, ErrThreadExpired)
+	}
+
+	for _, id := range ev.Detached {
+		r.usage.bury(id, ErrDetached)
+	}
+
+	if ev.ThreadID != nil {
+		delete(r.threads, *ev.ThreadID)
+		r.usage.untrack(*ev.ThreadID)
+	}
+}
+
+// snapshot returns the records needed to rebuild the current state of the
+// repository, oldest threads first.
+func (r *MemoryRepository) snapshot() []record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recs := []record{}
+	for e := r.usage.lru.Back(); e != nil; e = e.Prev() {
+		t, ok := r.threads[e.Value.(*threadUsage).id]
+		if !ok {
+			continue
+		}
+
+		recs = append(recs, newThreadRecord(t))
+		if t.Root != nil {
+			walk(t.Root, func(m *Message) {
+				recs = append(recs, newMessageRecord(m))
+			})
+		}
+	}
+
+	if len(r.usage.tombstoneOrder) > 0 {
+		buried := &evictRecord{Messages: []MessageID{}}
+		for _, id := range r.usage.tombstoneOrder {
+			if r.usage.tombstones[id] == ErrDetached {
+				buried.Detached = append(buried.Detached, id)
+			} else {
+				buried.Messages = append(buried.Messages, id)
+			}
+		}
+
+		recs = append(recs, record{Kind: recordEvict, Evict: buried})
+	}
+
+	return recs
+}
+
+// walk visits msg and all of its replies, parents before children.
+func walk(msg *Message, visit func(*Message)) {
+	visit(msg)
+	for _, c := range msg.children {
+		walk(c, visit)
+	}
+}
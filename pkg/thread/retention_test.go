@@ -0,0 +1,216 @@
+package thread
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+var retentionEpoch = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func testMessage(id int, replyTo *telegram.Message) *telegram.Message {
+	return &telegram.Message{
+		MessageID:      id,
+		From:           &telegram.User{ID: 456, FirstName: "Foo"},
+		Chat:           &telegram.Chat{ID: 789},
+		Date:           int(retentionEpoch.Unix()),
+		Text:           "Some message",
+		ReplyToMessage: replyTo,
+	}
+}
+
+func TestMemoryRepository_Retention(t *testing.T) {
+	cases := []struct {
+		desc     string
+		policy   RetentionPolicy
+		elapsed  time.Duration
+		expected error
+	}{
+		{
+			desc:     "keeps threads within limits",
+			policy:   RetentionPolicy{MaxThreads: 2, MaxMessagesPerThread: 3, MaxIdle: time.Hour},
+			elapsed:  time.Minute,
+			expected: nil,
+		},
+		{
+			desc:     "evicts least recently active thread",
+			policy:   RetentionPolicy{MaxThreads: 1},
+			expected: ErrThreadExpired,
+		},
+		{
+			desc:     "expires full threads",
+			policy:   RetentionPolicy{MaxMessagesPerThread: 2},
+			expected: ErrThreadExpired,
+		},
+		{
+			desc:     "expires idle threads",
+			policy:   RetentionPolicy{MaxIdle: time.Hour},
+			elapsed:  2 * time.Hour,
+			expected: ErrThreadExpired,
+		},
+		{
+			desc:     "evicts threads over the memory budget",
+			policy:   RetentionPolicy{MaxBytes: 3 * messageOverhead},
+			expected: ErrThreadExpired,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			resetGenerator()
+			generateID = generateIncrementingTestID
+			now = func() time.Time { return retentionEpoch }
+			defer func() { now = time.Now }()
+
+			sut := NewMemoryRepository()
+			sut.SetRetention(tc.policy)
+			first := testMessage(1, nil)
+			reply := testMessage(2, first)
+			sut.AddMessage(first, TypePrompt)
+			sut.AddMessage(reply, TypeResponse)
+			sut.AddMessage(testMessage(3, nil), TypePrompt)
+
+			now = func() time.Time { return retentionEpoch.Add(tc.elapsed) }
+			_, err := sut.AddMessage(testMessage(4, reply), TypePrompt)
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("unexpected error expected '%v', got '%v'", tc.expected, err)
+			}
+
+			if tc.expected == nil {
+				return
+			}
+
+			if _, err := sut.GetMessage(GetMessageID(first)); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected evicted root to be removed, got '%v'", err)
+			}
+		})
+	}
+}
+
+func TestMemoryRepository_FullThreadTakesResponses(t *testing.T) {
+	resetGenerator()
+	generateID = generateIncrementingTestID
+	sut := NewMemoryRepository()
+	sut.SetRetention(RetentionPolicy{MaxMessagesPerThread: 3})
+	first := testMessage(1, nil)
+	reply := testMessage(2, first)
+	prompt := testMessage(3, reply)
+	sut.AddMessage(first, TypePrompt)
+	sut.AddMessage(reply, TypeResponse)
+	if _, err := sut.AddMessage(prompt, TypePrompt); err != nil {
+		t.Fatalf("unexpected error adding the prompt filling the thread: %v", err)
+	}
+
+	response := testMessage(4, prompt)
+	if _, err := sut.AddMessage(response, TypeResponse); err != nil {
+		t.Errorf("unexpected error adding the response to a full thread: %v", err)
+	}
+
+	continued := testMessage(5, response)
+	if _, err := sut.AddMessage(continued, TypeResponse); err != nil {
+		t.Errorf("unexpected error adding the rest of the response: %v", err)
+	}
+
+	command := testMessage(6, continued)
+	if _, err := sut.AddMessage(command, TypeCommand); err != nil {
+		t.Errorf("unexpected error adding a command to a full thread: %v", err)
+	}
+
+	if _, err := sut.AddMessage(testMessage(7, command), TypeInformational); err != nil {
+		t.Errorf("unexpected error adding the reply to a command to a full thread: %v", err)
+	}
+
+	_, err := sut.AddMessage(testMessage(8, continued), TypePrompt)
+	if !errors.Is(err, ErrThreadExpired) {
+		t.Errorf("unexpected error expected '%v', got '%v'", ErrThreadExpired, err)
+	}
+}
+
+func TestOpenJournalRepository_RemembersEvictions(t *testing.T) {
+	resetGenerator()
+	generateID = generateIncrementingTestID
+	path := filepath.Join(t.TempDir(), "threads.journal")
+	repo, err := OpenJournalRepository(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening repository: %v", err)
+	}
+
+	repo.SetRetention(RetentionPolicy{MaxThreads: 1})
+	first := testMessage(1, nil)
+	repo.AddMessage(first, TypePrompt)
+	second, _ := repo.AddMessage(testMessage(2, nil), TypePrompt)
+	repo.Close()
+
+	restored, err := OpenJournalRepository(path)
+	if err != nil {
+		t.Fatalf("unexpected error reopening repository: %v", err)
+	}
+	defer restored.Close()
+
+	if _, err := restored.GetThread(second.ThreadID); err != nil {
+		t.Errorf("expected live thread to be restored, got '%v'", err)
+	}
+
+	_, err = restored.AddMessage(testMessage(3, first), TypePrompt)
+	if !errors.Is(err, ErrThreadExpired) {
+		t.Errorf("unexpected error expected '%v', got '%v'", ErrThreadExpired, err)
+	}
+}
+
+func TestOpenJournalRepository_ReplaysConcurrentEvictions(t *testing.T) {
+	const chats, messages = 8, 100
+	generateID = uuid.NewUUID
+	path := filepath.Join(t.TempDir(), "threads.journal")
+	repo, err := OpenJournalRepository(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening repository: %v", err)
+	}
+
+	repo.SetRetention(RetentionPolicy{MaxThreads: chats - 2})
+	var wg sync.WaitGroup
+	for chat := 1; chat <= chats; chat++ {
+		wg.Add(1)
+		go func(chat int) {
+			defer wg.Done()
+			var previous *telegram.Message
+			for id := 1; id <= messages; id++ {
+				msg := testMessage(id, previous)
+				msg.Chat = &telegram.Chat{ID: int64(chat)}
+				if _, err := repo.AddMessage(msg, TypePrompt); errors.Is(err, ErrThreadExpired) {
+					msg.ReplyToMessage = nil
+					repo.AddMessage(msg, TypePrompt)
+				}
+
+				previous = msg
+			}
+		}(chat)
+	}
+	wg.Wait()
+
+	live := map[MessageID]bool{}
+	for chat := 1; chat <= chats; chat++ {
+		for id := 1; id <= messages; id++ {
+			msgID := MessageID{ChannelID: int64(chat), FromID: 456, MessageID: id}
+			_, err := repo.GetMessage(msgID)
+			live[msgID] = err == nil
+		}
+	}
+	repo.Close()
+
+	restored, err := OpenJournalRepository(path)
+	if err != nil {
+		t.Fatalf("unexpected error reopening repository: %v", err)
+	}
+	defer restored.Close()
+
+	for msgID, expected := range live {
+		if _, err := restored.GetMessage(msgID); (err == nil) != expected {
+			t.Errorf("expected message %v to be restored: %t, got '%v'", msgID, expected, err)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package thread
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS threads (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel_id INTEGER NOT NULL,
+	from_id    INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	thread_id  TEXT NOT NULL,
+	data       TEXT NOT NULL,
+	UNIQUE (channel_id, from_id, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS messages_thread_id ON messages (thread_id);
+
+CREATE TABLE IF NOT EXISTS detached_messages (
+	channel_id INTEGER NOT NULL,
+	from_id    INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	PRIMARY KEY (channel_id, from_id, message_id)
+);
+`
+
+// SQLRepository stores threads in a SQLite database. Threads are loaded from
+// the database on every read, so the returned messages are snapshots of the
+// thread at the time of the call.
+type SQLRepository struct {
+	db *sql.DB
+}
+
+func NewSQLRepository(db *sql.DB) (*SQLRepository, error) {
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, fmt.Errorf("migrate schema: %w", err)
+	}
+
+	return &SQLRepository{db: db}, nil
+}
+
+func (r *SQLRepository) AddMessage(source *telegram.Message, messageType MessageType) (*Message, error) {
+	msg := newMessage(source, messageType)
+	if source.ReplyToMessage != nil {
+		id := GetMessageID(source.ReplyToMessage)
+		parent, err := r.GetMessage(id)
+		if errors.Is(err, ErrNotFound) {
+			var detached bool
+			if detached, err = r.detached(id); detached {
+				return nil, ErrDetached
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("get parent message: %w", err)
+		}
+
+		msg.parent = parent
+	}
+
+	if msg.parent == nil {
+		thread, err := r.NewThread(&msg)
+		if err != nil {
+			return nil, fmt.Errorf("allocate thread: %w", err)
+		}
+
+		msg.ThreadID = thread.ID
+	} else {
+		msg.parent.children = append(msg.parent.children, &msg)
+		msg.ThreadID = msg.parent.ThreadID
+	}
+
+	if err := r.insertMessage(&msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+func (r *SQLRepository) insertMessage(msg *Message) error {
+	data, err := json.Marshal(newMessageRecord(msg).Message)
+	if err != nil {
+		return fmt.Errorf("encode message: %w", err)
+	}
+
+	_, err = r.db.Exec(
+		`INSERT INTO messages (channel_id, from_id, message_id, thread_id, data) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (channel_id, from_id, message_id) DO UPDATE SET thread_id = excluded.thread_id, data = excluded.data`,
+		msg.ID.ChannelID, msg.ID.FromID, msg.ID.MessageID, msg.ThreadID.String(), string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("insert message: %w", err)
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) GetMessage(id MessageID) (*Message, error) {
+	var threadID uuid.UUID
+	err := r.db.QueryRow(
+		`SELECT thread_id FROM messages WHERE channel_id = ? AND from_id = ? AND message_id = ?`,
+		id.ChannelID, id.FromID, id.MessageID,
+	).Scan(&threadID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("query message: %w", err)
+	}
+
+	messages, err := r.loadMessages(threadID)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := messages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return msg, nil
+}
+
+func (r *SQLRepository) loadMessages(threadID uuid.UUID) (map[MessageID]*Message, error) {
+	rows, err := r.db.Query(`SELECT data FROM messages WHERE thread_id = ? ORDER BY seq`, threadID.String())
+	if err != nil {
+		return nil, fmt.Errorf("query thread messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := map[MessageID]*Message{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("scan message: %w", err)
+		}
+
+		var rec messageRecord
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			return nil, fmt.Errorf("decode message: %w", err)
+		}
+
+		msg := rec.message()
+		link(messages, msg, rec.ParentID)
+		messages[msg.ID] = msg
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read thread messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+func (r *SQLRepository) GetThread(id uuid.UUID) (t Thread, err error) {
+	var data string
+	err = r.db.QueryRow(`SELECT data FROM threads WHERE id = ?`, id.String()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, ErrNotFound
+	}
+
+	if err != nil {
+		return t, fmt.Errorf("query thread: %w", err)
+	}
+
+	var rec threadRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return t, fmt.Errorf("decode thread: %w", err)
+	}
+
+	t = rec.thread()
+	if t.Root == nil {
+		return t, nil
+	}
+
+	messages, err := r.loadMessages(id)
+	if err != nil {
+		return t, err
+	}
+
+	if root, ok := messages[t.Root.ID]; ok {
+		t.Root = root
+	}
+
+	return t, nil
+}
+
+func (r *SQLRepository) NewThread(root *Message) (t Thread, err error) {
+	var id uuid.UUID
+	for i := 0; i < IDCollisionRetryCount; i++ {
+		id, err = generateID()
+		if err != nil {
+			continue
+		}
+
+		t = Thread{
+			ID:       id,
+			Root:     root,
+			Settings: DefaultOpenAISettings,
+		}
+
+		data, err := json.Marshal(newThreadRecord(t).Thread)
+		if err != nil {
+			return Thread{}, fmt.Errorf("encode thread: %w", err)
+		}
+
+		res, err := r.db.Exec(`INSERT INTO threads (id, data) VALUES (?, ?) ON CONFLICT (id) DO NOTHING`, id.String(), string(data))
+		if err != nil {
+			return Thread{}, fmt.Errorf("insert thread: %w", err)
+		}
+
+		if n, err := res.RowsAffected(); err == nil && n == 1 {
+			return t, nil
+		}
+	}
+
+	return Thread{}, ErrAllocateThread
+}
+
+func (r *SQLRepository) Set(thread Thread) error {
+	data, err := json.Marshal(newThreadRecord(thread).Thread)
+	if err != nil {
+		return fmt.Errorf("encode thread: %w", err)
+	}
+
+	_, err = r.db.Exec(
+		`INSERT INTO threads (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`,
+		thread.ID.String(), string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("save thread: %w", err)
+	}
+
+	return nil
+}
+
+// Detach deletes the message and every reply to it from the database, their
+// IDs are kept so replies to them fail with ErrDetached.
+func (r *SQLRepository) Detach(id MessageID) error {
+	msg, err := r.GetMessage(id)
+	if err != nil {
+		return err
+	}
+
+	if msg.parent == nil {
+		return ErrDetachRoot
+	}
+
+	t, err := r.GetThread(msg.ThreadID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin detach transaction: %w", err)
+	}
+
+	defer tx.Rollback()
+	detached := []MessageID{}
+	walk(msg, func(m *Message) {
+		if err != nil {
+			return
+		}
+
+		detached = append(detached, m.ID)
+		if _, err = tx.Exec(
+			`DELETE FROM messages WHERE channel_id = ? AND from_id = ? AND message_id = ?`,
+			m.ID.ChannelID, m.ID.FromID, m.ID.MessageID,
+		); err != nil {
+			return
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO detached_messages (channel_id, from_id, message_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+			m.ID.ChannelID, m.ID.FromID, m.ID.MessageID,
+		)
+	})
+	if err != nil {
+		return fmt.Errorf("delete message: %w", err)
+	}
+
+	t.Deselect(detached)
+	data, err := json.Marshal(newThreadRecord(t).Thread)
+	if err != nil {
+		return fmt.Errorf("encode thread: %w", err)
+	}
+
+	if _, err := tx.Exec(`UPDATE threads SET data = ? WHERE id = ?`, string(data), t.ID.String()); err != nil {
+		return fmt.Errorf("save thread: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit detach: %w", err)
+	}
+
+	return nil
+}
+
+// detached reports whether the message with id was detached from its thread.
+func (r *SQLRepository) detached(id MessageID) (bool, error) {
+	var found int
+	err := r.db.QueryRow(
+		`SELECT 1 FROM detached_messages WHERE channel_id = ? AND from_id = ? AND message_id = ?`,
+		id.ChannelID, id.FromID, id.MessageID,
+	).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("query detached message: %w", err)
+	}
+
+	return true, nil
+}
+
+// Close leaves the database open, it is shared with the stores kept next to
+// the threads and closed by whoever opened it.
+func (r *SQLRepository) Close() error {
+	return nil
+}
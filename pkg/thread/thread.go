@@ -3,6 +3,7 @@ package thread
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/google/uuid"
@@ -11,12 +12,134 @@ import (
 var (
 	ErrAllocateThread = errors.New("failed to allocate thread")
 	ErrNotFound       = errors.New("could not find element")
+	ErrCorruptJournal = errors.New("corrupt journal")
+	ErrThreadExpired  = errors.New("thread has expired")
+	ErrDetachRoot     = errors.New("cannot detach the root of a thread")
+	ErrDetached       = errors.New("message has been detached from its thread")
 )
 
 type Thread struct {
 	ID       uuid.UUID
 	Root     *Message
 	Settings CompletionParameters
+	Summary  Summary
+	// Persona is the character the bot plays in the thread, if any.
+	Persona *Persona
+	// Language is the language the bot replies in, any when empty.
+	Language string
+	// Sources tells the layer each setting of the thread comes from, by the
+	// name of the setting. Settings missing from it are the global ones.
+	Sources map[string]Source
+	// Selected maps the Telegram message ID of responses showing another of
+	// their alternatives to the message replies to them continue from.
+	Selected map[int]MessageID
+	// Fork tells where the thread was forked from, if it was.
+	Fork *Fork
+}
+
+// Fork is the origin of a thread forked from another one, along with the
+// conversation that led up to the fork. The history comes before the root of
+// the forked thread.
+type Fork struct {
+	ThreadID  uuid.UUID `json:"thread_id"`
+	MessageID MessageID `json:"message_id"`
+	History   []Turn    `json:"history"`
+}
+
+// Turns returns the conversation leading up to and including msg, a forked
+// thread starts with the history it was forked with.
+func (t Thread) Turns(msg *Message) []Turn {
+	if t.Fork == nil {
+		return msg.Turns()
+	}
+
+	turns := append([]Turn{}, t.Fork.History...)
+	return append(turns, msg.Turns()...)
+}
+
+// Source is the layer a setting of a thread comes from.
+type Source string
+
+const (
+	SourceGlobal Source = "global"
+	SourceChat   Source = "chat"
+	SourceThread Source = "thread"
+)
+
+// Source returns the layer the setting key comes from.
+func (t Thread) Source(key string) Source {
+	if source, ok := t.Sources[key]; ok {
+		return source
+	}
+
+	return SourceGlobal
+}
+
+// SetSource records that the settings keys come from source. The sources
+// are copied, the repository may share them with other copies of the thread.
+func (t *Thread) SetSource(source Source, keys ...string) {
+	sources := make(map[string]Source, len(t.Sources)+len(keys))
+	for key, s := range t.Sources {
+		sources[key] = s
+	}
+
+	for _, key := range keys {
+		sources[key] = source
+	}
+
+	t.Sources = sources
+}
+
+// Select makes replies to the response shown continue from branch, the end
+// of the alternative it shows. Showing the response itself again removes the
+// redirect. Like the sources, the selection is copied before it changes.
+func (t *Thread) Select(shown MessageID, branch MessageID) {
+	selected := make(map[int]MessageID, len(t.Selected)+1)
+	for id, b := range t.Selected {
+		selected[id] = b
+	}
+
+	if branch == shown {
+		delete(selected, shown.MessageID)
+	} else {
+		selected[shown.MessageID] = branch
+	}
+
+	t.Selected = selected
+}
+
+// Deselect drops the redirects from and to the detached messages, so replies
+// to the alternatives left continue from what is still in the thread.
+func (t *Thread) Deselect(detached []MessageID) {
+	// Telegram numbers the messages of a chat, and a thread stays in one.
+	gone := make(map[int]bool, len(detached))
+	for _, id := range detached {
+		gone[id.MessageID] = true
+	}
+
+	selected := make(map[int]MessageID, len(t.Selected))
+	for shown, branch := range t.Selected {
+		if !gone[shown] && !gone[branch.MessageID] {
+			selected[shown] = branch
+		}
+	}
+
+	t.Selected = selected
+}
+
+// Persona is the character a thread was given, copied so the thread keeps it
+// when the saved persona changes.
+type Persona struct {
+	Name         string `json:"name"`
+	DisplayName  string `json:"display_name,omitempty"`
+	SystemPrompt string `json:"system_prompt"`
+}
+
+// Summary condenses the start of a conversation, up to and including the
+// message identified by Through.
+type Summary struct {
+	Text    string
+	Through MessageID
 }
 
 type MessageID struct {
@@ -40,6 +163,7 @@ type Message struct {
 	ThreadID uuid.UUID
 	Sender   User
 	Text     string
+	Time     time.Time
 
 	parent   *Message
 	children []*Message
@@ -74,6 +198,35 @@ func GetMessageID(msg *telegram.Message) MessageID {
 	}
 }
 
+func newMessage(source *telegram.Message, messageType MessageType) Message {
+	msg := Message{
+		ID:       GetMessageID(source),
+		Type:     messageType,
+		parent:   nil,
+		children: []*Message{},
+		Text:     source.Text,
+		Time:     now(),
+	}
+
+	if source.Date != 0 {
+		msg.Time = time.Unix(int64(source.Date), 0)
+	}
+
+	if source.From != nil {
+		msg.Sender = User(*source.From)
+	}
+
+	if source.IsCommand() {
+		msg.Text = source.CommandArguments()
+	}
+
+	return msg
+}
+
+var generateID func() (uuid.UUID, error) = uuid.NewUUID
+
+var now func() time.Time = time.Now
+
 func (m *Message) History() []string {
 	prompt := fmt.Sprintf("%s: %s", m.Sender.DisplayName(), m.Text)
 	history := []string{}
@@ -88,6 +241,112 @@ func (m *Message) History() []string {
 	return history
 }
 
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Turn is a single role tagged message of a chat style conversation.
+type Turn struct {
+	ID      MessageID
+	Role    Role
+	Name    string
+	Content string
+}
+
+// Turns returns the conversation leading up to and including m, oldest first.
+// Bot responses become assistant turns and prompts become user turns tagged
+// with the name of the sender. A response replying to another response is the
+// continuation of a reply that was too long for one message, it is merged
+// into the turn it continues.
+func (m *Message) Turns() []Turn {
+	turns := []Turn{}
+	if m.parent != nil {
+		turns = m.parent.Turns()
+	}
+
+	switch m.Type {
+	case TypePrompt:
+		return append(turns, Turn{ID: m.ID, Role: RoleUser, Name: m.Sender.DisplayName(), Content: m.Text})
+	case TypeResponse:
+		if m.parent != nil && m.parent.Type == TypeResponse && len(turns) > 0 {
+			last := &turns[len(turns)-1]
+			last.ID = m.ID
+			last.Content += "\n\n" + m.Text
+			return turns
+		}
+
+		return append(turns, Turn{ID: m.ID, Role: RoleAssistant, Content: m.Text})
+	}
+
+	return turns
+}
+
+// ResponseStart returns the first message of the response m is part of, a
+// response too long for one message continues in replies to its start.
+func (m *Message) ResponseStart() *Message {
+	start := m
+	for start.Type == TypeResponse && start.parent != nil && start.parent.Type == TypeResponse {
+		start = start.parent
+	}
+
+	return start
+}
+
+// ResponseEnd returns the last message of the response starting with m.
+func (m *Message) ResponseEnd() *Message {
+	end := m
+	for next := end.continuation(); next != nil; next = end.continuation() {
+		end = next
+	}
+
+	return end
+}
+
+// ResponseText returns the text of the whole response starting with m.
+func (m *Message) ResponseText() string {
+	text := m.Text
+	for next := m.continuation(); next != nil; next = next.continuation() {
+		text += "\n\n" + next.Text
+	}
+
+	return text
+}
+
+func (m *Message) continuation() *Message {
+	if m.Type != TypeResponse {
+		return nil
+	}
+
+	for _, c := range m.children {
+		if c.Type == TypeResponse {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Alternatives returns the responses to the prompt the response starting with
+// m answers, m included, in the order they were sent.
+func (m *Message) Alternatives() []*Message {
+	if m.parent == nil || m.parent.Type == TypeResponse {
+		return []*Message{m}
+	}
+
+	alternatives := []*Message{}
+	for _, c := range m.parent.children {
+		if c.Type == TypeResponse {
+			alternatives = append(alternatives, c)
+		}
+	}
+
+	return alternatives
+}
+
 func (m *Message) Parent() *Message {
 	return m.parent
 }
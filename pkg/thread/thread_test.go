@@ -139,3 +139,130 @@ func TestGetMessageID_ProvidesDefault(t *testing.T) {
 		t.Errorf("expected '%v', got '%v'", expected, result)
 	}
 }
+
+func TestMessage_Turns(t *testing.T) {
+	cases := []struct {
+		desc     string
+		input    *Message
+		expected []Turn
+	}{
+		{
+			desc: "tags prompts and responses with roles",
+			input: &Message{
+				Text: "A follow up",
+				Type: TypePrompt,
+				Sender: User{
+					FirstName: "Sam",
+					LastName:  "TheClam",
+				},
+				parent: &Message{
+					Text: "A response",
+					Type: TypeResponse,
+					Sender: User{
+						FirstName: "Bot",
+					},
+					parent: &Message{
+						Text: "A prompt",
+						Type: TypePrompt,
+						Sender: User{
+							FirstName: "Sam",
+							LastName:  "TheClam",
+						},
+					},
+				},
+			},
+			expected: []Turn{
+				{Role: RoleUser, Name: "Sam TheClam", Content: "A prompt"},
+				{Role: RoleAssistant, Content: "A response"},
+				{Role: RoleUser, Name: "Sam TheClam", Content: "A follow up"},
+			},
+		},
+		{
+			desc: "excludes informational messages and commands",
+			input: &Message{
+				Text: "Some command",
+				Type: TypeCommand,
+				parent: &Message{
+					Text: "Some information",
+					Type: TypeInformational,
+				},
+			},
+			expected: []Turn{},
+		},
+		{
+			desc: "merges responses split across messages",
+			input: &Message{
+				ID:   MessageID{MessageID: 3},
+				Text: "Second part",
+				Type: TypeResponse,
+				parent: &Message{
+					ID:   MessageID{MessageID: 2},
+					Text: "First part",
+					Type: TypeResponse,
+					parent: &Message{
+						ID:     MessageID{MessageID: 1},
+						Text:   "A prompt",
+						Type:   TypePrompt,
+						Sender: User{FirstName: "Sam"},
+					},
+				},
+			},
+			expected: []Turn{
+				{ID: MessageID{MessageID: 1}, Role: RoleUser, Name: "Sam", Content: "A prompt"},
+				{ID: MessageID{MessageID: 3}, Role: RoleAssistant, Content: "First part\n\nSecond part"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result := tc.input.Turns()
+			if !reflect.DeepEqual(tc.expected, result) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestMessage_Alternatives(t *testing.T) {
+	prompt := &Message{ID: MessageID{MessageID: 1}, Type: TypePrompt}
+	first := &Message{ID: MessageID{MessageID: 2}, Type: TypeResponse, Text: "First part", parent: prompt}
+	rest := &Message{ID: MessageID{MessageID: 3}, Type: TypeResponse, Text: "Second part", parent: first}
+	note := &Message{ID: MessageID{MessageID: 4}, Type: TypeInformational, parent: prompt}
+	second := &Message{ID: MessageID{MessageID: 5}, Type: TypeResponse, Text: "Another answer", parent: prompt}
+	prompt.children = []*Message{first, note, second}
+	first.children = []*Message{rest}
+
+	if start := rest.ResponseStart(); start != first {
+		t.Errorf("expected '%v', got '%v'", first.ID, start.ID)
+	}
+
+	if end := first.ResponseEnd(); end != rest {
+		t.Errorf("expected '%v', got '%v'", rest.ID, end.ID)
+	}
+
+	if text := first.ResponseText(); text != "First part\n\nSecond part" {
+		t.Errorf("expected '%s', got '%s'", "First part\n\nSecond part", text)
+	}
+
+	expected := []*Message{first, second}
+	if alternatives := second.Alternatives(); !reflect.DeepEqual(alternatives, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, alternatives)
+	}
+}
+
+func TestThread_Turns(t *testing.T) {
+	root := &Message{ID: MessageID{MessageID: 2}, Type: TypeInformational, Text: "Forked"}
+	prompt := &Message{ID: MessageID{MessageID: 3}, Type: TypePrompt, Text: "And now?", Sender: User{FirstName: "Sam"}, parent: root}
+	history := []Turn{{ID: MessageID{MessageID: 1}, Role: RoleUser, Name: "Sam", Content: "Hello"}}
+	forked := Thread{Fork: &Fork{History: history}}
+
+	expected := []Turn{history[0], {ID: prompt.ID, Role: RoleUser, Name: "Sam", Content: "And now?"}}
+	if turns := forked.Turns(prompt); !reflect.DeepEqual(turns, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, turns)
+	}
+
+	if turns := (Thread{}).Turns(prompt); !reflect.DeepEqual(turns, expected[1:]) {
+		t.Errorf("expected '%v', got '%v'", expected[1:], turns)
+	}
+}
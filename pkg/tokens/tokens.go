@@ -0,0 +1,157 @@
+package tokens
+
+import (
+	"regexp"
+	"strings"
+	"telegram-bot/pkg/thread"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultContextSize is used for models that aren't listed in ContextSizes.
+const DefaultContextSize int = 4096
+
+// ContextSizes is the number of tokens each model accepts for the prompt and
+// the completion combined.
+var ContextSizes = map[string]int{
+	"text-davinci-003": 4097,
+	"text-curie-001":   2049,
+	"text-babbage-001": 2049,
+	"text-ada-001":     2049,
+	"gpt-3.5-turbo":    4096,
+	"gpt-4":            8192,
+}
+
+// turnOverhead is the number of tokens the chat format adds around every
+// message, replyOverhead the tokens priming the reply.
+const (
+	turnOverhead  int = 4
+	replyOverhead int = 3
+)
+
+// pieces splits text the same way the GPT byte pair encoders do before
+// merging, every piece is at least one token.
+var pieces = regexp.MustCompile(`'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+`)
+
+func ContextSize(model string) int {
+	if size, ok := ContextSizes[model]; ok {
+		return size
+	}
+
+	return DefaultContextSize
+}
+
+// Budget returns the number of tokens left for the prompt once maxTokens are
+// reserved for the completion.
+func Budget(model string, maxTokens int) int {
+	return ContextSize(model) - maxTokens
+}
+
+// runeTokens is the number of tokens a rune outside ASCII is encoded to at
+// most. The encoders merge few of their bytes: ideographs, kana and hangul
+// take about two tokens each, emoji and other symbols up to three, and the
+// letters of other scripts, like Cyrillic or Greek, about one.
+func runeTokens(r rune) int {
+	switch {
+	case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+		return 2
+	case r > 0xFFFF, r > unicode.MaxLatin1 && unicode.Is(unicode.So, r):
+		return 3
+	default:
+		return 1
+	}
+}
+
+func pieceTokens(piece string) int {
+	// Common words and their leading space are a single token, longer or
+	// unusual ones are split into chunks of roughly four bytes. Runes
+	// outside ASCII are counted on their own.
+	ascii, other := 0, 0
+	for _, r := range strings.TrimPrefix(piece, " ") {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other += runeTokens(r)
+		}
+	}
+
+	if other == 0 && ascii <= 6 {
+		return 1
+	}
+
+	return other + (ascii+3)/4
+}
+
+// Estimate approximates the number of tokens text is encoded to. It is tuned
+// to count slightly too many, for English as for other scripts, so prompts
+// that fit the estimate fit the model.
+func Estimate(text string) int {
+	count := 0
+	for _, piece := range pieces.FindAllString(text, -1) {
+		count += pieceTokens(piece)
+	}
+
+	return count
+}
+
+func turnTokens(t thread.Turn) int {
+	return turnOverhead + Estimate(t.Name) + Estimate(t.Content)
+}
+
+// Count estimates the tokens a conversation uses as a prompt.
+func Count(turns []thread.Turn) int {
+	count := replyOverhead
+	for _, t := range turns {
+		count += turnTokens(t)
+	}
+
+	return count
+}
+
+// Fit drops the oldest turns until the conversation fits in budget tokens. The
+// newest turn is always kept, if it doesn't fit on its own the start of its
+// content is cut off. Fit returns the kept turns along with their token count.
+func Fit(turns []thread.Turn, budget int) ([]thread.Turn, int) {
+	if len(turns) == 0 {
+		return turns, replyOverhead
+	}
+
+	used := replyOverhead
+	start := len(turns)
+	for start > 0 {
+		cost := turnTokens(turns[start-1])
+		if used+cost > budget {
+			break
+		}
+
+		used += cost
+		start--
+	}
+
+	if start < len(turns) {
+		return turns[start:], used
+	}
+
+	last := turns[len(turns)-1]
+	available := budget - used - turnOverhead - Estimate(last.Name)
+	last.Content = truncateStart(last.Content, available)
+	return []thread.Turn{last}, used + turnTokens(last)
+}
+
+// truncateStart keeps as much of the end of text as fits in limit tokens.
+func truncateStart(text string, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+
+	matches := pieces.FindAllStringIndex(text, -1)
+	count := 0
+	for i := len(matches) - 1; i >= 0; i-- {
+		count += pieceTokens(text[matches[i][0]:matches[i][1]])
+		if count > limit {
+			return strings.TrimLeft(text[matches[i][1]:], " ")
+		}
+	}
+
+	return text
+}
@@ -0,0 +1,108 @@
+package tokens
+
+import (
+	"reflect"
+	"telegram-bot/pkg/thread"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	cases := []struct {
+		desc     string
+		input    string
+		expected int
+	}{
+		{
+			desc:     "counts short words as one token",
+			input:    "Hello there, how are you?",
+			expected: 7,
+		},
+		{
+			desc:     "splits long words",
+			input:    "internationalization",
+			expected: 5,
+		},
+		{
+			desc:     "counts two tokens per ideograph or kana",
+			input:    "こんにちは世界",
+			expected: 14,
+		},
+		{
+			desc:     "counts a token per Cyrillic letter",
+			input:    "Привет, как дела?",
+			expected: 15,
+		},
+		{
+			desc:     "counts three tokens per emoji",
+			input:    "Great 👍🎉",
+			expected: 7,
+		},
+		{
+			desc:     "counts accented letters on their own",
+			input:    "café",
+			expected: 2,
+		},
+		{
+			desc:     "counts nothing for empty text",
+			input:    "",
+			expected: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result := Estimate(tc.input)
+			if result != tc.expected {
+				t.Errorf("expected '%d', got '%d'", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestFit(t *testing.T) {
+	turns := []thread.Turn{
+		{Role: thread.RoleUser, Content: "one two three"},
+		{Role: thread.RoleAssistant, Content: "four five six"},
+		{Role: thread.RoleUser, Content: "seven eight nine"},
+	}
+	cases := []struct {
+		desc     string
+		input    []thread.Turn
+		budget   int
+		expected []thread.Turn
+	}{
+		{
+			desc:     "keeps everything within budget",
+			input:    turns,
+			budget:   100,
+			expected: turns,
+		},
+		{
+			desc:     "drops the oldest turns",
+			input:    turns,
+			budget:   replyOverhead + 2*(turnOverhead+3),
+			expected: turns[1:],
+		},
+		{
+			desc:   "truncates the start of the newest turn",
+			input:  turns,
+			budget: replyOverhead + turnOverhead + 2,
+			expected: []thread.Turn{
+				{Role: thread.RoleUser, Content: "eight nine"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result, used := Fit(tc.input, tc.budget)
+			if !reflect.DeepEqual(tc.expected, result) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, result)
+			}
+
+			if used > tc.budget {
+				t.Errorf("expected at most '%d' tokens, got '%d'", tc.budget, used)
+			}
+		})
+	}
+}
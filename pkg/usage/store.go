@@ -0,0 +1,196 @@
+package usage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStore keeps the usage records in memory. When opened with a path
+// every record is also appended to a file, one JSON record per line, so they
+// survive a restart.
+type MemoryStore struct {
+	records []Record
+	file    *os.File
+	enc     *json.Encoder
+
+	mu sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// OpenFileStore returns a memory store appending to the file at path, the
+// records already in it are restored.
+func OpenFileStore(path string) (*MemoryStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open usage file: %w", err)
+	}
+
+	s := NewMemoryStore()
+	dec := json.NewDecoder(f)
+	for {
+		var rec Record
+		offset := dec.InputOffset()
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A crash can leave a partially written last record behind.
+			if err := f.Truncate(offset); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("truncate torn usage record: %w", err)
+			}
+
+			break
+		}
+
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("read usage record: %w", err)
+		}
+
+		s.records = append(s.records, rec)
+	}
+
+	s.file = f
+	s.enc = json.NewEncoder(f)
+	return s, nil
+}
+
+func (s *MemoryStore) Add(rec Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enc != nil {
+		if err := s.enc.Encode(rec); err != nil {
+			return fmt.Errorf("write usage record: %w", err)
+		}
+	}
+
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func (s *MemoryStore) Query(f Filter) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []Record
+	for _, rec := range s.records {
+		if f.match(rec) {
+			records = append(records, rec)
+		}
+	}
+
+	return records, nil
+}
+
+func (s *MemoryStore) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return fmt.Errorf("sync usage file: %w", err)
+	}
+
+	return s.file.Close()
+}
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS usage_records (
+	seq               INTEGER PRIMARY KEY AUTOINCREMENT,
+	time              INTEGER NOT NULL,
+	chat_id           INTEGER NOT NULL,
+	user_id           INTEGER NOT NULL,
+	thread_id         TEXT NOT NULL,
+	model             TEXT NOT NULL,
+	prompt_tokens     INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	cost              REAL NOT NULL,
+	priced            INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS usage_records_time ON usage_records (time);
+`
+
+// SQLStore keeps the usage records in a SQL database, such as the one threads
+// are stored in.
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, fmt.Errorf("migrate usage schema: %w", err)
+	}
+
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Add(rec Record) error {
+	_, err := s.db.Exec(
+		`INSERT INTO usage_records (time, chat_id, user_id, thread_id, model, prompt_tokens, completion_tokens, cost, priced)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.Time.UnixNano(), rec.ChatID, rec.UserID, rec.ThreadID.String(), rec.Model,
+		rec.PromptTokens, rec.CompletionTokens, rec.Cost, rec.Priced,
+	)
+	if err != nil {
+		return fmt.Errorf("save usage record: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLStore) Query(f Filter) ([]Record, error) {
+	rows, err := s.db.Query(
+		`SELECT time, chat_id, user_id, thread_id, model, prompt_tokens, completion_tokens, cost, priced
+		FROM usage_records WHERE time >= ? AND time < ? AND (? = 0 OR chat_id = ?) ORDER BY seq`,
+		f.Since.UnixNano(), f.Until.UnixNano(), f.ChatID, f.ChatID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query usage records: %w", err)
+	}
+
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		var rec Record
+		var nanos int64
+		var threadID string
+		err := rows.Scan(&nanos, &rec.ChatID, &rec.UserID, &threadID, &rec.Model, &rec.PromptTokens, &rec.CompletionTokens, &rec.Cost, &rec.Priced)
+		if err != nil {
+			return nil, fmt.Errorf("scan usage record: %w", err)
+		}
+
+		rec.Time = time.Unix(0, nanos).UTC()
+		if rec.ThreadID, err = uuid.Parse(threadID); err != nil {
+			return nil, fmt.Errorf("parse thread id of usage record: %w", err)
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query usage records: %w", err)
+	}
+
+	return records, nil
+}
+
+// Close leaves the database open, usage records share it with the threads
+// and are written as they are added.
+func (s *SQLStore) Close() error {
+	return nil
+}
@@ -0,0 +1,309 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/tokens"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidPrice = errors.New("invalid price")
+
+// Price is what a model costs in USD per 1000 tokens of the prompt and of the
+// completion.
+type Price struct {
+	Prompt     float64
+	Completion float64
+}
+
+// Prices maps models to their price.
+type Prices map[string]Price
+
+// DefaultPrices are the prices of the models /tweak offers.
+var DefaultPrices = Prices{
+	"text-davinci-003": {Prompt: 0.02, Completion: 0.02},
+	"text-curie-001":   {Prompt: 0.002, Completion: 0.002},
+	"text-babbage-001": {Prompt: 0.0005, Completion: 0.0005},
+	"text-ada-001":     {Prompt: 0.0004, Completion: 0.0004},
+	"gpt-3.5-turbo":    {Prompt: 0.0015, Completion: 0.002},
+	"gpt-4":            {Prompt: 0.03, Completion: 0.06},
+}
+
+// ParsePrices parses a comma separated list of "model=prompt/completion"
+// prices and adds them to a copy of base.
+func ParsePrices(s string, base Prices) (Prices, error) {
+	prices := Prices{}
+	for model, p := range base {
+		prices[model] = p
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		model, price, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("'%s': %w", entry, ErrInvalidPrice)
+		}
+
+		prompt, completion, ok := strings.Cut(price, "/")
+		if !ok {
+			completion = prompt
+		}
+
+		var p Price
+		var err error
+		if p.Prompt, err = strconv.ParseFloat(strings.TrimSpace(prompt), 64); err != nil {
+			return nil, fmt.Errorf("'%s': %w", entry, ErrInvalidPrice)
+		}
+
+		if p.Completion, err = strconv.ParseFloat(strings.TrimSpace(completion), 64); err != nil {
+			return nil, fmt.Errorf("'%s': %w", entry, ErrInvalidPrice)
+		}
+
+		prices[strings.TrimSpace(model)] = p
+	}
+
+	return prices, nil
+}
+
+// Cost returns the cost of u with model, and whether the model has a price.
+func (p Prices) Cost(model string, u completion.Usage) (float64, bool) {
+	price, ok := p[model]
+	if !ok {
+		return 0, false
+	}
+
+	return (float64(u.PromptTokens)*price.Prompt + float64(u.CompletionTokens)*price.Completion) / 1000, true
+}
+
+// Of returns the usage resp reports, or an estimate from the text of req and
+// resp for providers that don't report it, such as when streaming.
+func Of(req completion.Request, resp completion.Response) completion.Usage {
+	if resp.Usage.TotalTokens > 0 {
+		return resp.Usage
+	}
+
+	u := completion.Usage{CompletionTokens: tokens.Estimate(resp.Text)}
+	if len(req.Messages) == 0 {
+		u.PromptTokens = tokens.Estimate(req.Prompt)
+	}
+
+	for _, m := range req.Messages {
+		u.PromptTokens += tokens.Estimate(m.Content)
+	}
+
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+// Attribution tells who a completion is for.
+type Attribution struct {
+	ChatID   int64
+	UserID   int64
+	ThreadID uuid.UUID
+}
+
+type attributionKey struct{}
+
+// WithAttribution returns a context attributing completions made with it to a.
+func WithAttribution(ctx context.Context, a Attribution) context.Context {
+	return context.WithValue(ctx, attributionKey{}, a)
+}
+
+// AttributionFrom returns the attribution of ctx.
+func AttributionFrom(ctx context.Context) (Attribution, bool) {
+	a, ok := ctx.Value(attributionKey{}).(Attribution)
+	return a, ok
+}
+
+// Record is the usage of a single completion.
+type Record struct {
+	Time             time.Time `json:"time"`
+	ChatID           int64     `json:"chat_id"`
+	UserID           int64     `json:"user_id"`
+	ThreadID         uuid.UUID `json:"thread_id"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+	// Priced is false when the model had no price, its cost is unknown.
+	Priced bool `json:"priced"`
+}
+
+// Filter selects records from Since until before Until, of a single chat
+// unless ChatID is 0.
+type Filter struct {
+	ChatID int64
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f Filter) match(r Record) bool {
+	if f.ChatID != 0 && r.ChatID != f.ChatID {
+		return false
+	}
+
+	return !r.Time.Before(f.Since) && r.Time.Before(f.Until)
+}
+
+// Store keeps the usage records.
+type Store interface {
+	Add(Record) error
+	Query(Filter) ([]Record, error)
+	Close() error
+}
+
+// Ledger records the usage of completions and what they cost.
+type Ledger struct {
+	store  Store
+	prices Prices
+	now    func() time.Time
+}
+
+func NewLedger(store Store, prices Prices) *Ledger {
+	return &Ledger{store: store, prices: prices, now: time.Now}
+}
+
+// Record adds the usage of a completion with model attributed to a.
+func (l *Ledger) Record(a Attribution, model string, u completion.Usage) error {
+	cost, priced := l.prices.Cost(model, u)
+	return l.store.Add(Record{
+		Time:             l.now().UTC(),
+		ChatID:           a.ChatID,
+		UserID:           a.UserID,
+		ThreadID:         a.ThreadID,
+		Model:            model,
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		Cost:             cost,
+		Priced:           priced,
+	})
+}
+
+// Records returns the records selected by f.
+func (l *Ledger) Records(f Filter) ([]Record, error) {
+	return l.store.Query(f)
+}
+
+// Now returns the time of the ledger's clock.
+func (l *Ledger) Now() time.Time {
+	return l.now().UTC()
+}
+
+func (l *Ledger) Close() error {
+	return l.store.Close()
+}
+
+// Meter is a provider recording the usage of every completion in a ledger,
+// attributed through the context of the call.
+type Meter struct {
+	provider completion.Provider
+	ledger   *Ledger
+}
+
+// streamingMeter is a Meter of a provider that streams.
+type streamingMeter struct {
+	*Meter
+	streamer completion.Streamer
+}
+
+// NewMeter wraps provider in a Meter, the returned provider streams if
+// provider does.
+func NewMeter(provider completion.Provider, ledger *Ledger) completion.Provider {
+	m := &Meter{provider: provider, ledger: ledger}
+	if streamer, ok := provider.(completion.Streamer); ok {
+		return streamingMeter{Meter: m, streamer: streamer}
+	}
+
+	return m
+}
+
+func (m *Meter) record(ctx context.Context, req completion.Request, resp completion.Response) {
+	a, _ := AttributionFrom(ctx)
+	if err := m.ledger.Record(a, req.Model, Of(req, resp)); err != nil {
+		log.Printf("failed to record usage of chat %d: %s", a.ChatID, err)
+	}
+}
+
+func (m *Meter) Complete(ctx context.Context, req completion.Request) (completion.Response, error) {
+	resp, err := m.provider.Complete(ctx, req)
+	if err == nil {
+		m.record(ctx, req, resp)
+	}
+
+	return resp, err
+}
+
+func (m streamingMeter) Stream(ctx context.Context, req completion.Request, onText func(string)) (completion.Response, error) {
+	resp, err := m.streamer.Stream(ctx, req, onText)
+	if err == nil {
+		m.record(ctx, req, resp)
+	}
+
+	return resp, err
+}
+
+// Row sums up the records sharing a key.
+type Row struct {
+	Key              string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	// Unpriced counts the requests to models without a price.
+	Unpriced int
+}
+
+func (r Row) Tokens() int {
+	return r.PromptTokens + r.CompletionTokens
+}
+
+// Summarize sums up records by the key returned for each, sorted by key.
+func Summarize(records []Record, key func(Record) string) []Row {
+	rows := map[string]*Row{}
+	for _, rec := range records {
+		k := key(rec)
+		row, ok := rows[k]
+		if !ok {
+			row = &Row{Key: k}
+			rows[k] = row
+		}
+
+		row.Requests++
+		row.PromptTokens += rec.PromptTokens
+		row.CompletionTokens += rec.CompletionTokens
+		row.Cost += rec.Cost
+		if !rec.Priced {
+			row.Unpriced++
+		}
+	}
+
+	summary := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		summary = append(summary, *row)
+	}
+
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Key < summary[j].Key })
+	return summary
+}
+
+// ByDay keys records by their day, e.g. "2023-04-01".
+func ByDay(r Record) string {
+	return r.Time.Format("2006-01-02")
+}
+
+// ByWeek keys records by their ISO week, e.g. "2023-W13".
+func ByWeek(r Record) string {
+	year, week := r.Time.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
@@ -0,0 +1,228 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"telegram-bot/pkg/completion"
+	"telegram-bot/pkg/storage"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestParsePrices(t *testing.T) {
+	cases := []struct {
+		desc        string
+		prices      string
+		expected    Prices
+		expectedErr error
+	}{
+		{
+			desc:     "keeps the base prices",
+			prices:   "",
+			expected: Prices{"a": {Prompt: 1, Completion: 2}},
+		},
+		{
+			desc:   "adds and overrides prices",
+			prices: "a=0.5/1, b = 0.1",
+			expected: Prices{
+				"a": {Prompt: 0.5, Completion: 1},
+				"b": {Prompt: 0.1, Completion: 0.1},
+			},
+		},
+		{
+			desc:        "rejects entries without a price",
+			prices:      "a",
+			expectedErr: ErrInvalidPrice,
+		},
+		{
+			desc:        "rejects prices that aren't numbers",
+			prices:      "a=cheap",
+			expectedErr: ErrInvalidPrice,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			prices, err := ParsePrices(tc.prices, Prices{"a": {Prompt: 1, Completion: 2}})
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error '%v', got '%v'", tc.expectedErr, err)
+			}
+
+			if !reflect.DeepEqual(prices, tc.expected) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, prices)
+			}
+		})
+	}
+}
+
+func TestOf(t *testing.T) {
+	reported := completion.Usage{PromptTokens: 3, CompletionTokens: 4, TotalTokens: 7}
+	if u := Of(completion.Request{}, completion.Response{Text: "Hi", Usage: reported}); u != reported {
+		t.Errorf("expected '%v', got '%v'", reported, u)
+	}
+
+	req := completion.Request{Messages: []completion.Message{{Content: "Hello there"}, {Content: "Hi"}}}
+	u := Of(req, completion.Response{Text: "How are you?"})
+	if u.PromptTokens == 0 || u.CompletionTokens == 0 || u.TotalTokens != u.PromptTokens+u.CompletionTokens {
+		t.Errorf("expected an estimate of the usage, got '%v'", u)
+	}
+}
+
+func TestMeter(t *testing.T) {
+	provider := &completion.Fake{Steps: []completion.Step{
+		{Response: completion.Response{Text: "Hi", Usage: completion.Usage{PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500}}},
+		{Err: completion.ErrAPI},
+		{Response: completion.Response{Text: "Hi", Usage: completion.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}}},
+	}}
+
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	ledger := NewLedger(NewMemoryStore(), Prices{"priced": {Prompt: 0.002, Completion: 0.004}})
+	ledger.now = func() time.Time { return now }
+	meter := NewMeter(provider, ledger)
+
+	a := Attribution{ChatID: -3, UserID: 2, ThreadID: uuid.New()}
+	ctx := WithAttribution(context.Background(), a)
+	streamer, ok := meter.(completion.Streamer)
+	if !ok {
+		t.Fatalf("expected the meter of a streaming provider to stream")
+	}
+
+	streamer.Stream(ctx, completion.Request{Model: "priced"}, func(string) {})
+	meter.Complete(ctx, completion.Request{Model: "priced"})
+	meter.Complete(ctx, completion.Request{Model: "unpriced"})
+
+	records, err := ledger.Records(Filter{Since: now, Until: now.Add(time.Second)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []Record{
+		{Time: now, ChatID: -3, UserID: 2, ThreadID: a.ThreadID, Model: "priced", PromptTokens: 1000, CompletionTokens: 500, Cost: 0.004, Priced: true},
+		{Time: now, ChatID: -3, UserID: 2, ThreadID: a.ThreadID, Model: "unpriced", PromptTokens: 10, CompletionTokens: 5},
+	}
+
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected '%v', got '%v'", expected, records)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	at := func(day int) time.Time { return time.Date(2023, 4, day, 12, 0, 0, 0, time.UTC) }
+	records := []Record{
+		{Time: at(2), PromptTokens: 1, CompletionTokens: 2, Cost: 0.5, Priced: true},
+		{Time: at(3), PromptTokens: 3, CompletionTokens: 4, Cost: 0.25, Priced: true},
+		{Time: at(2), PromptTokens: 5, CompletionTokens: 6},
+	}
+
+	cases := []struct {
+		desc     string
+		key      func(Record) string
+		expected []Row
+	}{
+		{
+			desc: "sums up days",
+			key:  ByDay,
+			expected: []Row{
+				{Key: "2023-04-02", Requests: 2, PromptTokens: 6, CompletionTokens: 8, Cost: 0.5, Unpriced: 1},
+				{Key: "2023-04-03", Requests: 1, PromptTokens: 3, CompletionTokens: 4, Cost: 0.25},
+			},
+		},
+		{
+			desc: "sums up iso weeks",
+			key:  ByWeek,
+			expected: []Row{
+				{Key: "2023-W13", Requests: 2, PromptTokens: 6, CompletionTokens: 8, Cost: 0.5, Unpriced: 1},
+				{Key: "2023-W14", Requests: 1, PromptTokens: 3, CompletionTokens: 4, Cost: 0.25},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rows := Summarize(records, tc.key)
+			if !reflect.DeepEqual(rows, tc.expected) {
+				t.Errorf("expected '%v', got '%v'", tc.expected, rows)
+			}
+		})
+	}
+}
+
+// stores lists every Store implementation, each is reopened from the same
+// path to check that the records survive a restart.
+var stores = []struct {
+	name string
+	open func(t *testing.T, path string) (Store, error)
+}{
+	{
+		name: "file",
+		open: func(_ *testing.T, path string) (Store, error) {
+			return OpenFileStore(path)
+		},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T, path string) (Store, error) {
+			db, err := storage.OpenSQLite(path)
+			if err != nil {
+				return nil, err
+			}
+
+			t.Cleanup(func() { db.Close() })
+			return NewSQLStore(db)
+		},
+	},
+}
+
+func TestStores(t *testing.T) {
+	day := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Time: day.Add(time.Hour), ChatID: -3, UserID: 2, ThreadID: uuid.New(), Model: "gpt-4", PromptTokens: 10, CompletionTokens: 20, Cost: 0.0015, Priced: true},
+		{Time: day.Add(2 * time.Hour), ChatID: -4, UserID: 2, ThreadID: uuid.New(), Model: "other", PromptTokens: 1, CompletionTokens: 2},
+		{Time: day.Add(25 * time.Hour), ChatID: -3, UserID: 5, ThreadID: uuid.New(), Model: "gpt-4", PromptTokens: 3, CompletionTokens: 4, Cost: 0.0003, Priced: true},
+	}
+
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "usage")
+			store, err := s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error opening store: %v", err)
+			}
+
+			for _, rec := range records {
+				if err := store.Add(rec); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			store.Close()
+			store, err = s.open(t, path)
+			if err != nil {
+				t.Fatalf("unexpected error reopening store: %v", err)
+			}
+
+			defer store.Close()
+			all, err := store.Query(Filter{Since: day, Until: day.AddDate(0, 0, 2)})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(all, records) {
+				t.Errorf("expected '%v', got '%v'", records, all)
+			}
+
+			chat, err := store.Query(Filter{ChatID: -3, Since: day, Until: day.AddDate(0, 0, 1)})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if expected := records[:1]; !reflect.DeepEqual(chat, expected) {
+				t.Errorf("expected '%v', got '%v'", expected, chat)
+			}
+		})
+	}
+}